@@ -0,0 +1,561 @@
+// Package aare is a small AppArmor regular expression (AARE) engine, only
+// the subset used in file rules is supported: literals, ?, *, **, []
+// classes and {} alternations.
+package aare
+
+import (
+	"sort"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokChar tokenKind = iota
+	// ? and the first character of a * or ** directly after a /
+	tokAny
+	tokClass
+	tokStar
+	tokStarStar
+)
+
+type token struct {
+	kind   tokenKind
+	c      rune
+	class  string
+	negate bool
+}
+
+// maximum number of patterns an alternation is expanded into before
+// giving up
+const MaxExpansion = 4096
+
+// classEnd returns the index of the ] closing the character class opened
+// at i, or -1 if it is never closed. A ] right after the [ or [^ is a
+// member of the class, as in tokenize.
+func classEnd(p string, i int) int {
+	end := i + 1
+	if end < len(p) && p[end] == '^' {
+		end++
+	}
+	if end < len(p) && p[end] == ']' {
+		end++
+	}
+	for end < len(p) && p[end] != ']' {
+		end++
+	}
+	if end >= len(p) {
+		return -1
+	}
+	return end
+}
+
+// SkipClass returns the index to continue scanning the pattern from if a
+// character class starts at i, so the characters in it are not mistaken
+// for separators or braces
+func SkipClass(p string, i int) int {
+	if p[i] == '[' {
+		if end := classEnd(p, i); end > 0 {
+			return end
+		}
+	}
+	return i
+}
+
+// Fields splits a rule into its whitespace separated words like
+// strings.Fields, but a quoted path or one with an escaped space is a
+// single word. The words are returned as written, quotes and escapes
+// included.
+func Fields(s string) []string {
+	var fields []string
+	start, quoted := -1, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			if start < 0 {
+				start = i
+			}
+			i++
+		case c == '"':
+			if start < 0 {
+				start = i
+			}
+			quoted = !quoted
+		case strings.IndexByte(" \t\r\n\v\f", c) >= 0 && !quoted:
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+	}
+	return fields
+}
+
+// Unquote drops the quotes around a path, which the pattern does not
+// include
+func Unquote(p string) string {
+	if len(p) >= 2 && p[0] == '"' && p[len(p)-1] == '"' {
+		return p[1 : len(p)-1]
+	}
+	return p
+}
+
+// SplitPath splits the pattern into its path components, a / within a
+// character class does not separate components
+func SplitPath(p string) []string {
+	var parts []string
+	last := 0
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '[':
+			i = SkipClass(p, i)
+		case '/':
+			parts = append(parts, p[last:i])
+			last = i + 1
+		}
+	}
+	return append(parts, p[last:])
+}
+
+// HasUnbracedComma reports whether the part has a comma outside of any
+// alternation or character class, as the parts merged by pass 2 have
+// until they are braced
+func HasUnbracedComma(p string) bool {
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '[':
+			i = SkipClass(p, i)
+		case '{':
+			return false
+		case ',':
+			return true
+		}
+	}
+	return false
+}
+
+func ClosingBrace(p string, start int) int {
+	depth := 0
+	for i := start; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '[':
+			i = SkipClass(p, i)
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func SplitAlternation(p string) []string {
+	var parts []string
+	depth := 0
+	last := 0
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '[':
+			i = SkipClass(p, i)
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, p[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(parts, p[last:])
+}
+
+// Group is a top level {} group within a pattern
+type Group struct {
+	// Start and End are the indexes of the braces
+	Start   int
+	End     int
+	Members []string
+}
+
+// Groups returns the top level alternations of the pattern, variables
+// like @{HOME} are not alternations
+func Groups(p string) []Group {
+	var groups []Group
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' {
+			i++
+			continue
+		}
+		if p[i] == '[' {
+			i = SkipClass(p, i)
+			continue
+		}
+		if p[i] != '{' || (i > 0 && p[i-1] == '@') {
+			continue
+		}
+		end := ClosingBrace(p, i)
+		if end < 0 {
+			break
+		}
+		groups = append(groups, Group{
+			Start:   i,
+			End:     end,
+			Members: SplitAlternation(p[i+1 : end]),
+		})
+		i = end
+	}
+	return groups
+}
+
+// JoinAlternation writes the members as an alternation, a single member
+// needs no braces
+func JoinAlternation(members []string) string {
+	if len(members) == 1 {
+		return members[0]
+	}
+	return "{" + strings.Join(members, ",") + "}"
+}
+
+// Canonical orders and deduplicates the members of every
+// alternation of the pattern, and drops the braces of alternations with a
+// single member, so {a,b} and {b,a,a} written by different edits compare
+// equal
+func Canonical(p string) string {
+	groups := Groups(p)
+	if len(groups) == 0 {
+		return p
+	}
+	var sb strings.Builder
+	last := 0
+	for _, g := range groups {
+		seen := make(map[string]bool)
+		var members []string
+		for _, m := range g.Members {
+			m = Canonical(m)
+			if !seen[m] {
+				seen[m] = true
+				members = append(members, m)
+			}
+		}
+		sort.Strings(members)
+		sb.WriteString(p[last:g.Start])
+		sb.WriteString(JoinAlternation(members))
+		last = g.End + 1
+	}
+	sb.WriteString(p[last:])
+	return sb.String()
+}
+
+// Expand expands all {} groups of the pattern, variables like
+// @{HOME} are left untouched. The boolean is false if the expansion would
+// exceed MaxExpansion patterns.
+func Expand(p string) ([]string, bool) {
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' {
+			i++
+			continue
+		}
+		if p[i] == '[' {
+			i = SkipClass(p, i)
+			continue
+		}
+		if p[i] != '{' || (i > 0 && p[i-1] == '@') {
+			continue
+		}
+		end := ClosingBrace(p, i)
+		if end < 0 {
+			return []string{p}, true
+		}
+
+		var result []string
+		for _, alt := range SplitAlternation(p[i+1 : end]) {
+			expanded, ok := Expand(p[:i] + alt + p[end+1:])
+			if !ok {
+				return nil, false
+			}
+			result = append(result, expanded...)
+			if len(result) > MaxExpansion {
+				return nil, false
+			}
+		}
+		return result, true
+	}
+	return []string{p}, true
+}
+
+// tokenize converts a pattern without alternations into tokens. A * or **
+// directly following a / never matches the empty string.
+func tokenize(p string) []token {
+	var tokens []token
+	rs := []rune(p)
+	for i := 0; i < len(rs); i++ {
+		switch rs[i] {
+		case '\\':
+			if i+1 < len(rs) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokChar, c: rs[i]})
+		case '?':
+			tokens = append(tokens, token{kind: tokAny})
+		case '*':
+			kind := tokStar
+			if i+1 < len(rs) && rs[i+1] == '*' {
+				kind = tokStarStar
+				for i+1 < len(rs) && rs[i+1] == '*' {
+					i++
+				}
+			}
+			if len(tokens) > 0 && tokens[len(tokens)-1].kind == tokChar && tokens[len(tokens)-1].c == '/' {
+				tokens = append(tokens, token{kind: tokAny})
+			}
+			tokens = append(tokens, token{kind: kind})
+		case '[':
+			end := i + 1
+			if end < len(rs) && rs[end] == '^' {
+				end++
+			}
+			if end < len(rs) && rs[end] == ']' {
+				end++
+			}
+			for end < len(rs) && rs[end] != ']' {
+				end++
+			}
+			if end == len(rs) {
+				tokens = append(tokens, token{kind: tokChar, c: rs[i]})
+				continue
+			}
+			t := token{kind: tokClass, class: string(rs[i+1 : end])}
+			if strings.HasPrefix(t.class, "^") {
+				t.negate = true
+				t.class = t.class[1:]
+			}
+			tokens = append(tokens, t)
+			i = end
+		default:
+			tokens = append(tokens, token{kind: tokChar, c: rs[i]})
+		}
+	}
+	return tokens
+}
+
+// Wildcards returns the globs of a pattern without alternations in the
+// order they appear, as "**", "*" or "[]"
+func Wildcards(p string) []string {
+	var globs []string
+	for _, t := range tokenize(p) {
+		switch t.kind {
+		case tokStarStar:
+			globs = append(globs, "**")
+		case tokStar:
+			globs = append(globs, "*")
+		case tokClass:
+			globs = append(globs, "[]")
+		}
+	}
+	return globs
+}
+
+func (t token) isStar() bool {
+	return t.kind == tokStar || t.kind == tokStarStar
+}
+
+func (t token) classContains(c rune) bool {
+	rs := []rune(t.class)
+	found := false
+	for i := 0; i < len(rs); i++ {
+		if i+2 < len(rs) && rs[i+1] == '-' {
+			if c >= rs[i] && c <= rs[i+2] {
+				found = true
+			}
+			i += 2
+		} else if rs[i] == c {
+			found = true
+		}
+	}
+	return found != t.negate
+}
+
+// singleOverlap reports whether two single character tokens can match
+// the same character. Two classes are assumed to overlap.
+func singleOverlap(a, b token) bool {
+	if a.kind == tokChar && b.kind == tokChar {
+		return a.c == b.c
+	}
+	if b.kind == tokChar {
+		a, b = b, a
+	}
+	if a.kind == tokChar {
+		if a.c == '/' {
+			return false
+		}
+		if b.kind == tokClass {
+			return b.classContains(a.c)
+		}
+	}
+	return true
+}
+
+// starConsumes reports whether the star token can match (part of)
+// whatever the other token matches.
+func starConsumes(star, t token) bool {
+	if star.kind == tokStarStar {
+		return true
+	}
+	if t.kind == tokChar {
+		return t.c != '/'
+	}
+	return t.kind != tokStarStar
+}
+
+type tokenPair struct {
+	i, j int
+}
+
+func intersects(a, b []token, i, j int, memo map[tokenPair]bool) bool {
+	if i == len(a) && j == len(b) {
+		return true
+	}
+	key := tokenPair{i, j}
+	if res, ok := memo[key]; ok {
+		return res
+	}
+	res := false
+	if i < len(a) && a[i].isStar() {
+		res = intersects(a, b, i+1, j, memo) ||
+			(j < len(b) && !b[j].isStar() && starConsumes(a[i], b[j]) && intersects(a, b, i, j+1, memo))
+	}
+	if !res && j < len(b) && b[j].isStar() {
+		res = intersects(a, b, i, j+1, memo) ||
+			(i < len(a) && !a[i].isStar() && starConsumes(b[j], a[i]) && intersects(a, b, i+1, j, memo))
+	}
+	if !res && i < len(a) && j < len(b) && !a[i].isStar() && !b[j].isStar() {
+		res = singleOverlap(a[i], b[j]) && intersects(a, b, i+1, j+1, memo)
+	}
+	memo[key] = res
+	return res
+}
+
+// Intersects reports whether any path can be matched by both patterns.
+// If the alternations are too large to expand, they are assumed to overlap.
+func Intersects(p1, p2 string) bool {
+	e1, ok1 := Expand(p1)
+	e2, ok2 := Expand(p2)
+	if !ok1 || !ok2 {
+		return true
+	}
+	for _, a := range e1 {
+		ta := tokenize(a)
+		for _, b := range e2 {
+			if intersects(ta, tokenize(b), 0, 0, make(map[tokenPair]bool)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// singleCovers reports whether the general token matches everything the
+// specific token matches.
+func singleCovers(g, s token) bool {
+	switch g.kind {
+	case tokChar:
+		return s.kind == tokChar && s.c == g.c
+	case tokAny:
+		return (s.kind == tokChar && s.c != '/') || s.kind == tokAny || s.kind == tokClass
+	case tokClass:
+		if s.kind == tokChar {
+			return g.classContains(s.c)
+		}
+		return s.kind == tokClass && s.class == g.class && s.negate == g.negate
+	}
+	return false
+}
+
+func covers(g, s []token, i, j int, memo map[tokenPair]bool) bool {
+	if i == len(g) {
+		return j == len(s)
+	}
+	key := tokenPair{i, j}
+	if res, ok := memo[key]; ok {
+		return res
+	}
+
+	var res bool
+	if g[i].isStar() {
+		res = covers(g, s, i+1, j, memo) ||
+			(j < len(s) && starConsumes(g[i], s[j]) && covers(g, s, i, j+1, memo))
+	} else {
+		res = j < len(s) && singleCovers(g[i], s[j]) && covers(g, s, i+1, j+1, memo)
+	}
+	memo[key] = res
+	return res
+}
+
+// Covers reports whether every path matched by specific is also
+// matched by general. The check is conservative, it may report false for
+// exotic patterns that are in fact covered, but never the reverse.
+func Covers(general, specific string) bool {
+	eg, okg := Expand(general)
+	es, oks := Expand(specific)
+	if !okg || !oks {
+		return false
+	}
+
+	var tg [][]token
+	for _, g := range eg {
+		tg = append(tg, tokenize(g))
+	}
+	for _, s := range es {
+		ts := tokenize(s)
+		found := false
+		for _, g := range tg {
+			if covers(g, ts, 0, 0, make(map[tokenPair]bool)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether the pattern matches the concrete path.
+func Match(pattern, path string) bool {
+	var tp []token
+	for _, c := range path {
+		tp = append(tp, token{kind: tokChar, c: c})
+	}
+
+	expanded, ok := Expand(pattern)
+	if !ok {
+		return false
+	}
+	for _, e := range expanded {
+		if covers(tokenize(e), tp, 0, 0, make(map[tokenPair]bool)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package aare
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzTokenize makes sure the pattern lexer and matcher never panic on a
+// malformed pattern
+func FuzzTokenize(f *testing.F) {
+	for _, seed := range []string{
+		"/sys/devices/**",
+		"/a/{b,c}/[^.]*",
+		"/a/[a-",
+		`/a/\`,
+		"/a/{b,{c,d}}",
+		"@{HOME}/.config/*",
+		"[",
+		"{",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, p string) {
+		tokenize(p)
+		Fields(p)
+		SplitPath(p)
+		Expand(p)
+		Match(p, "/a/b")
+	})
+}
+
+func TestOverlaps(t *testing.T) {
+	for _, tc := range []struct {
+		p1, p2 string
+		want   Relation
+	}{
+		{"/a/b", "/a/b", Equal},
+		{"/a/{b,c}", "/a/{c,b}", Equal},
+		{"/a/b", "/a/*", Subset},
+		{"/a/**", "/a/b/c", Superset},
+		{"/a/*", "/a/b/*", Disjoint},
+		{"/a/b*", "/a/*c", Intersecting},
+		{"@{HOME}/x", "@{HOME}/*", Subset},
+	} {
+		got, err := Overlaps(tc.p1, tc.p2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("Overlaps(%q, %q) = %v, want %v", tc.p1, tc.p2, got, tc.want)
+		}
+	}
+	for _, p := range []string{"a/b", "/a/{b", "/a/b}"} {
+		if _, err := Overlaps(p, "/a/**"); err == nil {
+			t.Errorf("Overlaps(%q) did not fail", p)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	for _, tc := range []struct {
+		rule string
+		want []string
+	}{
+		{"owner /a/b rw", []string{"owner", "/a/b", "rw"}},
+		{"  /a/b\tr  ", []string{"/a/b", "r"}},
+		{`"/a/quoted path" r`, []string{`"/a/quoted path"`, "r"}},
+		{`deny "/a/quoted path"`, []string{"deny", `"/a/quoted path"`}},
+		{`/a/escaped\ path r`, []string{`/a/escaped\ path`, "r"}},
+		{`/a/{b,c d} r`, []string{"/a/{b,c", "d}", "r"}},
+		{"", nil},
+	} {
+		if got := Fields(tc.rule); strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("Fields(%q) = %q, want %q", tc.rule, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package aare
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Relation is how the paths matched by two AARE patterns relate
+type Relation int
+
+const (
+	// Disjoint patterns never match the same path
+	Disjoint Relation = iota
+	// Subset is reported when every path the first pattern matches is
+	// matched by the second as well
+	Subset
+	// Superset is the reverse of Subset
+	Superset
+	// Equal patterns match exactly the same paths
+	Equal
+	// Intersecting patterns match some paths in common but neither
+	// contains the other
+	Intersecting
+)
+
+func (r Relation) String() string {
+	switch r {
+	case Disjoint:
+		return "disjoint"
+	case Subset:
+		return "subset"
+	case Superset:
+		return "superset"
+	case Equal:
+		return "equal"
+	}
+	return "intersecting"
+}
+
+// Check reports patterns the matching engine cannot reason about
+func Check(p string) error {
+	if !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "@{") {
+		return fmt.Errorf("pattern %q is not an absolute path", p)
+	}
+	depth := 0
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced } in pattern %q", p)
+			}
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced { in pattern %q", p)
+	}
+	if _, ok := Expand(p); !ok {
+		return fmt.Errorf("pattern %q expands to more than %d alternatives", p, MaxExpansion)
+	}
+	return nil
+}
+
+// Overlaps returns how the paths matched by the two patterns relate. The
+// containment checks are conservative, two patterns reported as
+// Intersecting may in rare cases be a subset of one another, but a
+// reported Subset or Superset always holds.
+func Overlaps(p1, p2 string) (Relation, error) {
+	sub, err := Contained(p1, p2)
+	if err != nil {
+		return Disjoint, err
+	}
+
+	super := Covers(p1, p2)
+	switch {
+	case sub && super:
+		return Equal, nil
+	case sub:
+		return Subset, nil
+	case super:
+		return Superset, nil
+	case Intersects(p1, p2):
+		return Intersecting, nil
+	}
+	return Disjoint, nil
+}
+
+// Contained reports whether Overlaps finds the first pattern a Subset of
+// or Equal to the second, without working out the rest of the relation
+func Contained(p1, p2 string) (bool, error) {
+	if err := Check(p1); err != nil {
+		return false, err
+	}
+	if err := Check(p2); err != nil {
+		return false, err
+	}
+	return Covers(p2, p1), nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// abstraction is a shipped abstraction along with the file rules it
+// grants, those of the abstractions it includes among them
+type abstraction struct {
+	// name is the include path, i.e abstractions/nameservice
+	name  string
+	rules []profileRule
+}
+
+// loadAbstractions reads the abstractions below the include base
+func loadAbstractions(base string) ([]abstraction, error) {
+	entries, err := os.ReadDir(filepath.Join(base, "abstractions"))
+	if err != nil {
+		return nil, err
+	}
+	var abstractions []abstraction
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") || strings.Contains(e.Name(), ".dpkg-") {
+			continue
+		}
+		lines, _, err := flattenIncludes(filepath.Join(base, "abstractions", e.Name()), base)
+		if err != nil {
+			fmt.Printf("aaoptimizer: skipping abstraction %s: %v\n", e.Name(), err)
+			continue
+		}
+		a := abstraction{name: "abstractions/" + e.Name()}
+		for _, pr := range parseProfileRules(lines) {
+			if pr.isFile() && !pr.deny {
+				a.rules = append(a.rules, pr)
+			}
+		}
+		if len(a.rules) > 0 {
+			abstractions = append(abstractions, a)
+		}
+	}
+	return abstractions, nil
+}
+
+// grants reports whether the abstraction grants everything the rule does
+func (a *abstraction) grants(r profileRule) bool {
+	_, ok := a.provider(r)
+	return ok
+}
+
+// provider returns the rule of the abstraction granting everything the
+// rule does, if any
+func (a *abstraction) provider(r profileRule) (profileRule, bool) {
+	if !r.isFile() || r.deny || r.audit {
+		return profileRule{}, false
+	}
+	for _, ar := range a.rules {
+		if ar.owner && !r.owner || ar.target != r.target {
+			continue
+		}
+		if permsCover(strings.TrimSuffix(ar.perms, ","), strings.TrimSuffix(r.perms, ",")) && aare.Covers(ar.path, r.path) {
+			return ar, true
+		}
+	}
+	return profileRule{}, false
+}
+
+// abstractionSuggestion is a group of rules of a profile an abstraction
+// grants as well
+type abstractionSuggestion struct {
+	abstraction *abstraction
+	profile     *profileBlock
+	// lines are the 0-based indices of the rules
+	lines []int
+}
+
+// suggestAbstractions finds the abstractions granting at least minRules
+// of the rules of a profile that does not include them yet, the ones
+// granting the most rules first. Rules the abstractions the profile
+// includes already grant are not counted.
+func suggestAbstractions(lines []string, abstractions []abstraction, minRules int) []abstractionSuggestion {
+	blocks, owners := findProfiles(lines)
+	included := make(map[*profileBlock]map[string]bool)
+	for _, inc := range parseIncludes(lines) {
+		pb := owners[inc.line-1]
+		if included[pb] == nil {
+			included[pb] = make(map[string]bool)
+		}
+		included[pb][inc.path] = true
+	}
+
+	var suggestions []abstractionSuggestion
+	for i := range abstractions {
+		a := &abstractions[i]
+		byProfile := make(map[*profileBlock][]int)
+		for _, pr := range parseProfileRules(lines) {
+			pb := owners[pr.line-1]
+			if !included[pb][a.name] && a.grants(pr) && !grantedByIncluded(pr, abstractions, included[pb]) {
+				byProfile[pb] = append(byProfile[pb], pr.line-1)
+			}
+		}
+		// rules outside of any profile come first, then those of the
+		// profiles in file order
+		for _, pb := range append([]*profileBlock{nil}, blocks...) {
+			if len(byProfile[pb]) >= minRules {
+				suggestions = append(suggestions, abstractionSuggestion{a, pb, byProfile[pb]})
+			}
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return len(suggestions[i].lines) > len(suggestions[j].lines)
+	})
+	return suggestions
+}
+
+// grantedByIncluded reports whether one of the included abstractions
+// already grants the rule, so including another one for it gains nothing
+func grantedByIncluded(pr profileRule, abstractions []abstraction, included map[string]bool) bool {
+	for i := range abstractions {
+		if included[abstractions[i].name] && abstractions[i].grants(pr) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAbstractions replaces the rules of each suggestion with an include
+// of the abstraction where the first of them was. Rules already replaced
+// by an earlier suggestion are not claimed again, so suggestions left with
+// fewer than minRules rules are dropped.
+func applyAbstractions(lines []string, suggestions []abstractionSuggestion, minRules int) ([]string, []abstractionSuggestion) {
+	replaced := make(map[int]bool)
+	includes := make(map[int]string)
+	var applied []abstractionSuggestion
+	for _, s := range suggestions {
+		var left []int
+		for _, i := range s.lines {
+			if !replaced[i] {
+				left = append(left, i)
+			}
+		}
+		if len(left) < minRules {
+			continue
+		}
+		for _, i := range left {
+			replaced[i] = true
+		}
+		l := lines[left[0]]
+		includes[left[0]] = l[:len(l)-len(strings.TrimLeft(l, " \t"))] + "include <" + s.abstraction.name + ">"
+		s.lines = left
+		applied = append(applied, s)
+	}
+
+	var out []string
+	for i, l := range lines {
+		if inc, ok := includes[i]; ok {
+			out = append(out, inc)
+		}
+		if !replaced[i] {
+			out = append(out, l)
+		}
+	}
+	return out, applied
+}
+
+func describeSuggestion(file string, s abstractionSuggestion) string {
+	var numbers []int
+	for _, i := range s.lines {
+		numbers = append(numbers, i+1)
+	}
+	where := ""
+	if s.profile != nil {
+		where = " of profile " + s.profile.name
+	}
+	return fmt.Sprintf("%s:%d: %d rules%s are granted by <%s>, on lines %s", file, s.lines[0]+1, len(s.lines), where, s.abstraction.name, lineList(numbers))
+}
+
+func abstractionsMain(args []string) {
+	fs := flag.NewFlagSet("abstractions", flag.ExitOnError)
+	base := fs.String("include-base", defaultIncludeBase, "directory the abstractions are in")
+	minRules := fs.Int("min-rules", 3, "fewest rules of a profile an abstraction must grant to be suggested")
+	apply := fs.Bool("apply-abstractions", false, "replace the rules with an include of the abstraction in the output, widening the profile to everything the abstraction grants")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer abstractions [flags] [profile] [output]")
+		fmt.Println("suggests the shipped abstractions granting groups of rules of the profile, and replaces the rules with them if asked to")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 || (*apply && fs.NArg() < 2) || *minRules < 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	abstractions, err := loadAbstractions(*base)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+
+	suggestions := suggestAbstractions(lines, abstractions, *minRules)
+	if !*apply {
+		for _, s := range suggestions {
+			fmt.Println(describeSuggestion(input, s))
+		}
+		return
+	}
+
+	out, applied := applyAbstractions(lines, suggestions, *minRules)
+	for _, s := range applied {
+		fmt.Printf("%s, replaced them with the include, which may grant more\n", describeSuggestion(input, s))
+	}
+	if err := writeLines(out, fs.Arg(1)); err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+}
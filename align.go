@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+)
+
+// splitRuleColumns splits a file rule line into the part up to and
+// including the path, and the remainder starting with the permissions.
+func splitRuleColumns(l string) (string, string, bool) {
+	pr, ok := parseProfileRule(0, l)
+	if !ok || !pr.isFile() {
+		return "", "", false
+	}
+	idx := strings.Index(l, pr.path)
+	if idx < 0 {
+		return "", "", false
+	}
+	idx += len(pr.path)
+	return l[:idx], strings.TrimLeft(l[idx:], " \t"), true
+}
+
+// columnsAligned reports whether the permissions of the file rules on the
+// 1-based lines start at the same column, padded to get there
+func columnsAligned(lines []string, numbers []int) bool {
+	column, padded, rules := -1, false, 0
+	for _, n := range numbers {
+		l := lines[n-1]
+		head, rest, ok := splitRuleColumns(l)
+		if !ok {
+			continue
+		}
+		c := len(l) - len(rest)
+		if column >= 0 && c != column {
+			return false
+		}
+		column = c
+		padded = padded || c-len(head) > 1
+		rules++
+	}
+	return rules > 1 && padded
+}
+
+func alignWidth(lines []string) int {
+	width := 0
+	for _, l := range lines {
+		if head, _, ok := splitRuleColumns(l); ok && len(head) > width {
+			width = len(head)
+		}
+	}
+	return width
+}
+
+// alignLines pads the path column of every file rule so the permissions
+// start at the same column, other lines are left untouched.
+func alignLines(lines []string, width int) {
+	for i, l := range lines {
+		head, rest, ok := splitRuleColumns(l)
+		if !ok {
+			continue
+		}
+		lines[i] = head + strings.Repeat(" ", width-len(head)+1) + rest
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Rules may carry annotations about where they came from, which are
+// carried over to the generated rules as trailing comments like
+// # interfaces: a, b and read back on later runs. snapd profiles are
+// assembled from the snippets of the interfaces a snap is connected to,
+// each introduced by a comment like # interface: xyz, and rules merged
+// from an overlay are tagged with the file they came from. The markers of
+// the rules are carried over the same way.
+
+const interfaceComment = "# interface:"
+
+// annotationTags are the trailing annotations, in the order they are
+// written
+var annotationTags = []string{"interfaces", "overlay", "aaopt"}
+
+// annotations are the names for each annotation tag
+type annotations map[string][]string
+
+func (a annotations) add(tag, name string) {
+	for _, n := range a[tag] {
+		if n == name {
+			return
+		}
+	}
+	a[tag] = append(a[tag], name)
+}
+
+func isInterfaceComment(tl string) bool {
+	return strings.HasPrefix(strings.TrimSpace(tl), interfaceComment)
+}
+
+// trailingAnnotations returns the annotations in the trailing comment of
+// the rule, if any
+func trailingAnnotations(l string) annotations {
+	i := strings.Index(l, "#")
+	if i < 0 {
+		return nil
+	}
+	var a annotations
+	for _, c := range strings.Split(l[i+1:], "#") {
+		tag, names, ok := strings.Cut(c, ":")
+		tag = strings.TrimSpace(tag)
+		if !ok || !isAnnotationTag(tag) {
+			continue
+		}
+		if a == nil {
+			a = make(annotations)
+		}
+		for _, n := range strings.Split(names, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				a.add(tag, n)
+			}
+		}
+	}
+	return a
+}
+
+func isAnnotationTag(tag string) bool {
+	for _, t := range annotationTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleAnnotations returns the annotations of every rule line, keyed by the
+// 1-based line number. An interface comment applies to the rules following
+// it, up to the next one or the end of the profile, unless the rule lists
+// its interfaces itself. Nil is returned if the lines carry no annotations
+// at all.
+func ruleAnnotations(lines []string) map[int]annotations {
+	annotated := make(map[int]annotations)
+	current := ""
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		switch {
+		case isInterfaceComment(tl):
+			current = strings.TrimSpace(strings.TrimPrefix(tl, interfaceComment))
+			continue
+		case strings.HasSuffix(tl, "{") || strings.HasPrefix(tl, "}"):
+			current = ""
+			continue
+		case ruleKind(tl) == "":
+			continue
+		}
+
+		a := trailingAnnotations(tl)
+		if a["interfaces"] == nil && current != "" {
+			if a == nil {
+				a = make(annotations)
+			}
+			a.add("interfaces", current)
+		}
+		if a != nil {
+			annotated[i+1] = a
+		}
+	}
+	if len(annotated) == 0 {
+		return nil
+	}
+	return annotated
+}
+
+// annotate appends the annotations of the original rules each generated
+// rule covers as a trailing comment
+func (r *region) annotate(rules []string) {
+	for i, rl := range rules {
+		merged := make(annotations)
+		// no-merge only sticks to the rules marked with it, not those
+		// passes generated over them and their unmarked siblings
+		keptApart := true
+		for _, line := range r.coveredLines([]string{rl}) {
+			marked := false
+			for _, n := range r.annotations[line]["aaopt"] {
+				marked = marked || n == "no-merge"
+			}
+			keptApart = keptApart && marked
+			for tag, names := range r.annotations[line] {
+				for _, n := range names {
+					merged.add(tag, n)
+				}
+			}
+		}
+		if !keptApart {
+			var names []string
+			for _, n := range merged["aaopt"] {
+				if n != "no-merge" {
+					names = append(names, n)
+				}
+			}
+			merged["aaopt"] = names
+		}
+		for _, tag := range annotationTags {
+			if names := merged[tag]; len(names) > 0 {
+				sort.Strings(names)
+				rl += " # " + tag + ": " + strings.Join(names, ", ")
+			}
+		}
+		rules[i] = rl
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// treeArena is a compact tree of rule paths. Its nodes live in a single
+// slice and refer to their children by index, ordered by part, so adding
+// a rule allocates next to nothing. Very large inputs are ingested into
+// arenas, which are turned into leaf trees in one go once complete. Only
+// the ingest is compact, the passes still work on the leaf trees, so the
+// peak memory of a run is not lowered.
+type treeArena struct {
+	nodes []arenaNode
+}
+
+type arenaNode struct {
+	part     string
+	children []int32
+}
+
+func newTreeArena() *treeArena {
+	return &treeArena{nodes: []arenaNode{{}}}
+}
+
+// child returns the child of the node with the part, adding it if missing
+func (ta *treeArena) child(n int32, part string) int32 {
+	c := ta.nodes[n].children
+	i := sort.Search(len(c), func(i int) bool {
+		return ta.nodes[c[i]].part >= part
+	})
+	if i < len(c) && ta.nodes[c[i]].part == part {
+		return c[i]
+	}
+	id := int32(len(ta.nodes))
+	ta.nodes = append(ta.nodes, arenaNode{part: part})
+	c = append(c, 0)
+	copy(c[i+1:], c[i:])
+	c[i] = id
+	ta.nodes[n].children = c
+	return id
+}
+
+// addRule adds the rule below the node, like leaf.addRule does
+func (ta *treeArena) addRule(n int32, r rule) {
+	p, last := r.next()
+	if strings.HasPrefix(p, "{") {
+		end := aare.ClosingBrace(p, 0)
+		for _, t := range aare.SplitAlternation(p[1:end]) {
+			c := ta.child(n, t+p[end+1:])
+			if !last {
+				cl := r.current
+				ta.addRule(c, r)
+				r.current = cl
+			}
+		}
+	} else {
+		c := ta.child(n, p)
+		if !last {
+			ta.addRule(c, r)
+		}
+	}
+}
+
+// thaw returns the arena as a leaf tree. The leaves are allocated at once
+// and their maps sized to fit, and the arena must not be used afterwards.
+func (ta *treeArena) thaw() *leaf {
+	leaves := make([]leaf, len(ta.nodes))
+	for i, n := range ta.nodes {
+		leaves[i].part = n.part
+		leaves[i].children = make(map[string]*leaf, len(n.children))
+		for _, c := range n.children {
+			leaves[i].children[ta.nodes[c].part] = &leaves[c]
+		}
+	}
+	ta.nodes = nil
+	return &leaves[0]
+}
+
+// thawArenas turns the arenas holding the rules into the trees the passes
+// work on
+func (aa *aaOptimizer) thawArenas() {
+	for b, ta := range aa.arenas {
+		aa.trees[b] = ta.thaw()
+	}
+	aa.arenas = nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// prefixes shallower than this are too broad to be worth optimizing
+// on their own, i.e /sys or /run
+const autoMinDepth = 2
+
+type prefixCandidate struct {
+	prefix string
+	depth  int
+	count  int
+}
+
+// detectPrefixes finds the directory prefixes that are shared by more than
+// min path rules. When prefixes nest, the shallowest one is picked as that
+// gives the passes the most room to consolidate.
+func detectPrefixes(lines []string, min int) []prefixCandidate {
+	counts := make(map[string]*prefixCandidate)
+	for _, l := range lines {
+		pr, ok := parseProfileRule(0, l)
+		if !ok || !pr.isFile() || !strings.HasPrefix(pr.path, "/") {
+			continue
+		}
+
+		// the last part is the file itself
+		parts := aare.SplitPath(strings.TrimPrefix(pr.path, "/"))
+		for d := autoMinDepth; d < len(parts); d++ {
+			p := "/" + strings.Join(parts[:d], "/")
+			c := counts[p]
+			if c == nil {
+				c = &prefixCandidate{prefix: p, depth: d}
+				counts[p] = c
+			}
+			c.count++
+		}
+	}
+
+	var candidates []*prefixCandidate
+	for _, c := range counts {
+		if c.count > min {
+			candidates = append(candidates, c)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].depth != candidates[j].depth {
+			return candidates[i].depth < candidates[j].depth
+		}
+		return candidates[i].prefix < candidates[j].prefix
+	})
+
+	var chosen []prefixCandidate
+	for _, c := range candidates {
+		covered := false
+		for _, ch := range chosen {
+			if strings.HasPrefix(c.prefix+"/", ch.prefix+"/") {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			chosen = append(chosen, *c)
+		}
+	}
+	return chosen
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// batchJob is one run of the optimizer, composing the inputs into the
+// output
+type batchJob struct {
+	inputs []string
+	output string
+}
+
+// mirrorPath returns where the input goes below the output directory,
+// the path relative to the working directory if the input is below it,
+// otherwise the absolute path
+func mirrorPath(input, outputDir string) (string, error) {
+	abs, err := filepath.Abs(input)
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = strings.TrimPrefix(abs, string(filepath.Separator))
+	}
+	return filepath.Join(outputDir, rel), nil
+}
+
+// batchJobs returns a job per input file, writing it below the output
+// directory. Directories are walked for the files in them, skipping
+// hidden files along with the sidecar files of earlier runs.
+func batchJobs(inputs []string, outputDir string) ([]batchJob, error) {
+	var jobs []batchJob
+	add := func(input string) error {
+		output, err := mirrorPath(input, outputDir)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, batchJob{inputs: []string{input}, output: output})
+		return nil
+	}
+	for _, in := range inputs {
+		fi, err := os.Stat(in)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if err := add(in); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.WalkDir(in, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			name := d.Name()
+			if p != in && strings.HasPrefix(name, ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || strings.HasSuffix(name, ".aaopt.json") || strings.HasSuffix(name, ".orig") {
+				return nil
+			}
+			return add(p)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "aaopt")
+}
+
+// cacheOptions returns the flags set on the command line that influence
+// the output, in a stable order
+func cacheOptions(fs *flag.FlagSet, ignore ...string) string {
+	var opts []string
+	fs.Visit(func(f *flag.Flag) {
+		for _, i := range ignore {
+			if f.Name == i {
+				return
+			}
+		}
+		opts = append(opts, f.Name+"="+f.Value.String())
+	})
+	sort.Strings(opts)
+	return strings.Join(opts, "\x00")
+}
+
+// buildIDHash is worked out once, hashing the executable takes a while
+var (
+	buildIDOnce sync.Once
+	buildIDHash string
+)
+
+// buildID identifies the build of the tool, so results cached by another
+// build are not used. The version is "devel" unless set when building, so
+// it comes along with the VCS revision of a clean checkout, or else a hash
+// of the executable.
+func buildID() string {
+	buildIDOnce.Do(func() {
+		buildIDHash = version + "\x00" + buildRevision()
+	})
+	return buildIDHash
+}
+
+// buildRevision returns the VCS revision the tool was built from, or a
+// hash of the executable if it was built from a modified checkout or
+// without VCS information
+func buildRevision() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		var revision string
+		modified := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				revision = s.Value
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if revision != "" && !modified {
+			return revision
+		}
+	}
+	h := sha256.New()
+	if exe, err := os.Executable(); err == nil {
+		if f, err := os.Open(exe); err == nil {
+			io.Copy(h, f)
+			f.Close()
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheKey hashes the content of the files together with the options and
+// the build of the tool
+func cacheKey(files []string, opts string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", buildID(), opts)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", f, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func cacheEntry(dir, key string) string {
+	return filepath.Join(dir, key+".out")
+}
+
+func cacheLookup(dir, key string) ([]string, bool) {
+	path := cacheEntry(dir, key)
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, false
+	}
+	// keep recently used entries from being pruned
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return lines, true
+}
+
+func cacheStore(dir, key string, lines []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeLines(lines, cacheEntry(dir, key))
+}
+
+// pruneCache removes the entries not used within maxAge
+func pruneCache(dir string, maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".out") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil || time.Since(fi.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func cacheMain(args []string) {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	dir := fs.String("cache-dir", defaultCacheDir(), "directory of the cache")
+	maxAge := fs.Duration("max-age", 30*24*time.Hour, "remove entries not used for this long")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer cache [flags] prune")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 || fs.Arg(0) != "prune" {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	removed, err := pruneCache(*dir, *maxAge)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("removed %d cache entries\n", removed)
+}
+
+// treeCacheKey identifies the optimized tree of a bucket, which only
+// depends on its rules, the options the passes use and the fold markers of
+// the region, which apply to every bucket
+func treeCacheKey(b bucket, rules []string, opts *options, markedFolds []string) string {
+	sorted := append([]string(nil), rules...)
+	sort.Strings(sorted)
+	var hot []string
+	for p := range opts.hot {
+		hot = append(hot, p)
+	}
+	sort.Strings(hot)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%t\x00%t\x00%t\x00%t\x00%d\x00%d\x00%d\x00%s\x00%s\x00%s\x00", buildID(), strings.Join(opts.forbidden, "\x00"), opts.tunables != nil, opts.generalizeHome, opts.foldPids, opts.foldUdev, opts.minDepth, opts.maxGlobstars, opts.foldSingleChar, b.qualifiers, b.perms, b.target)
+	for _, list := range [][]string{opts.folds, markedFolds, hot} {
+		fmt.Fprintf(h, "%d\x00%s\x00", len(list), strings.Join(list, "\x00"))
+	}
+	for _, r := range sorted {
+		fmt.Fprintf(h, "%s\x00", r)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+)
+
+// passStats counts what one optimizer pass did
+type passStats struct {
+	// Changes is the number of transformations the pass made, Inputs and
+	// Outputs the number of rules those replaced and generated
+	Changes int `json:"changes"`
+	Inputs  int `json:"inputs"`
+	Outputs int `json:"outputs"`
+}
+
+// changeSet describes what optimizing a profile did, written as one JSON
+// line per profile to the --change-set file
+type changeSet struct {
+	// File is the profile written
+	File string `json:"file"`
+	// lines is the optimized profile
+	lines []string
+	// Removed are the original rules no longer in the profile, Added the
+	// generated rules that were not in it before
+	Removed []string `json:"removed"`
+	Added   []string `json:"added"`
+	// Widenings are the transformations granting more than the rules they
+	// replaced
+	Widenings []transformation `json:"widenings"`
+	// Passes are the stats of every pass that changed something, by name
+	Passes map[string]passStats `json:"passes"`
+}
+
+func newChangeSet(file string) *changeSet {
+	return &changeSet{File: file, Passes: make(map[string]passStats)}
+}
+
+// transformed counts the transformation for its pass
+func (cs *changeSet) transformed(tx transformation) {
+	s := cs.Passes[tx.Pass]
+	s.Changes++
+	s.Inputs += len(tx.Inputs)
+	s.Outputs += len(tx.Outputs)
+	cs.Passes[tx.Pass] = s
+	if tx.Widening {
+		cs.Widenings = append(cs.Widenings, tx)
+	}
+}
+
+// addRegions records the rules the blocks replacing the regions removed
+// and added
+func (cs *changeSet) addRegions(regions []*region) {
+	for _, r := range regions {
+		removed, added := regionChanges(r)
+		cs.Removed = append(cs.Removed, removed...)
+		cs.Added = append(cs.Added, added...)
+	}
+}
+
+// optimizeProfile optimizes the rules of the profile below the prefixes
+// with the default options, file is the path the profile was read from and
+// is used to resolve its tunables
+func optimizeProfile(lines []string, file string, prefixes []string) (*changeSet, error) {
+	cs := newChangeSet(file)
+	opts := defaultOptions(file, &prefixSet{paths: prefixes, variables: loadTunables([]string{file})})
+	opts.transformed = cs.transformed
+
+	output, regions, err := optimizeLines(lines, opts)
+	if err != nil {
+		return nil, err
+	}
+	cs.lines = output
+	cs.addRegions(regions)
+	return cs, nil
+}
+
+// regionChanges returns the rules of the region missing from the block
+// that replaced it, and the rules of that block that were not in the region
+func regionChanges(r *region) (removed, added []string) {
+	original := make(map[string]bool)
+	for _, rule := range r.rules {
+		original[strings.TrimSpace(rule)] = true
+	}
+	generated := make(map[string]bool)
+	for _, line := range r.generated {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		generated[line] = true
+		if !original[line] {
+			added = append(added, line)
+		}
+	}
+	for _, rule := range r.rules {
+		if !generated[strings.TrimSpace(rule)] {
+			removed = append(removed, strings.TrimSpace(rule))
+		}
+	}
+	return removed, added
+}
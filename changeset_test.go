@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChangeSet(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		lines   []string
+		removed []string
+		added   []string
+		passes  []string
+	}{{
+		name: "merged",
+		lines: []string{
+			"profile test {",
+			"  /sys/devices/a/x r,",
+			"  /sys/devices/a/y r,",
+			"  /etc/foo r,",
+			"}",
+		},
+		removed: []string{"/sys/devices/a/x r,", "/sys/devices/a/y r,"},
+		added:   []string{"/sys/devices/a/{x,y} r,"},
+		passes:  []string{"pass1"},
+	}, {
+		name: "unchanged",
+		lines: []string{
+			"profile test {",
+			"  /sys/devices/a/x r,",
+			"  /etc/foo r,",
+			"}",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			cs, err := optimizeProfile(tc.lines, "test", []string{"/sys/devices"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(cs.Removed, "\n") != strings.Join(tc.removed, "\n") {
+				t.Errorf("removed %q, want %q", cs.Removed, tc.removed)
+			}
+			if strings.Join(cs.Added, "\n") != strings.Join(tc.added, "\n") {
+				t.Errorf("added %q, want %q", cs.Added, tc.added)
+			}
+			if len(cs.Passes) != len(tc.passes) {
+				t.Errorf("passes %v, want %q", cs.Passes, tc.passes)
+			}
+			for _, p := range tc.passes {
+				if cs.Passes[p].Changes == 0 {
+					t.Errorf("pass %s made no changes", p)
+				}
+			}
+			if len(cs.Widenings) != 0 {
+				t.Errorf("unexpected widenings %v", cs.Widenings)
+			}
+		})
+	}
+}
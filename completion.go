@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// parseFlags parses the arguments of the flag set, then takes the flags
+// not given from the environment and the configuration file. Errors point
+// at the offending flag and the closest one known instead of printing the
+// whole usage.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	usage := fs.Usage
+	fs.Init(fs.Name(), flag.ContinueOnError)
+	fs.Usage = func() {}
+	fs.SetOutput(io.Discard)
+	err := fs.Parse(args)
+	fs.Usage = usage
+	fs.SetOutput(nil)
+	if err == flag.ErrHelp {
+		fs.Usage()
+		os.Exit(0)
+	}
+	if err == nil {
+		err = applyEnv(fs)
+	}
+	if err == nil {
+		err = applyConfig(fs)
+	}
+	if err == nil {
+		return
+	}
+
+	help := "aaoptimizer --help"
+	if fs != flag.CommandLine {
+		help = "aaoptimizer " + fs.Name() + " --help"
+	}
+	msg := err.Error()
+	if name, ok := strings.CutPrefix(msg, "flag provided but not defined: -"); ok {
+		if s := closestFlag(fs, name); s != "" {
+			msg += ", did you mean --" + s + "?"
+		}
+	}
+	fmt.Printf("aaoptimizer: %s\n", msg)
+	fmt.Printf("run '%s' for the flags\n", help)
+	os.Exit(-1)
+}
+
+// closestFlag returns the flag of the set closest to the unknown name, or
+// "" if none is close enough to be what was meant
+func closestFlag(fs *flag.FlagSet, name string) string {
+	name = strings.TrimPrefix(name, "-")
+	if i := strings.Index(name, "="); i >= 0 {
+		name = name[:i]
+	}
+	best, bestDistance := "", 3
+	fs.VisitAll(func(f *flag.Flag) {
+		d := editDistance(name, f.Name)
+		if strings.HasPrefix(f.Name, name) && len(name) >= 3 {
+			d = 1
+		}
+		if d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// flagChoices matches the choices listed at the end of a flag usage, like
+// (none|plain|json)
+var flagChoices = regexp.MustCompile(`\(([a-z0-9-]+(?:\|[a-z0-9-]+)+)\)$`)
+
+// choices returns the values of the flags of the set that take one of a
+// few, by flag name
+func choices(fs *flag.FlagSet) map[string][]string {
+	values := make(map[string][]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if m := flagChoices.FindStringSubmatch(f.Usage); m != nil {
+			values[f.Name] = strings.Split(m[1], "|")
+		}
+	})
+	return values
+}
+
+// The completion scripts complete the subcommands and the values of the
+// flags with choices. The flags themselves are read from the --help
+// output of the subcommand being completed, so they never go stale.
+
+const bashCompletion = `_aaoptimizer() {
+	local cur prev sub
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+	sub=""
+	if [ "$COMP_CWORD" -gt 1 ]; then
+		case " %[1]s " in
+		*" ${COMP_WORDS[1]} "*) sub="${COMP_WORDS[1]}" ;;
+		esac
+	fi
+	case "$prev" in
+%[2]s	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "$(aaoptimizer $sub --help 2>&1 | sed -n 's/^  -\([a-zA-Z0-9-]*\).*/--\1/p')" -- "$cur"))
+		return
+	fi
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "%[1]s" -- "$cur"))
+	fi
+	COMPREPLY+=($(compgen -f -- "$cur"))
+}
+complete -o filenames -F _aaoptimizer aaoptimizer
+`
+
+const fishCompletion = `function __aaoptimizer_flags
+	set -l tokens (commandline -opc)
+	set -l sub
+	if test (count $tokens) -gt 1; and contains -- $tokens[2] %[1]s
+		set sub $tokens[2]
+	end
+	aaoptimizer $sub --help 2>&1 | string replace -rf '^  -([a-zA-Z0-9-]+).*' -- '--$1'
+end
+complete -c aaoptimizer -n __fish_use_subcommand -xa '%[1]s'
+complete -c aaoptimizer -n 'string match -q -- "-*" (commandline -ct)' -xa '(__aaoptimizer_flags)'
+%[2]s`
+
+// writeCompletion writes the completion script for the shell, zsh uses
+// the bash one through bashcompinit
+func writeCompletion(w io.Writer, shell string) error {
+	values := choices(flag.CommandLine)
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	subs := strings.Join(subcommands, " ")
+
+	switch shell {
+	case "bash", "zsh":
+		var cases strings.Builder
+		for _, name := range names {
+			fmt.Fprintf(&cases, "\t-%[1]s|--%[1]s)\n\t\tCOMPREPLY=($(compgen -W \"%[2]s\" -- \"$cur\"))\n\t\treturn\n\t\t;;\n", name, strings.Join(values[name], " "))
+		}
+		if shell == "zsh" {
+			fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+		}
+		_, err := fmt.Fprintf(w, bashCompletion, subs, cases.String())
+		return err
+	case "fish":
+		var lines strings.Builder
+		for _, name := range names {
+			fmt.Fprintf(&lines, "complete -c aaoptimizer -l %s -xa '%s'\n", name, strings.Join(values[name], " "))
+		}
+		_, err := fmt.Fprintf(w, fishCompletion, subs, lines.String())
+		return err
+	}
+	return fmt.Errorf("unknown shell %q, must be bash, zsh or fish", shell)
+}
+
+// checkPositional reports what is wrong with the inputs and the output
+// given, or "" if nothing is
+func checkPositional(args []string, outputDir string) string {
+	for _, a := range args {
+		if len(a) > 1 && strings.HasPrefix(a, "-") {
+			return fmt.Sprintf("flag %s follows the inputs, the flags must come before them", a)
+		}
+	}
+	switch {
+	case outputDir != "" && len(args) == 0:
+		return "missing the inputs to write below --output-dir"
+	case outputDir != "":
+		return ""
+	case len(args) == 0:
+		return "missing the input and the output, or --output-dir"
+	case len(args) == 1:
+		return fmt.Sprintf("missing the output after the input %s, or --output-dir", args[0])
+	}
+	return ""
+}
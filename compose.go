@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+)
+
+// composeInputs reads the inputs into a single profile. The first input is
+// the base, the others are fragments put in front of the closing brace of
+// its last profile, or appended if it has none. Every input is introduced
+// by a section comment naming it.
+func composeInputs(inputs []string) ([]string, error) {
+	base, err := readLines(inputs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(inputs) == 1 {
+		return base, nil
+	}
+
+	end := len(base)
+	indent := ""
+	if pb := lastProfile(base); pb != nil {
+		end = pb.end
+		indent = "  "
+	}
+
+	lines := []string{"# section: " + inputs[0]}
+	lines = append(lines, base[:end]...)
+	for _, in := range inputs[1:] {
+		fragment, err := readLines(in)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, "", indent+"# section: "+in)
+		for _, l := range fragment {
+			if l != "" && !strings.HasPrefix(l, " ") && !strings.HasPrefix(l, "\t") {
+				l = indent + l
+			}
+			lines = append(lines, l)
+		}
+	}
+	return append(lines, base[end:]...), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLastTopLevelProfile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		base []string
+		// want is the base with the rule added
+		want []string
+	}{{
+		name: "hat last",
+		base: []string{
+			"profile a {",
+			"  /etc/a r,",
+			"  ^hat {",
+			"    /etc/hat r,",
+			"  }",
+			"}",
+		},
+		want: []string{
+			"profile a {",
+			"  /etc/a r,",
+			"  ^hat {",
+			"    /etc/hat r,",
+			"  }",
+			"  /etc/new r,",
+			"}",
+		},
+	}, {
+		name: "child profile of the last profile",
+		base: []string{
+			"profile a {",
+			"}",
+			"profile b {",
+			"  profile child {",
+			"  }",
+			"}",
+		},
+		want: []string{
+			"profile a {",
+			"}",
+			"profile b {",
+			"  profile child {",
+			"  }",
+			"  /etc/new r,",
+			"}",
+		},
+	}, {
+		name: "no profile",
+		base: []string{
+			"/etc/a r,",
+		},
+		want: []string{
+			"/etc/a r,",
+			"/etc/new r,",
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			merged := mergeRules(tc.base, []string{"/etc/new r,"})
+			if strings.Join(merged, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("mergeRules got\n%s\nwant\n%s", strings.Join(merged, "\n"), strings.Join(tc.want, "\n"))
+			}
+
+			dir := t.TempDir()
+			base := filepath.Join(dir, "base")
+			fragment := filepath.Join(dir, "fragment")
+			if err := writeLines(tc.base, base); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeLines([]string{"/etc/new r,"}, fragment); err != nil {
+				t.Fatal(err)
+			}
+			composed, err := composeInputs([]string{base, fragment})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// drop the section comments and the blank line before the
+			// fragment
+			var rules []string
+			for _, l := range composed {
+				if tl := strings.TrimSpace(l); tl != "" && !strings.HasPrefix(tl, "#") {
+					rules = append(rules, l)
+				}
+			}
+			if strings.Join(rules, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("composeInputs got\n%s\nwant\n%s", strings.Join(composed, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
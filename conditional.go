@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// booleanDefinition matches the definition of a boolean variable like
+// $foo = true
+var booleanDefinition = regexp.MustCompile(`^\$\{?([A-Za-z0-9_]+)\}?\s*=\s*(true|false)\s*,?$`)
+
+var (
+	booleanReference  = regexp.MustCompile(`\$\{?([A-Za-z0-9_]+)\}?`)
+	variableReference = regexp.MustCompile(`@\{([A-Za-z0-9_]+)\}`)
+)
+
+// parseBoolean parses the definition of a boolean variable
+func parseBoolean(l string) (string, bool, bool) {
+	m := booleanDefinition.FindStringSubmatch(strings.TrimSpace(stripComment(l)))
+	if m == nil {
+		return "", false, false
+	}
+	return m[1], m[2] == "true", true
+}
+
+// definedVariables returns the variables and booleans the lines define
+func definedVariables(lines []string) (map[string]bool, map[string]bool) {
+	variables := make(map[string]bool)
+	booleans := make(map[string]bool)
+	for _, l := range lines {
+		if name, _, _, ok := parseVariable(l); ok {
+			variables[name] = true
+		}
+		if name, value, ok := parseBoolean(l); ok {
+			booleans[name] = value
+		}
+	}
+	return variables, booleans
+}
+
+// parseCondition returns the condition of a line opening a conditional
+// branch, if ... { or } else if ... {, and whether it is an else branch.
+// The condition of a bare else is empty.
+func parseCondition(l string) (string, bool, bool) {
+	tl := strings.TrimSpace(stripComment(l))
+	if !strings.HasSuffix(tl, "{") {
+		return "", false, false
+	}
+	tl = strings.TrimSpace(strings.TrimSuffix(tl, "{"))
+	isElse := false
+	if strings.HasPrefix(tl, "}") {
+		tl = strings.TrimSpace(strings.TrimPrefix(tl, "}"))
+		if tl != "else" && !strings.HasPrefix(tl, "else ") {
+			return "", false, false
+		}
+		isElse = true
+		tl = strings.TrimSpace(strings.TrimPrefix(tl, "else"))
+		if tl == "" {
+			return "", true, true
+		}
+	}
+	if !strings.HasPrefix(tl, "if ") {
+		return "", false, false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(tl, "if")), isElse, true
+}
+
+// conditionEvaluator evaluates conditions given the variables and
+// booleans known to be defined. A condition depending on anything else is
+// unknown, as it may be defined by a file that is not included.
+type conditionEvaluator struct {
+	variables map[string]bool
+	booleans  map[string]bool
+	tokens    []string
+}
+
+// evaluate returns the value of the condition, the second boolean is
+// false if it is not known statically
+func (ce *conditionEvaluator) evaluate(cond string) (bool, bool) {
+	cond = strings.ReplaceAll(strings.ReplaceAll(cond, "(", " ( "), ")", " ) ")
+	ce.tokens = strings.Fields(cond)
+	value, known := ce.or()
+	if len(ce.tokens) > 0 {
+		return false, false
+	}
+	return value, known
+}
+
+func (ce *conditionEvaluator) next() string {
+	if len(ce.tokens) == 0 {
+		return ""
+	}
+	t := ce.tokens[0]
+	ce.tokens = ce.tokens[1:]
+	return t
+}
+
+func (ce *conditionEvaluator) or() (bool, bool) {
+	value, known := ce.and()
+	for len(ce.tokens) > 0 && ce.tokens[0] == "or" {
+		ce.next()
+		v, k := ce.and()
+		switch {
+		case known && value, k && v:
+			value, known = true, true
+		case known && k:
+			value = false
+		default:
+			known = false
+		}
+	}
+	return value, known
+}
+
+func (ce *conditionEvaluator) and() (bool, bool) {
+	value, known := ce.not()
+	for len(ce.tokens) > 0 && ce.tokens[0] == "and" {
+		ce.next()
+		v, k := ce.not()
+		switch {
+		case known && !value, k && !v:
+			value, known = false, true
+		case known && k:
+			value = true
+		default:
+			known = false
+		}
+	}
+	return value, known
+}
+
+func (ce *conditionEvaluator) not() (bool, bool) {
+	if len(ce.tokens) > 0 && ce.tokens[0] == "not" {
+		ce.next()
+		value, known := ce.not()
+		return !value, known
+	}
+	return ce.term()
+}
+
+func (ce *conditionEvaluator) term() (bool, bool) {
+	t := ce.next()
+	switch {
+	case t == "(":
+		value, known := ce.or()
+		if ce.next() != ")" {
+			return false, false
+		}
+		return value, known
+	case t == "defined":
+		t = ce.next()
+		if m := variableReference.FindStringSubmatch(t); m != nil && m[0] == t {
+			return true, ce.variables[m[1]]
+		}
+		if m := booleanReference.FindStringSubmatch(t); m != nil && m[0] == t {
+			_, ok := ce.booleans[m[1]]
+			return true, ok
+		}
+	default:
+		if m := booleanReference.FindStringSubmatch(t); m != nil && m[0] == t {
+			value, ok := ce.booleans[m[1]]
+			return value, ok
+		}
+	}
+	return false, false
+}
+
+// lintUnusedVariables reports the variables and booleans the linted file
+// defines that nothing references. Those of the included files are left
+// alone, tunables are meant to be referenced by other profiles.
+func lintUnusedVariables(lines []string, sources []source) []finding {
+	type definition struct {
+		line int
+		ref  string
+	}
+	var definitions []definition
+	referenced := make(map[string]bool)
+	for i, l := range lines {
+		tl := strings.TrimSpace(stripComment(l))
+		name, _, _, isVariable := parseVariable(l)
+		boolean, _, isBoolean := parseBoolean(l)
+		switch {
+		case isVariable:
+			definitions = append(definitions, definition{i + 1, "@{" + name + "}"})
+			tl = tl[strings.Index(tl, "}")+1:]
+		case isBoolean:
+			definitions = append(definitions, definition{i + 1, "$" + boolean})
+			tl = ""
+		}
+		for _, m := range variableReference.FindAllStringSubmatch(tl, -1) {
+			referenced["@{"+m[1]+"}"] = true
+		}
+		for _, m := range booleanReference.FindAllStringSubmatch(tl, -1) {
+			referenced["$"+m[1]] = true
+		}
+	}
+
+	var findings []finding
+	seen := make(map[string]bool)
+	for _, d := range definitions {
+		if referenced[d.ref] || seen[d.ref] {
+			continue
+		}
+		if sources != nil && sources[d.line-1].file != sources[0].file {
+			continue
+		}
+		seen[d.ref] = true
+		findings = append(findings, finding{line: d.line, message: fmt.Sprintf("%s is defined but never referenced", d.ref)})
+	}
+	return findings
+}
+
+// lintDeadConditionals reports the conditional branches that can never be
+// taken given the variables and booleans the lines define, either because
+// their condition is false or because an earlier branch always is.
+func lintDeadConditionals(lines []string, sources []source) []finding {
+	variables, booleans := definedVariables(lines)
+	ce := &conditionEvaluator{variables: variables, booleans: booleans}
+
+	// chain tracks the branches of an if ... else chain, taken is set once
+	// one of them is known to always be taken
+	type chain struct {
+		taken bool
+	}
+	// the stack holds a chain for every open conditional and nil for the
+	// other blocks
+	var stack []*chain
+	var findings []finding
+	for i, l := range lines {
+		tl := strings.TrimSpace(stripComment(l))
+		cond, isElse, ok := parseCondition(l)
+		switch {
+		case ok:
+			var c *chain
+			if isElse && len(stack) > 0 && stack[len(stack)-1] != nil {
+				c = stack[len(stack)-1]
+			} else {
+				c = &chain{}
+				stack = append(stack, c)
+			}
+			if c.taken {
+				findings = append(findings, finding{line: i + 1, message: fmt.Sprintf("%q can never be taken, an earlier branch always is", tl)})
+				continue
+			}
+			if cond == "" {
+				continue
+			}
+			value, known := ce.evaluate(cond)
+			if !known {
+				continue
+			}
+			if value {
+				c.taken = true
+			} else {
+				findings = append(findings, finding{line: i + 1, message: fmt.Sprintf("%q can never be taken, %s is always false", tl, cond)})
+			}
+		case strings.HasPrefix(tl, "}") && strings.HasSuffix(tl, "{"):
+		case strings.HasSuffix(tl, "{"):
+			stack = append(stack, nil)
+		case strings.HasPrefix(tl, "}"):
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return findings
+}
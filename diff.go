@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// diffRule is a rule of one of the profiles being compared
+type diffRule struct {
+	Line int    `json:"line"`
+	Rule string `json:"rule"`
+}
+
+// diffEntry is a change between two versions of a profile. Modified
+// entries pair the rules of the new version with the rules of the old one
+// they replace.
+type diffEntry struct {
+	// Kind is added, removed or modified
+	Kind string `json:"kind"`
+	// Classification is new grant, revoked grant, widened, narrowed or
+	// equivalent, the latter for rules rewritten without changing what
+	// the profile grants
+	Classification string     `json:"classification"`
+	Profile        string     `json:"profile,omitempty"`
+	Old            []diffRule `json:"old,omitempty"`
+	New            []diffRule `json:"new,omitempty"`
+}
+
+// profileGrants reports whether the rules grant everything the rule does,
+// every alternative of its path has to be granted by one of them
+func profileGrants(rules []profileRule, r profileRule) bool {
+	if r.capability {
+		// a bare capability rule grants every capability, which only
+		// another bare one does too
+		capabilities := r.capabilities
+		if len(capabilities) == 0 {
+			capabilities = []string{""}
+		}
+		for _, c := range capabilities {
+			found := false
+			for _, o := range rules {
+				if !o.capability || o.deny != r.deny {
+					continue
+				}
+				found = found || len(o.capabilities) == 0
+				for _, oc := range o.capabilities {
+					found = found || oc == c
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+
+	alternatives, ok := aare.Expand(r.path)
+	if !ok {
+		return false
+	}
+	perms := strings.TrimSuffix(r.perms, ",")
+	for _, alt := range alternatives {
+		found := false
+		for _, o := range rules {
+			if !o.isFile() || o.deny != r.deny || o.owner && !r.owner || o.target != r.target {
+				continue
+			}
+			if permsCover(strings.TrimSuffix(o.perms, ","), perms) && aare.Covers(o.path, alt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// replaces reports whether the new rule is a rewrite of the old one, for
+// the same path or one covering the other
+func replaces(n, o profileRule) bool {
+	if n.capability || o.capability || n.deny != o.deny || n.owner != o.owner || n.target != o.target {
+		return false
+	}
+	return n.path == o.path || aare.Covers(n.path, o.path) || aare.Covers(o.path, n.path)
+}
+
+// diffProfiles compares the rules of two versions of a profile, profile by
+// profile. Rules found unchanged in both are left out. For deny rules the
+// classification is reversed, a new deny rule revokes a grant.
+func diffProfiles(oldLines, newLines []string) []diffEntry {
+	byProfile := func(lines []string) (map[string][]profileRule, []string) {
+		_, owners := findProfiles(lines)
+		rules := make(map[string][]profileRule)
+		var names []string
+		for _, pr := range parseProfileRules(lines) {
+			name := ""
+			if pb := owners[pr.line-1]; pb != nil {
+				name = pb.name
+			}
+			if _, ok := rules[name]; !ok {
+				names = append(names, name)
+			}
+			rules[name] = append(rules[name], pr)
+		}
+		return rules, names
+	}
+	oldRules, oldNames := byProfile(oldLines)
+	newRules, newNames := byProfile(newLines)
+	names := newNames
+	for _, n := range oldNames {
+		if _, ok := newRules[n]; !ok {
+			names = append(names, n)
+		}
+	}
+
+	var entries []diffEntry
+	for _, name := range names {
+		olds, news := oldRules[name], newRules[name]
+		unchanged := make(map[string]int)
+		for _, o := range olds {
+			unchanged[o.text]++
+		}
+		var added []profileRule
+		for _, n := range news {
+			if unchanged[n.text] > 0 {
+				unchanged[n.text]--
+				continue
+			}
+			added = append(added, n)
+		}
+		kept := make(map[string]int)
+		for _, n := range news {
+			kept[n.text]++
+		}
+		var removed []profileRule
+		for _, o := range olds {
+			if kept[o.text] > 0 {
+				kept[o.text]--
+				continue
+			}
+			removed = append(removed, o)
+		}
+
+		replaced := make(map[int][]profileRule)
+		claimed := make([]bool, len(removed))
+		for i, n := range added {
+			for j, o := range removed {
+				if !claimed[j] && replaces(n, o) {
+					claimed[j] = true
+					replaced[i] = append(replaced[i], o)
+				}
+			}
+		}
+
+		for i, n := range added {
+			e := diffEntry{Profile: name, New: []diffRule{{n.line, n.text}}}
+			if len(replaced[i]) == 0 {
+				e.Kind = "added"
+				e.Classification = "new grant"
+				if profileGrants(olds, n) {
+					e.Classification = "equivalent"
+				}
+			} else {
+				e.Kind = "modified"
+				e.Classification = "equivalent"
+				for _, o := range replaced[i] {
+					e.Old = append(e.Old, diffRule{o.line, o.text})
+					if !profileGrants(news, o) {
+						e.Classification = "narrowed"
+					}
+				}
+				if !profileGrants(olds, n) {
+					e.Classification = "widened"
+				}
+			}
+			entries = append(entries, reverseDeny(e, n.deny))
+		}
+		for j, o := range removed {
+			if claimed[j] {
+				continue
+			}
+			e := diffEntry{Kind: "removed", Classification: "revoked grant", Profile: name, Old: []diffRule{{o.line, o.text}}}
+			if profileGrants(news, o) {
+				e.Classification = "equivalent"
+			}
+			entries = append(entries, reverseDeny(e, o.deny))
+		}
+	}
+	return entries
+}
+
+// reverseDeny reverses the classification of a change to deny rules
+func reverseDeny(e diffEntry, deny bool) diffEntry {
+	if !deny {
+		return e
+	}
+	switch e.Classification {
+	case "new grant":
+		e.Classification = "revoked grant"
+	case "revoked grant":
+		e.Classification = "new grant"
+	case "widened":
+		e.Classification = "narrowed"
+	case "narrowed":
+		e.Classification = "widened"
+	}
+	return e
+}
+
+func diffMain(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := fs.String("format", "text", "output format of the changes (text|json)")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer diff [flags] [old] [new]")
+		fmt.Println("compares the rules of two versions of a profile, classifying each change by what it does to the access granted, exits with 1 if they differ")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Printf("aaoptimizer: invalid --format %q, must be text or json\n", *format)
+		os.Exit(-1)
+	}
+
+	var versions [][]string
+	for _, p := range fs.Args() {
+		lines, err := readLines(p)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(-1)
+		}
+		versions = append(versions, lines)
+	}
+
+	entries := diffProfiles(versions[0], versions[1])
+	if *format == "json" {
+		out := struct {
+			Old     string      `json:"old"`
+			New     string      `json:"new"`
+			Entries []diffEntry `json:"entries"`
+		}{fs.Arg(0), fs.Arg(1), entries}
+		if out.Entries == nil {
+			out.Entries = []diffEntry{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(-1)
+		}
+	} else {
+		for _, e := range entries {
+			where := ""
+			if e.Profile != "" {
+				where = " in profile " + e.Profile
+			}
+			fmt.Printf("%s%s (%s):\n", e.Kind, where, e.Classification)
+			for _, r := range e.Old {
+				fmt.Printf("  - %s:%d: %s\n", fs.Arg(0), r.Line, r.Rule)
+			}
+			for _, r := range e.New {
+				fmt.Printf("  + %s:%d: %s\n", fs.Arg(1), r.Line, r.Rule)
+			}
+		}
+	}
+	if len(entries) > 0 {
+		os.Exit(1)
+	}
+}
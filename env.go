@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Every flag may also be set through an AAOPT_ environment variable named
+// after it, AAOPT_JOBS for --jobs, or AAOPT_LINT_FORMAT for lint --format,
+// or in the configuration file. Flags given on the command line take
+// precedence over the environment, which takes precedence over the
+// configuration file. Flags that may be given multiple times take their
+// values separated by blanks in the environment, i.e
+// AAOPT_PATH="/sys/devices /proc", and one per line in the configuration.
+//
+// The configuration file is AAOPT_CONFIG, or aaoptimizer/config in the
+// user configuration directory if it exists. It has one flag per line,
+// like jobs = 4, the flags of the subcommands following a [lint] like
+// section header:
+//
+//	# the optimizer
+//	jobs = 4
+//	path = /sys/devices
+//	path = /proc
+//
+//	[lint]
+//	format = sarif
+
+// envPrefix is the prefix of the environment variables setting the flags
+const envPrefix = "AAOPT_"
+
+// envActions are the flags doing something else than configuring the run,
+// they are not taken from the environment or the configuration
+var envActions = map[string]bool{
+	"version":    true,
+	"completion": true,
+}
+
+// envName returns the environment variable setting the flag of the set
+func envName(fs *flag.FlagSet, name string) string {
+	n := envPrefix
+	if fs != flag.CommandLine {
+		n += fs.Name() + "_"
+	}
+	n += name
+	return strings.ToUpper(strings.ReplaceAll(n, "-", "_"))
+}
+
+// setFlags returns the flags of the set given so far
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
+
+// applyEnv sets the flags of the set not given on the command line from
+// the environment
+func applyEnv(fs *flag.FlagSet) error {
+	given := setFlags(fs)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || envActions[f.Name] {
+			return
+		}
+		name := envName(fs, f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		values := []string{v}
+		if _, ok := f.Value.(*stringList); ok {
+			values = strings.Fields(v)
+		}
+		for _, v := range values {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("invalid %s %q: %v", name, v, serr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// configPath returns the configuration file, and whether it was asked for
+// rather than the default one
+func configPath() (string, bool) {
+	if path, ok := os.LookupEnv(envPrefix + "CONFIG"); ok {
+		return path, true
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(dir, "aaoptimizer", "config"), false
+}
+
+// applyConfig sets the flags of the set given neither on the command line
+// nor in the environment from the configuration file
+func applyConfig(fs *flag.FlagSet) error {
+	path, explicit := configPath()
+	if path == "" {
+		return nil
+	}
+	lines, err := readLines(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	given := setFlags(fs)
+	section := ""
+	if fs != flag.CommandLine {
+		section = fs.Name()
+	}
+	current := ""
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		if tl == "" || strings.HasPrefix(tl, "#") {
+			continue
+		}
+		if strings.HasPrefix(tl, "[") && strings.HasSuffix(tl, "]") {
+			current = strings.TrimSpace(tl[1 : len(tl)-1])
+			continue
+		}
+		if current != section {
+			continue
+		}
+		name, value, ok := strings.Cut(tl, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return fmt.Errorf("%s:%d: expected a flag = value line", path, i+1)
+		}
+		if fs.Lookup(name) == nil || envActions[name] {
+			return fmt.Errorf("%s:%d: unknown flag %s", path, i+1, name)
+		}
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s %q: %v", path, i+1, name, value, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// parseExcludePattern compiles an --exclude-pattern, either a regular
+// expression prefixed by re: or a glob over the whole rule, in which *
+// matches anything, slashes included, and ? a single character
+func parseExcludePattern(p string) (*regexp.Regexp, error) {
+	if re, ok := strings.CutPrefix(p, "re:"); ok {
+		return regexp.Compile(re)
+	}
+	quoted := regexp.QuoteMeta(p)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+	return regexp.Compile("^" + quoted + "$")
+}
+
+// pinExcluded pins the selected rules matching one of the exclude
+// patterns, they are copied through as they are
+func pinExcluded(lines []string, opts *options, pinned map[int]string) {
+	if len(opts.exclude) == 0 {
+		return
+	}
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		if _, ok := opts.prefixes.selectPrefix(tl); !ok {
+			continue
+		}
+		if reason := excludedReason(tl, opts); reason != "" {
+			pinned[i] = reason
+		}
+	}
+}
+
+// excludedReason returns why the rule is left as it is if it matches one
+// of the exclude patterns, or ""
+func excludedReason(tl string, opts *options) string {
+	for _, re := range opts.exclude {
+		if re.MatchString(tl) {
+			return "excluded by --exclude-pattern"
+		}
+	}
+	return ""
+}
+
+// pinPerms pins the selected file rules whose permissions are not one of
+// the sets given to --only-perms, they are copied through as they are
+func pinPerms(lines []string, opts *options, pinned map[int]string) {
+	if len(opts.onlyPerms) == 0 {
+		return
+	}
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		if _, ok := opts.prefixes.selectPrefix(tl); !ok {
+			continue
+		}
+		if reason := permsReason(i+1, tl, opts); reason != "" {
+			pinned[i] = reason
+		}
+	}
+}
+
+// permsReason returns why the rule is left as it is if its permissions
+// are not selected by --only-perms, or ""
+func permsReason(line int, tl string, opts *options) string {
+	if len(opts.onlyPerms) == 0 {
+		return ""
+	}
+	var perms string
+	if r, ok := parseProfileRule(line, tl); ok && r.isFile() {
+		perms = canonicalPerms(r.perms)
+	} else if isBareRule(tl) && opts.bareRules == "assume" {
+		perms = opts.barePerms
+	} else {
+		return ""
+	}
+	if !opts.onlyPerms[perms] {
+		return "permissions not selected by --only-perms"
+	}
+	return ""
+}
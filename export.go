@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var exportHeader = []string{"profile", "line", "qualifiers", "path", "perms", "target", "origins", "source_lines"}
+
+// exportRows returns a row for every file rule of the optimized profile,
+// along with the rules of the original profile it came from. Rules left in
+// place come from themselves.
+func exportRows(lines, out []string, regions []*region) [][]string {
+	// sources are the original lines each line of the output came from
+	sources := make([][]int, len(out))
+	last, outLast := 0, 0
+	untouched := func(end, outStart int) {
+		for i := last; i < end; i++ {
+			sources[outStart+i-last] = []int{i + 1}
+		}
+	}
+	for _, r := range regions {
+		untouched(r.start, outLast)
+		for i, l := range r.generated {
+			sources[r.outStart+i] = r.coveredLines([]string{l})
+		}
+		last, outLast = r.end, r.outStart+len(r.generated)
+	}
+	untouched(len(lines), outLast)
+
+	_, owners := findProfiles(out)
+	var rows [][]string
+	for _, pr := range parseProfileRules(out) {
+		if !pr.isFile() {
+			continue
+		}
+		var qualifiers []string
+		for _, q := range []struct {
+			name string
+			set  bool
+		}{{"audit", pr.audit}, {"deny", pr.deny}, {"owner", pr.owner}} {
+			if q.set {
+				qualifiers = append(qualifiers, q.name)
+			}
+		}
+		profile := ""
+		if pb := owners[pr.line-1]; pb != nil {
+			profile = pb.name
+		}
+		origins := sources[pr.line-1]
+		rows = append(rows, []string{
+			profile,
+			strconv.Itoa(pr.line),
+			strings.Join(qualifiers, " "),
+			pr.path,
+			strings.TrimSuffix(pr.perms, ","),
+			pr.target,
+			strconv.Itoa(len(origins)),
+			lineList(origins),
+		})
+	}
+	return rows
+}
+
+func exportMain(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var paths stringList
+	fs.Var(&paths, "path", "directory prefix of the rules to optimize before exporting, may be given multiple times, defaults to /sys/devices")
+	format := fs.String("format", "csv", "format of the rows (csv|tsv)")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer export [flags] [profile] [output]")
+		fmt.Println("optimizes the profile and writes one row per file rule of the result, with the lines of the original rules it came from")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if *format != "csv" && *format != "tsv" {
+		fmt.Printf("aaoptimizer: invalid --format %q, must be csv or tsv\n", *format)
+		os.Exit(-1)
+	}
+	if len(paths) == 0 {
+		paths = stringList{"/sys/devices"}
+	}
+
+	input := fs.Arg(0)
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	opts := defaultOptions(input, &prefixSet{paths: paths, variables: loadTunables([]string{input})})
+	out, regions, err := optimizeLines(lines, opts)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = writeFile(fs.Arg(1), func(w *bufio.Writer) error {
+		cw := csv.NewWriter(w)
+		if *format == "tsv" {
+			cw.Comma = '\t'
+		}
+		cw.Write(exportHeader)
+		cw.WriteAll(exportRows(lines, out, regions))
+		return cw.Error()
+	})
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+}
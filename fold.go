@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// checkFoldPattern reports why the pattern cannot replace a path
+// component, or "" if it can
+func checkFoldPattern(p string) string {
+	if p == "" || strings.Contains(p, "/") {
+		return "must be a single path component"
+	}
+	if _, ok := aare.Expand(p); !ok {
+		return "expands into too many patterns"
+	}
+	return checkPathToken(p)
+}
+
+// addFold records the fold marker of the rule, it applies to the siblings
+// of the deepest component of the rule the pattern matches
+func (aa *aaOptimizer) addFold(r rule) {
+	if reason := checkFoldPattern(r.fold); reason != "" {
+		fmt.Printf("aaoptimizer: ignoring fold=%s: %s\n", r.fold, reason)
+		return
+	}
+	for k := len(r.pathTokens) - 1; k >= 0; k-- {
+		t := r.pathTokens[k]
+		if t != r.fold && !(isLiteralPart(t) && aare.Match(r.fold, t)) {
+			continue
+		}
+		ctx := ""
+		if k > 0 {
+			ctx = "/" + strings.Join(r.pathTokens[:k], "/")
+		}
+		if aa.folds == nil {
+			aa.folds = make(map[string][]string)
+		}
+		for _, p := range aa.folds[ctx] {
+			if p == r.fold {
+				return
+			}
+		}
+		aa.folds[ctx] = append(aa.folds[ctx], r.fold)
+		return
+	}
+	fmt.Printf("aaoptimizer: ignoring fold=%s, it matches no component of %s\n", r.fold, "/"+strings.Join(r.pathTokens, "/"))
+}
+
+// foldFamilies replaces the literal children of the node matching one of
+// the fold patterns with a single child for the pattern, combining their
+// children. Unlike the other passes it does as it is told, rather than
+// deciding whether generalizing is worth it.
+func (aa *aaOptimizer) foldFamilies(b bucket, ctx string, l *leaf) {
+	var patterns []string
+	if aa.mayGeneralize(ctx) {
+		patterns = append(append(patterns, aa.folds[ctx]...), aa.foldPatterns...)
+	}
+	for _, pattern := range patterns {
+		if !aa.mayIntroduce(pattern) {
+			continue
+		}
+		var members []*leaf
+		for _, c := range l.sortedChildren() {
+			if c.part != pattern && isLiteralPart(c.part) && !aa.keptApart(ctx+"/"+c.part) && aare.Match(pattern, c.part) {
+				members = append(members, c)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+
+		var inputs []string
+		if aa.onTransform != nil {
+			for _, c := range members {
+				inputs = append(inputs, c.paths(ctx+"/"+c.part)...)
+			}
+		}
+		folded := l.children[pattern]
+		if folded == nil {
+			folded = newLeaf(pattern)
+			l.children[pattern] = folded
+		}
+		for _, c := range members {
+			aa.combineLeafs(folded, c)
+			delete(l.children, c.part)
+		}
+		if aa.onTransform != nil {
+			aa.transformed("fold", true, b.rules(inputs), b.rules(folded.paths(ctx+"/"+pattern)))
+		}
+	}
+	for _, c := range l.sortedChildren() {
+		aa.foldFamilies(b, ctx+"/"+c.part, c)
+	}
+}
+
+// Generalize things like:
+// /sys/class/net/eth0/address r, # aaopt: fold=eth[0-9]*
+// /sys/class/net/eth1/address r,
+func (aa *aaOptimizer) optimizeFolds() {
+	aa.eachTree(func(b bucket, l *leaf) {
+		aa.foldFamilies(b, "", l)
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// loadAccessFrequency reads the hit count of each path from the file, one
+// path and count per line in either order, so both "path count" and the
+// output of uniq -c work. Counts of repeated paths add up.
+func loadAccessFrequency(path string) (map[string]int, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	hits := make(map[string]int)
+	for i, l := range lines {
+		tl := strings.TrimSpace(strings.TrimSuffix(l, "\r"))
+		if tl == "" || strings.HasPrefix(tl, "#") {
+			continue
+		}
+		fields := strings.Fields(tl)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a path and a hit count", path, i+1)
+		}
+		p, count := fields[0], fields[1]
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			p, count = fields[1], fields[0]
+			n, err = strconv.Atoi(count)
+		}
+		if err != nil || n < 0 || !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("%s:%d: expected a path and a hit count", path, i+1)
+		}
+		hits[p] += n
+	}
+	return hits, nil
+}
+
+// hotNodes returns the paths hit at least minHits times along with every
+// directory above them. The passes leave those nodes out of alternations
+// and wildcards, keeping the rules for hot paths simple and shallow.
+func hotNodes(hits map[string]int, minHits int) map[string]bool {
+	hot := make(map[string]bool)
+	for p, n := range hits {
+		if n >= minHits {
+			markNode(hot, p)
+		}
+	}
+	return hot
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePercent parses a percentage like 20% or 20, an empty string means
+// the gate is disabled and is returned as -1
+func parsePercent(s string) (float64, error) {
+	if s == "" {
+		return -1, nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return v, nil
+}
+
+func countRules(lines []string) int {
+	n := 0
+	for _, l := range lines {
+		if ruleKind(l) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func countBytes(lines []string) int {
+	n := 0
+	for _, l := range lines {
+		n += len(l) + 1
+	}
+	return n
+}
+
+// change returns how much after differs from before in percent, negative
+// if it shrunk
+func change(before, after int) float64 {
+	if before == 0 {
+		return 0
+	}
+	return float64(after-before) * 100 / float64(before)
+}
+
+// checkGates returns why the optimized lines should not replace the
+// original ones, or an empty string if they pass opts.maxGrowth and
+// opts.minReduction
+func checkGates(lines, optimized []string, opts *options) string {
+	rules := change(countRules(lines), countRules(optimized))
+	bytes := change(countBytes(lines), countBytes(optimized))
+	if opts.maxGrowth >= 0 && (rules > opts.maxGrowth || bytes > opts.maxGrowth) {
+		return fmt.Sprintf("the optimized profile grows by %.1f%% in rules and %.1f%% in bytes, more than the allowed %.1f%%", rules, bytes, opts.maxGrowth)
+	}
+	if opts.minReduction >= 0 && -rules < opts.minReduction && -bytes < opts.minReduction {
+		return fmt.Sprintf("the optimized profile shrinks by %.1f%% in rules and %.1f%% in bytes, less than the required %.1f%%", -rules, -bytes, opts.minReduction)
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+const defaultGroupComment = "{{if .Qualifiers}}{{.Qualifiers}} {{end}}{{.Description}} {{.Area}} access{{if .Target}} transitioning to {{.Target}}{{end}}"
+
+var permDescriptions = []struct {
+	perm        string
+	description string
+}{
+	{"r", "read"},
+	{"w", "write"},
+	{"a", "append"},
+	{"l", "link"},
+	{"k", "lock"},
+	{"m", "mmap"},
+	{"x", "exec"},
+}
+
+// areas names the well-known top level directories
+var areas = map[string]string{
+	"sys":  "sysfs",
+	"proc": "procfs",
+	"dev":  "device",
+	"run":  "runtime",
+}
+
+type groupInfo struct {
+	Qualifiers string
+	Perms      string
+	// Target is the profile exec rules transition to, if any
+	Target      string
+	Description string
+	Area        string
+	Prefix      string
+	Count       int
+}
+
+func describePerms(perms string) string {
+	switch perms {
+	case "r":
+		return "read-only"
+	case "w":
+		return "write-only"
+	case "rw":
+		return "read-write"
+	}
+	var words []string
+	for _, pd := range permDescriptions {
+		if strings.Contains(perms, pd.perm) {
+			words = append(words, pd.description)
+		}
+	}
+	return strings.Join(words, "/")
+}
+
+func describeArea(prefix string) string {
+	first := strings.Split(strings.TrimPrefix(prefix, "/"), "/")[0]
+	if a, ok := areas[first]; ok {
+		return a
+	}
+	return prefix
+}
+
+func parseGroupTemplate(text string) (*template.Template, error) {
+	return template.New("group").Parse(text)
+}
+
+// groupComment renders the section comment of a permission group, if the
+// template fails the permissions are used instead.
+func groupComment(tmpl *template.Template, prefix string, b bucket, count int) string {
+	p := strings.TrimSuffix(b.perms, ",")
+	info := groupInfo{
+		Qualifiers:  b.qualifiers,
+		Perms:       p,
+		Target:      b.target,
+		Description: describePerms(p),
+		Area:        describeArea(prefix),
+		Prefix:      prefix,
+		Count:       count,
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, info); err != nil {
+		return "  # " + p
+	}
+	return "  # " + buf.String()
+}
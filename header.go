@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultHeader = "generated by aa-optimizer app"
+
+// blockInfo holds the variables available to the header and footer
+// templates of a generated block
+type blockInfo struct {
+	Version string
+	Date    string
+	Prefix  string
+	// Profile is the name of the profile the block is in, empty outside
+	// of any
+	Profile string
+	Count   int
+}
+
+// blockMarkers are the comments surrounding a generated block
+type blockMarkers struct {
+	header        *template.Template
+	footer        *template.Template
+	headerPattern *regexp.Regexp
+	footerPattern *regexp.Regexp
+}
+
+// markerPattern turns a marker template into a regular expression matching
+// any rendering of it, each template action may match anything.
+func markerPattern(text string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString(`^\s*#\s*`)
+	for {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			break
+		}
+		sb.WriteString(regexp.QuoteMeta(text[:start]))
+		sb.WriteString(".*")
+		text = text[start+end+2:]
+	}
+	sb.WriteString(regexp.QuoteMeta(text))
+	sb.WriteString(`\s*$`)
+	return regexp.Compile(sb.String())
+}
+
+func newBlockMarkers(header, footer string) (*blockMarkers, error) {
+	var err error
+	bm := &blockMarkers{}
+	if bm.header, err = template.New("header").Parse(header); err != nil {
+		return nil, err
+	}
+	if bm.headerPattern, err = markerPattern(header); err != nil {
+		return nil, err
+	}
+	if footer == "" {
+		return bm, nil
+	}
+	if bm.footer, err = template.New("footer").Parse(footer); err != nil {
+		return nil, err
+	}
+	if bm.footerPattern, err = markerPattern(footer); err != nil {
+		return nil, err
+	}
+	return bm, nil
+}
+
+func renderMarker(tmpl *template.Template, info blockInfo) string {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, info); err != nil {
+		return "  # " + defaultHeader
+	}
+	return "  # " + buf.String()
+}
+
+func newBlockInfo(r *region) blockInfo {
+	info := blockInfo{
+		Version: version,
+		Date:    time.Now().Format("2006-01-02"),
+		Prefix:  r.prefix,
+		Count:   len(r.rules),
+	}
+	if r.profile != nil {
+		info.Profile = r.profile.name
+	}
+	return info
+}
+
+type lineSpan struct {
+	start int
+	end   int
+}
+
+// generatedSpans finds the blocks generated by an earlier run, these can
+// only be found reliably when a footer is used.
+func (bm *blockMarkers) generatedSpans(lines []string) []lineSpan {
+	if bm == nil || bm.footerPattern == nil {
+		return nil
+	}
+
+	var spans []lineSpan
+	start := -1
+	for i, l := range lines {
+		if bm.headerPattern.MatchString(l) {
+			start = i
+		} else if start >= 0 && bm.footerPattern.MatchString(l) {
+			spans = append(spans, lineSpan{start, i + 1})
+			start = -1
+		}
+	}
+	return spans
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// learned profiles hardcode the home directory of whoever ran the program,
+// i.e /home/jane/.config/app. With generalizeHome the user directories are
+// folded onto /home/*, which --use-tunables then refolds to @{HOME}.
+
+func isUserDir(part string) bool {
+	return part != "" && !strings.ContainsAny(part, "*?[{@")
+}
+
+func (aa *aaOptimizer) foldHome(b bucket, home *leaf) {
+	if !aa.mayGeneralize("/home") || !aa.mayIntroduce("*") {
+		return
+	}
+	var users []*leaf
+	for _, c := range home.sortedChildren() {
+		if isUserDir(c.part) && len(c.children) > 0 && !aa.keptApart("/home/"+c.part) {
+			users = append(users, c)
+		}
+	}
+	if len(users) == 0 {
+		return
+	}
+	var names []string
+	for _, c := range users {
+		names = append(names, c.part)
+	}
+	fmt.Printf("aaoptimizer: generalizing the home directories of %s to /home/*, which grants the homes of every user\n", strings.Join(names, ", "))
+
+	folded := home.children["*"]
+	var inputs []string
+	if aa.onTransform != nil {
+		if folded != nil {
+			inputs = folded.paths("/home/*")
+		}
+		for _, c := range users {
+			inputs = append(inputs, c.paths("/home/"+c.part)...)
+		}
+	}
+	if folded == nil {
+		folded = newLeaf("*")
+		home.children["*"] = folded
+	}
+	for _, c := range users {
+		delete(home.children, c.part)
+		aa.combineLeafs(folded, c)
+	}
+	if aa.onTransform != nil {
+		aa.transformed("home", true, b.rules(inputs), b.rules(folded.paths("/home/*")))
+	}
+}
+
+// Generalize things like:
+// /home/jane/.config/app/** r,
+func (aa *aaOptimizer) optimizeHome() {
+	aa.eachTree(func(b bucket, l *leaf) {
+		if home := l.children["home"]; home != nil {
+			aa.foldHome(b, home)
+		}
+	})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the directory system includes, <abstractions/base>, are relative to
+const defaultIncludeBase = "/etc/apparmor.d"
+
+type include struct {
+	// line is 1-based
+	line     int
+	path     string
+	ifExists bool
+	// system is set for the <path> form, which is relative to the
+	// include base instead of the including file
+	system bool
+}
+
+// parseInclude parses #include and include lines, including the
+// include if exists form.
+func parseInclude(line int, l string) (include, bool) {
+	tl := strings.TrimSpace(l)
+	if strings.HasPrefix(tl, "#include") {
+		tl = strings.TrimPrefix(tl, "#")
+	}
+	if !strings.HasPrefix(tl, "include") {
+		return include{}, false
+	}
+	tl = strings.TrimSpace(strings.TrimPrefix(tl, "include"))
+
+	inc := include{line: line}
+	if strings.HasPrefix(tl, "if exists") {
+		inc.ifExists = true
+		tl = strings.TrimSpace(strings.TrimPrefix(tl, "if exists"))
+	}
+
+	switch {
+	case strings.HasPrefix(tl, "<") && strings.HasSuffix(tl, ">"):
+		inc.system = true
+		inc.path = strings.Trim(tl, "<>")
+	case strings.HasPrefix(tl, "\"") && strings.HasSuffix(tl, "\""):
+		inc.path = strings.Trim(tl, "\"")
+	default:
+		return include{}, false
+	}
+	return inc, inc.path != ""
+}
+
+// optional reports whether the included file may be missing. Besides the
+// include if exists form, that is the case for the <local/...> stubs
+// aa-genprof and aa-logprof include, which only exist once created.
+func (inc include) optional() bool {
+	return inc.ifExists || (inc.system && strings.HasPrefix(inc.path, "local/"))
+}
+
+func parseIncludes(lines []string) []include {
+	var incs []include
+	for i, l := range lines {
+		if inc, ok := parseInclude(i+1, l); ok {
+			incs = append(incs, inc)
+		}
+	}
+	return incs
+}
+
+// resolveInclude returns the file the include refers to, dir is the
+// directory of the including file.
+func resolveInclude(inc include, base, dir string) string {
+	if filepath.IsAbs(inc.path) {
+		return inc.path
+	}
+	if inc.system {
+		return filepath.Join(base, inc.path)
+	}
+	return filepath.Join(dir, inc.path)
+}
+
+// includeTargets returns the files an include pulls in, an include of a
+// directory includes every file in it.
+func includeTargets(path string) []string {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.IsDir() {
+		return []string{path}
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+	var targets []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			targets = append(targets, filepath.Join(path, e.Name()))
+		}
+	}
+	return targets
+}
+
+// includeDepth returns how deep the includes of the file nest, a file
+// without includes has depth 1. Missing files count as depth 1 and
+// cycles are not followed.
+func includeDepth(path, base string, visiting map[string]bool) int {
+	if visiting[path] {
+		return 0
+	}
+	lines, err := readLines(path)
+	if err != nil {
+		return 1
+	}
+
+	visiting[path] = true
+	defer delete(visiting, path)
+
+	depth := 0
+	for _, inc := range parseIncludes(lines) {
+		for _, t := range includeTargets(resolveInclude(inc, base, filepath.Dir(path))) {
+			if d := includeDepth(t, base, visiting); d > depth {
+				depth = d
+			}
+		}
+	}
+	return depth + 1
+}
+
+// source is where a line of a profile came from once includes are inlined
+type source struct {
+	file string
+	// line is 1-based
+	line int
+}
+
+func (s source) String() string {
+	return fmt.Sprintf("%s:%d", s.file, s.line)
+}
+
+// flattenIncludes returns the lines of the profile with the included files
+// inlined after each include line, along with the source of every line.
+// Missing files fail unless included with include if exists.
+func flattenIncludes(path, base string) ([]string, []source, error) {
+	var lines []string
+	var sources []source
+	var flatten func(path string, stack map[string]bool) error
+	flatten = func(path string, stack map[string]bool) error {
+		if stack[path] {
+			return fmt.Errorf("include cycle through %s", path)
+		}
+		fileLines, err := readLines(path)
+		if err != nil {
+			return err
+		}
+		stack[path] = true
+		defer delete(stack, path)
+
+		for i, l := range fileLines {
+			lines = append(lines, l)
+			sources = append(sources, source{path, i + 1})
+
+			inc, ok := parseInclude(i+1, l)
+			if !ok {
+				continue
+			}
+			resolved := resolveInclude(inc, base, filepath.Dir(path))
+			if _, err := os.Stat(resolved); err != nil {
+				if inc.optional() {
+					continue
+				}
+				return fmt.Errorf("%s:%d: included file %s does not exist", path, inc.line, resolved)
+			}
+			for _, t := range includeTargets(resolved) {
+				if err := flatten(t, stack); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := flatten(path, make(map[string]bool)); err != nil {
+		return nil, nil, err
+	}
+	return lines, sources, nil
+}
+
+// writeBackInclude optimizes the included file on its own and writes it
+// back in place, when it is in the directory of the profile. Only the
+// prefixes whose rules in the flattened profile all come from the file are
+// optimized, so the consolidated rules end up in the file they came from
+// rather than in the including profile.
+func writeBackInclude(path, profileDir string, flat []string, sources []source, opts options, backups int) error {
+	dir, err := filepath.Abs(profileDir)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dir, abs); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		fmt.Printf("aaoptimizer: not writing back %s, it is outside the directory of the profile\n", path)
+		return nil
+	}
+	shared := make(map[string]bool)
+	for i, l := range flat {
+		tl := strings.TrimSpace(l)
+		if p, ok := opts.prefixes.selectPrefix(tl); ok && ruleKind(tl) != "" && sources[i].file != path {
+			shared[p] = true
+		}
+	}
+	var paths []string
+	for _, p := range opts.prefixes.paths {
+		if !shared[p] {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	opts.file = path
+	opts.prefixes = &prefixSet{paths: paths, variables: opts.prefixes.variables}
+	optimized, regions, err := optimizeLines(lines, &opts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(regions) == 0 {
+		return nil
+	}
+	if reason := checkGates(lines, optimized, &opts); reason != "" {
+		fmt.Printf("aaoptimizer: %s: %s, leaving it untouched\n", path, reason)
+		return nil
+	}
+	if backups > 0 {
+		if err := rotateBackups(path, backups); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("writing %d optimized regions back to %s\n", len(regions), path)
+	return writeLines(optimized, path)
+}
+
+type includeEdge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Line     int    `json:"line"`
+	IfExists bool   `json:"if_exists"`
+	Missing  bool   `json:"missing"`
+}
+
+// includeGraph is the include dependency graph of a profile
+type includeGraph struct {
+	Root  string        `json:"root"`
+	Files []string      `json:"files"`
+	Edges []includeEdge `json:"edges"`
+}
+
+type includeFrame struct {
+	path string
+	line int
+}
+
+type includeWalker struct {
+	base    string
+	graph   *includeGraph
+	visited map[string]bool
+	stack   []includeFrame
+}
+
+func (w *includeWalker) cycleError(path string) error {
+	var chain []string
+	start := 0
+	for i, f := range w.stack {
+		if f.path == path {
+			start = i
+		}
+	}
+	for _, f := range w.stack[start:] {
+		chain = append(chain, fmt.Sprintf("%s:%d", f.path, f.line))
+	}
+	chain = append(chain, path)
+	return fmt.Errorf("include cycle: %s", strings.Join(chain, " -> "))
+}
+
+func (w *includeWalker) walk(path string) error {
+	for _, f := range w.stack {
+		if f.path == path {
+			return w.cycleError(path)
+		}
+	}
+	if w.visited[path] {
+		return nil
+	}
+	w.visited[path] = true
+	w.graph.Files = append(w.graph.Files, path)
+
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+
+	for _, inc := range parseIncludes(lines) {
+		resolved := resolveInclude(inc, w.base, filepath.Dir(path))
+		if _, err := os.Stat(resolved); err != nil {
+			if !inc.optional() {
+				return fmt.Errorf("%s:%d: included file %s does not exist", path, inc.line, resolved)
+			}
+			w.graph.Edges = append(w.graph.Edges, includeEdge{path, resolved, inc.line, true, true})
+			continue
+		}
+
+		for _, t := range includeTargets(resolved) {
+			w.graph.Edges = append(w.graph.Edges, includeEdge{path, t, inc.line, inc.ifExists, false})
+			w.stack = append(w.stack, includeFrame{path, inc.line})
+			err := w.walk(t)
+			w.stack = w.stack[:len(w.stack)-1]
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildIncludeGraph follows all includes of the profile. It fails on
+// cycles, with the chain of includes leading to it, and on missing files
+// unless they are included with include if exists.
+func buildIncludeGraph(path, base string) (*includeGraph, error) {
+	w := &includeWalker{
+		base:    base,
+		graph:   &includeGraph{Root: path},
+		visited: make(map[string]bool),
+	}
+	if err := w.walk(path); err != nil {
+		return nil, err
+	}
+	return w.graph, nil
+}
+
+func (g *includeGraph) dot() []string {
+	lines := []string{"digraph includes {"}
+	for _, f := range g.Files {
+		lines = append(lines, fmt.Sprintf("  %q;", f))
+	}
+	for _, e := range g.Edges {
+		attrs := fmt.Sprintf("label=\"line %d\"", e.Line)
+		if e.IfExists {
+			attrs += ", style=dashed"
+		}
+		if e.Missing {
+			attrs += ", color=red"
+		}
+		lines = append(lines, fmt.Sprintf("  %q -> %q [%s];", e.From, e.To, attrs))
+	}
+	return append(lines, "}")
+}
+
+// writeIncludeGraph exports the graph as JSON, or as DOT if the file ends
+// in .dot or .gv
+func writeIncludeGraph(g *includeGraph, path string) error {
+	ext := filepath.Ext(path)
+	if ext == ".dot" || ext == ".gv" {
+		return writeLines(g.dot(), path)
+	}
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"debug/elf"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sharedLibraries returns the libraries the binary is linked against,
+// resolved by ldd. If ldd cannot resolve them, the names recorded in the
+// binary are returned instead, along with false.
+func sharedLibraries(binary string) ([]string, bool, error) {
+	out, err := exec.Command("ldd", binary).Output()
+	if err == nil {
+		var libs []string
+		for _, l := range strings.Split(string(out), "\n") {
+			tokens := strings.Fields(l)
+			// libc.so.6 => /lib/x86_64-linux-gnu/libc.so.6 (0x...) or
+			// /lib64/ld-linux-x86-64.so.2 (0x...)
+			switch {
+			case len(tokens) >= 3 && tokens[1] == "=>" && strings.HasPrefix(tokens[2], "/"):
+				libs = append(libs, tokens[2])
+			case len(tokens) >= 1 && strings.HasPrefix(tokens[0], "/"):
+				libs = append(libs, tokens[0])
+			}
+		}
+		return libs, true, nil
+	}
+
+	f, err := elf.Open(binary)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return nil, false, err
+	}
+	return libs, false, nil
+}
+
+// profileSkeleton returns a minimal profile for the binary, to be filled in
+// by learning
+func profileSkeleton(name, binary, flags string, libs []string, resolved bool) []string {
+	header := "profile " + name + " " + binary
+	if flags != "" {
+		header += " flags=(" + flags + ")"
+	}
+	lines := []string{
+		"# skeleton generated by aaoptimizer init " + version,
+		"abi <abi/3.0>,",
+		"",
+		"include <tunables/global>",
+		"",
+		header + " {",
+		"  include <abstractions/base>",
+		"",
+		"  " + binary + " mr,",
+	}
+
+	sort.Strings(libs)
+	for _, lib := range libs {
+		if resolved {
+			lines = append(lines, "  "+lib+" mr,")
+		} else {
+			lines = append(lines, "  # needs "+lib+", which ldd could not resolve")
+		}
+	}
+	return append(lines, "}")
+}
+
+func initMain(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	name := fs.String("name", "", "name of the profile, the name of the binary by default")
+	mode := fs.String("mode", "complain", "mode the profile starts in (complain|enforce)")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer init [flags] [binary] [output]")
+		fmt.Println("writes a minimal profile for the binary, to stdout if no output is given")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	if *mode != "complain" && *mode != "enforce" {
+		fmt.Printf("aaoptimizer: invalid --mode %q, must be complain or enforce\n", *mode)
+		os.Exit(-1)
+	}
+
+	// profiles attach to the path with the symlinks resolved
+	binary, err := filepath.Abs(fs.Arg(0))
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	if *name == "" {
+		*name = filepath.Base(binary)
+	}
+	libs, resolved, err := sharedLibraries(binary)
+	if err != nil {
+		fmt.Printf("aaoptimizer: cannot read the libraries of %s: %v\n", binary, err)
+		os.Exit(1)
+	}
+
+	flags := ""
+	if *mode == "complain" {
+		flags = "complain"
+	}
+	lines := profileSkeleton(*name, binary, flags, libs, resolved)
+	if fs.NArg() == 1 {
+		fmt.Println(strings.Join(lines, "\n"))
+		return
+	}
+	if err := writeLines(lines, fs.Arg(1)); err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultApparmorFs is where the kernel exposes the loaded policy
+const defaultApparmorFs = "/sys/kernel/security/apparmor"
+
+// loadedProfiles returns the mode of every profile loaded in the kernel,
+// keyed by name
+func loadedProfiles(apparmorFs string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(apparmorFs, "profiles"))
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string]string)
+	for _, l := range strings.Split(string(data), "\n") {
+		// /usr/bin/foo (enforce)
+		i := strings.LastIndex(l, " (")
+		if i < 0 || !strings.HasSuffix(l, ")") {
+			continue
+		}
+		loaded[l[:i]] = l[i+2 : len(l)-1]
+	}
+	return loaded, nil
+}
+
+// loadedRawData returns the policy the kernel loaded the profile from, as
+// compiled by apparmor_parser. The directories of the profiles are named
+// after a mangled form of the name, so the name files are compared.
+func loadedRawData(apparmorFs, name string) ([]byte, error) {
+	dirs, err := filepath.Glob(filepath.Join(apparmorFs, "policy", "profiles", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		n, err := os.ReadFile(filepath.Join(d, "name"))
+		if err != nil || strings.TrimSpace(string(n)) != name {
+			continue
+		}
+		return os.ReadFile(filepath.Join(d, "raw_data"))
+	}
+	return nil, fmt.Errorf("the kernel does not expose the policy of %s", name)
+}
+
+// checkLoaded reports the mode every profile of the file is loaded in. If
+// diff is set, the file is compiled and compared against the policy the
+// kernel loaded, returning an error if any profile differs so nothing is
+// modified based on a file that is not what is enforced.
+func checkLoaded(lines []string, file, apparmorFs string, diff bool) error {
+	loaded, err := loadedProfiles(apparmorFs)
+	if err != nil {
+		return fmt.Errorf("cannot read the loaded profiles: %v", err)
+	}
+	blocks, _ := findProfiles(lines)
+	var names []string
+	for _, b := range blocks {
+		mode, ok := loaded[b.name]
+		if !ok {
+			fmt.Printf("profile %s is not loaded\n", b.name)
+			continue
+		}
+		fmt.Printf("profile %s is loaded in %s mode\n", b.name, mode)
+		if b.parent == nil {
+			names = append(names, b.name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Printf("warning: none of the profiles of %s are loaded\n", file)
+		return nil
+	}
+	if !diff {
+		return nil
+	}
+
+	compiled, err := exec.Command("apparmor_parser", "--skip-kernel-load", "--skip-cache", "--quiet", "--stdout", file).Output()
+	if err != nil {
+		return fmt.Errorf("cannot compile %s: %v", file, err)
+	}
+	var differs []string
+	for _, name := range names {
+		raw, err := loadedRawData(apparmorFs, name)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(compiled, raw) {
+			differs = append(differs, name)
+		}
+	}
+	if len(differs) > 0 {
+		return fmt.Errorf("the loaded policy of %s differs from %s, reload it first", strings.Join(differs, ", "), file)
+	}
+	fmt.Printf("the loaded policy matches %s\n", file)
+	return nil
+}
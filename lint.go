@@ -0,0 +1,468 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+type severity int
+
+const (
+	severityWarning severity = iota
+	severityError
+)
+
+func (s severity) String() string {
+	if s == severityError {
+		return "error"
+	}
+	return "warning"
+}
+
+func parseSeverity(s string) (severity, error) {
+	switch s {
+	case "warning":
+		return severityWarning, nil
+	case "error":
+		return severityError, nil
+	}
+	return severityWarning, fmt.Errorf("unknown severity %q, must be warning or error", s)
+}
+
+type finding struct {
+	file     string
+	line     int
+	message  string
+	check    string
+	severity severity
+}
+
+type lintCheck struct {
+	id       string
+	severity severity
+	run      func(rules []profileRule) []finding
+	// runLines is set instead of run by the checks looking at the lines
+	// rather than the rules
+	runLines func(lines []string, sources []source) []finding
+}
+
+var lintChecks = []lintCheck{
+	{"shadowed-allow", severityWarning, lintShadowedAllows, nil},
+	{"duplicate-capability", severityWarning, lintDuplicateCapabilities, nil},
+	{"conflicting-exec", severityError, lintConflictingExec, nil},
+	{"write-root-glob", severityError, lintWriteRootGlob, nil},
+	{"write-proc-mem", severityError, lintWriteProcMem, nil},
+	{"all-perms", severityWarning, lintAllPerms, nil},
+	{"write-sys-glob", severityWarning, lintWriteSysGlob, nil},
+	{"file-catch-all", severityWarning, lintFileCatchAll, nil},
+	{"invalid-perms", severityError, lintInvalidPerms, nil},
+	{"append-write-conflict", severityWarning, lintAppendWriteConflict, nil},
+	{"unused-variable", severityWarning, nil, lintUnusedVariables},
+	{"dead-conditional", severityWarning, nil, lintDeadConditionals},
+}
+
+// coveredBy reports whether every path the pattern matches is matched by
+// the other one
+func coveredBy(p, other string) bool {
+	ok, err := aare.Contained(p, other)
+	return err == nil && ok
+}
+
+// lintShadowedAllows reports allow rules that are fully covered by another
+// allow rule with the same or more permissions, or by a deny rule.
+func lintShadowedAllows(rules []profileRule) []finding {
+	var findings []finding
+	for _, r := range rules {
+		if !r.isFile() || r.deny {
+			continue
+		}
+		perms := canonicalPerms(r.perms)
+		for _, o := range rules {
+			if !o.isFile() || o.line == r.line {
+				continue
+			}
+			// a rule without the owner qualifier covers owner rules but
+			// not the other way around
+			if o.owner && !r.owner {
+				continue
+			}
+
+			oPerms := canonicalPerms(o.perms)
+			if o.deny {
+				if permsCover(oPerms, perms) && coveredBy(r.path, o.path) {
+					findings = append(findings, finding{line: r.line, message: fmt.Sprintf("%q can never take effect, it is denied by %s", r.text, o.ref())})
+					break
+				}
+				continue
+			}
+
+			// audit rules log the accesses, a rule differing in audit
+			// from the other is not redundant
+			if o.target != r.target || o.audit != r.audit {
+				continue
+			}
+			// different exec modes conflict rather than cover each other
+			if (o.isExec() || r.isExec()) && oPerms != perms {
+				continue
+			}
+			if !permsCover(oPerms, perms) {
+				continue
+			}
+			// identical rules cover each other, only report the later one
+			if o.path == r.path && oPerms == perms && o.owner == r.owner && o.line > r.line {
+				continue
+			}
+			if coveredBy(r.path, o.path) {
+				findings = append(findings, finding{line: r.line, message: fmt.Sprintf("%q is shadowed by %s", r.text, o.ref())})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// lintDuplicateCapabilities reports capabilities that are granted more
+// than once, including by a bare capability rule. Audit and plain rules
+// are compared apart, as audit changes the logging.
+func lintDuplicateCapabilities(rules []profileRule) []finding {
+	var findings []finding
+	for _, audit := range []bool{false, true} {
+		findings = append(findings, duplicateCapabilities(rules, audit)...)
+	}
+	return findings
+}
+
+// duplicateCapabilities reports the capabilities granted more than once
+// by the audit or the plain rules
+func duplicateCapabilities(rules []profileRule, audit bool) []finding {
+	var findings []finding
+	seen := make(map[string]profileRule)
+	var all *profileRule
+	for i, r := range rules {
+		if !r.capability || r.deny || r.audit != audit {
+			continue
+		}
+		if len(r.capabilities) == 0 {
+			if all != nil {
+				findings = append(findings, finding{line: r.line, message: fmt.Sprintf("all capabilities are already granted by %s", all.ref())})
+			} else {
+				all = &rules[i]
+			}
+			continue
+		}
+		for _, c := range r.capabilities {
+			if o, ok := seen[c]; ok {
+				findings = append(findings, finding{line: r.line, message: fmt.Sprintf("capability %s is already granted by %s", c, o.ref())})
+			} else if all != nil {
+				findings = append(findings, finding{line: r.line, message: fmt.Sprintf("capability %s is already granted by %s", c, all.ref())})
+			} else {
+				seen[c] = r
+			}
+		}
+	}
+	return findings
+}
+
+// lintConflictingExec reports exec rules for the same pattern that ask for
+// different transitions.
+func lintConflictingExec(rules []profileRule) []finding {
+	var findings []finding
+	seen := make(map[string]profileRule)
+	for _, r := range rules {
+		if !r.isExec() || r.deny {
+			continue
+		}
+		o, ok := seen[r.path]
+		if !ok {
+			seen[r.path] = r
+			continue
+		}
+		if o.perms != r.perms || o.target != r.target {
+			findings = append(findings, finding{line: r.line, message: fmt.Sprintf("exec transition for %s conflicts with %s", r.path, o.ref())})
+		}
+	}
+	return findings
+}
+
+func grantsWrite(r profileRule) bool {
+	return !r.deny && strings.ContainsAny(r.perms, "wa")
+}
+
+// lintRules runs the check on every allow file rule, a non-empty message
+// from the check means the rule is reported
+func lintRules(rules []profileRule, check func(r profileRule) string) []finding {
+	var findings []finding
+	for _, r := range rules {
+		if !r.isFile() || r.deny {
+			continue
+		}
+		if msg := check(r); msg != "" {
+			findings = append(findings, finding{line: r.line, message: msg})
+		}
+	}
+	return findings
+}
+
+func lintWriteRootGlob(rules []profileRule) []finding {
+	return lintRules(rules, func(r profileRule) string {
+		if strings.ContainsAny(r.perms, "wk") && aare.Covers(r.path, "/**") {
+			return fmt.Sprintf("%q grants write or lock access to the whole filesystem", r.text)
+		}
+		return ""
+	})
+}
+
+func lintWriteProcMem(rules []profileRule) []finding {
+	return lintRules(rules, func(r profileRule) string {
+		if grantsWrite(r) && aare.Intersects(r.path, "/proc/*/mem") {
+			return fmt.Sprintf("%q grants write access to process memory", r.text)
+		}
+		return ""
+	})
+}
+
+func lintAllPerms(rules []profileRule) []finding {
+	return lintRules(rules, func(r profileRule) string {
+		if permsCover(r.perms, "rwmx") {
+			return fmt.Sprintf("%q grants every permission", r.text)
+		}
+		return ""
+	})
+}
+
+func lintWriteSysGlob(rules []profileRule) []finding {
+	return lintRules(rules, func(r profileRule) string {
+		if grantsWrite(r) && aare.Covers(r.path, "/sys/**") {
+			return fmt.Sprintf("%q grants write access to all of /sys", r.text)
+		}
+		return ""
+	})
+}
+
+func lintInvalidPerms(rules []profileRule) []finding {
+	var findings []finding
+	for _, r := range rules {
+		if !r.isFile() {
+			continue
+		}
+		if err := validatePerms(r.perms); err != nil {
+			findings = append(findings, finding{line: r.line, message: fmt.Sprintf("%q has invalid permissions: %v", r.text, err)})
+		}
+	}
+	return findings
+}
+
+// lintAppendWriteConflict reports append rules overlapping a write rule,
+// the append rule is redundant as w implies a and mixing them is
+// rejected by apparmor_parser within a single rule
+func lintAppendWriteConflict(rules []profileRule) []finding {
+	var findings []finding
+	for _, r := range rules {
+		if !r.isFile() || r.deny || !strings.ContainsRune(r.perms, 'a') || strings.ContainsRune(r.perms, 'w') {
+			continue
+		}
+		for _, o := range rules {
+			if !o.isFile() || o.deny || o.owner != r.owner || !strings.ContainsRune(o.perms, 'w') {
+				continue
+			}
+			if aare.Intersects(o.path, r.path) {
+				findings = append(findings, finding{line: r.line, message: fmt.Sprintf("%q appends to files that %s already grants write access to, w implies a", r.text, o.ref())})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// catchAllWarning describes what a bare file rule does to the other file
+// rules of the profile
+func catchAllWarning(rules []profileRule) (int, string) {
+	files := 0
+	line := 0
+	for _, r := range rules {
+		if r.isFile() && !r.deny {
+			files++
+		}
+		if r.catchAll && !r.deny && line == 0 {
+			line = r.line
+		}
+	}
+	if line == 0 {
+		return 0, ""
+	}
+	return line, fmt.Sprintf("\"file,\" grants access to every file, which obviates %d other file rules", files)
+}
+
+func lintFileCatchAll(rules []profileRule) []finding {
+	line, msg := catchAllWarning(rules)
+	if msg == "" {
+		return nil
+	}
+	return []finding{{line: line, message: msg}}
+}
+
+// lint runs the checks over the lines, sources is the origin of each line
+// if includes were inlined, or nil
+func lint(lines []string, sources []source, disabled map[string]bool, severities map[string]severity) []finding {
+	rules := parseProfileRules(lines)
+	if sources != nil {
+		for i := range rules {
+			rules[i].src = sources[rules[i].line-1]
+		}
+	}
+	// the rules of different profiles never interact, so the checks run
+	// over the rules of each profile on their own
+	_, owners := findProfiles(lines)
+	var profiles [][]profileRule
+	index := make(map[*profileBlock]int)
+	for _, r := range rules {
+		owner := owners[r.line-1]
+		i, ok := index[owner]
+		if !ok {
+			i = len(profiles)
+			index[owner] = i
+			profiles = append(profiles, nil)
+		}
+		profiles[i] = append(profiles[i], r)
+	}
+
+	var findings []finding
+	for _, c := range lintChecks {
+		if disabled[c.id] {
+			continue
+		}
+		sev, ok := severities[c.id]
+		if !ok {
+			sev = c.severity
+		}
+		var checked []finding
+		if c.runLines != nil {
+			checked = c.runLines(lines, sources)
+		} else {
+			for _, pr := range profiles {
+				checked = append(checked, c.run(pr)...)
+			}
+		}
+		for _, f := range checked {
+			f.check = c.id
+			f.severity = sev
+			if sources != nil && f.line > 0 {
+				src := sources[f.line-1]
+				f.file, f.line = src.file, src.line
+			}
+			findings = append(findings, f)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].line < findings[j].line
+	})
+	return findings
+}
+
+func lintMain(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	var disable, severityOverrides stringList
+	fs.Var(&disable, "disable", "check to disable, may be given multiple times")
+	fs.Var(&severityOverrides, "severity", "override the severity of a check as check=warning|error, may be given multiple times")
+	failOn := fs.String("fail-on", "warning", "lowest severity that makes lint exit with an error, warning or error")
+	format := fs.String("format", "text", "output format of the findings (text|sarif)")
+	followIncludes := fs.Bool("follow-includes", false, "lint the profile along with every file it includes, reporting findings at the file they are in")
+	includeBase := fs.String("include-base", defaultIncludeBase, "directory <...> includes are relative to")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer lint [flags] [profile]")
+		fs.PrintDefaults()
+		fmt.Println("checks:")
+		for _, c := range lintChecks {
+			fmt.Printf("  %s (%s)\n", c.id, c.severity)
+		}
+	}
+	parseFlags(fs, args)
+
+	failSeverity, err := parseSeverity(*failOn)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	if *format != "text" && *format != "sarif" {
+		fmt.Printf("aaoptimizer: invalid --format %q, must be text or sarif\n", *format)
+		os.Exit(-1)
+	}
+
+	disabled := make(map[string]bool)
+	for _, d := range disable {
+		disabled[d] = true
+	}
+	severities := make(map[string]severity)
+	for _, so := range severityOverrides {
+		id, level, ok := strings.Cut(so, "=")
+		if !ok {
+			fmt.Printf("aaoptimizer: invalid severity override %q, expected check=level\n", so)
+			os.Exit(-1)
+		}
+		sev, err := parseSeverity(level)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(-1)
+		}
+		severities[id] = sev
+	}
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	var lines []string
+	var sources []source
+	if *followIncludes {
+		lines, sources, err = flattenIncludes(input, *includeBase)
+	} else {
+		lines, err = readLines(input)
+	}
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+
+	findings := lint(lines, sources, disabled, severities)
+	for i := range findings {
+		if findings[i].file == "" {
+			findings[i].file = input
+		}
+	}
+	if *format == "sarif" {
+		var checks []lintCheck
+		for _, c := range lintChecks {
+			if disabled[c.id] {
+				continue
+			}
+			if sev, ok := severities[c.id]; ok {
+				c.severity = sev
+			}
+			checks = append(checks, c)
+		}
+		if err := writeSarif(os.Stdout, checks, findings); err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(-1)
+		}
+	}
+
+	failed := false
+	for _, f := range findings {
+		if *format == "text" {
+			fmt.Printf("%s:%d: %s: %s [%s]\n", f.file, f.line, f.severity, f.message, f.check)
+		}
+		if f.severity >= failSeverity {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
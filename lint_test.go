@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintPerProfile(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		lines []string
+		// want are the checks expected to report, in order
+		want []string
+	}{{
+		name: "capability in two profiles",
+		lines: []string{
+			"profile a {",
+			"  capability net_admin,",
+			"}",
+			"profile b {",
+			"  capability net_admin,",
+			"}",
+		},
+	}, {
+		name: "capability twice in a profile",
+		lines: []string{
+			"profile a {",
+			"  capability net_admin,",
+			"  capability net_admin,",
+			"}",
+		},
+		want: []string{"duplicate-capability"},
+	}, {
+		name: "exec mode per profile",
+		lines: []string{
+			"profile a {",
+			"  /usr/bin/tool Px,",
+			"}",
+			"profile b {",
+			"  /usr/bin/tool Cx,",
+			"}",
+		},
+	}, {
+		name: "shadowed across profiles",
+		lines: []string{
+			"profile a {",
+			"  /sys/devices/** r,",
+			"}",
+			"profile b {",
+			"  /sys/devices/a r,",
+			"}",
+		},
+	}, {
+		name: "shadowed within a hat",
+		lines: []string{
+			"profile a {",
+			"  /sys/devices/** r,",
+			"  ^hat {",
+			"    /sys/devices/a r,",
+			"  }",
+			"}",
+		},
+	}, {
+		name: "shadowed in a profile",
+		lines: []string{
+			"profile a {",
+			"  /sys/devices/** r,",
+			"  /sys/devices/a r,",
+			"}",
+		},
+		want: []string{"shadowed-allow"},
+	}, {
+		name: "audit rule below a plain one",
+		lines: []string{
+			"profile a {",
+			"  /sys/devices/** r,",
+			"  audit /sys/devices/a r,",
+			"}",
+		},
+	}, {
+		name: "plain rule below an audit one",
+		lines: []string{
+			"profile a {",
+			"  audit /sys/devices/** r,",
+			"  /sys/devices/a r,",
+			"}",
+		},
+	}, {
+		name: "audit capability",
+		lines: []string{
+			"profile a {",
+			"  capability net_admin,",
+			"  audit capability net_admin,",
+			"}",
+		},
+	}, {
+		name: "audit rule denied",
+		lines: []string{
+			"profile a {",
+			"  deny /sys/devices/** r,",
+			"  audit /sys/devices/a r,",
+			"}",
+		},
+		want: []string{"shadowed-allow"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, f := range lint(tc.lines, nil, nil, nil) {
+				got = append(got, f.check)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("got findings %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// In lossless mode every rewritten region is verified instead of trusting
+// the passes: the alternations of the generated rules are expanded, and
+// the resulting patterns must match exactly what the original rules did.
+
+type expandedRule struct {
+	text     string
+	b        bucket
+	patterns []string
+}
+
+func expandRules(rules []string) ([]expandedRule, error) {
+	var expanded []expandedRule
+	for _, rl := range rules {
+		rr, err := newRule(rl)
+		if err != nil {
+			return nil, err
+		}
+		if rr.deny {
+			continue
+		}
+		pr, ok := parseProfileRule(0, rl)
+		if !ok || !pr.isFile() {
+			return nil, fmt.Errorf("cannot verify %q", strings.TrimSpace(rl))
+		}
+		patterns, ok := aare.Expand(pr.path)
+		if !ok {
+			return nil, fmt.Errorf("%q has too many alternations to verify", strings.TrimSpace(rl))
+		}
+		expanded = append(expanded, expandedRule{strings.TrimSpace(rl), rr.bucket(), patterns})
+	}
+	return expanded, nil
+}
+
+// grants reports whether the rule grants the pattern with at least the
+// permissions of b
+func (er *expandedRule) grants(b bucket, pattern string) bool {
+	if er.b.qualifiers != b.qualifiers || er.b.target != b.target || !permsCover(er.b.perms, b.perms) {
+		return false
+	}
+	for _, p := range er.patterns {
+		if aare.Covers(p, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyLossless checks that the optimized rules of the region grant
+// exactly what its original rules did, no more and no less
+func verifyLossless(r *region, trees map[bucket][]string) error {
+	original, err := expandRules(r.rules)
+	if err != nil {
+		return err
+	}
+	var buckets []bucket
+	for b := range trees {
+		buckets = append(buckets, b)
+	}
+	sortBuckets(buckets)
+	var rules []string
+	for _, b := range buckets {
+		rules = append(rules, trees[b]...)
+	}
+	generated, err := expandRules(rules)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range generated {
+		for _, p := range g.patterns {
+			granted := false
+			for i := range original {
+				if original[i].grants(g.b, p) {
+					granted = true
+					break
+				}
+			}
+			if !granted {
+				return fmt.Errorf("%q grants %s which the original rules did not", g.text, p)
+			}
+		}
+	}
+	for _, o := range original {
+		for _, p := range o.patterns {
+			granted := false
+			for i := range generated {
+				if generated[i].grants(o.b, p) {
+					granted = true
+					break
+				}
+			}
+			if !granted {
+				return fmt.Errorf("%q is no longer granted", o.text)
+			}
+		}
+	}
+	return nil
+}
@@ -2,34 +2,184 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"test/aaoptimizer/aare"
 )
 
 type rule struct {
 	deny       bool
+	qualifiers []string
 	pathTokens []string
 	current    int
 	perms      string
+	// target is the profile an exec rule transitions to, if any
+	target string
+	// group, noMerge and fold come from the markers of the rule
+	group   string
+	noMerge bool
+	fold    string
+}
+
+// parseError is returned for rules the optimizer cannot ingest
+type parseError struct {
+	rule   string
+	reason string
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("cannot parse rule %q: %s", e.rule, e.reason)
+}
+
+// checkPathToken makes sure the alternations of a path component can be
+// handled by leaf.addRule, which expects a component to either be a
+// single alternation or have none at all
+func checkPathToken(t string) string {
+	depth := 0
+	for i := 0; i < len(t); i++ {
+		switch t[i] {
+		case '\\':
+			i++
+		case '[':
+			i = aare.SkipClass(t, i)
+		case '{':
+			if i > 0 && t[i-1] == '@' {
+				// skip over the variable name
+				if end := strings.IndexByte(t[i:], '}'); end > 0 {
+					i += end
+				}
+				continue
+			}
+			depth++
+			if depth > 1 {
+				return "nested alternations are not supported"
+			}
+		case '}':
+			depth--
+			if depth < 0 {
+				return "alternation spans path components"
+			}
+		}
+	}
+	if depth != 0 {
+		return "alternation spans path components"
+	}
+	// a suffix like {eth,wlan}* is shared by every alternative
+	if strings.HasPrefix(t, "{") && strings.ContainsAny(t[aare.ClosingBrace(t, 0)+1:], "{}") {
+		return "alternations must cover a whole path component"
+	}
+	return ""
 }
 
-func newRule(rs string) rule {
+func newRule(rs string) (rule, error) {
 	r := rule{}
 	i := 0
-	tokens := strings.Split(rs, " ")
-	if len(tokens) == 3 {
-		if tokens[i] == "deny" {
+	tokens := aare.Fields(strings.TrimSuffix(strings.TrimSpace(stripComment(rs)), ","))
+qualifiers:
+	for ; i < len(tokens)-2; i++ {
+		switch tokens[i] {
+		case "deny":
 			r.deny = true
+		case "audit", "owner", "file":
+			// the file keyword is kept as a qualifier so it is emitted
+			// back as written
+			r.qualifiers = append(r.qualifiers, tokens[i])
+		case "allow":
+		default:
+			break qualifiers
 		}
-		i++
 	}
-	r.pathTokens = strings.Split(tokens[i], "/")
+	if i >= len(tokens) {
+		return rule{}, &parseError{rs, "missing path"}
+	}
+	if i+1 >= len(tokens) {
+		return rule{}, &parseError{rs, "missing permissions"}
+	}
+	switch {
+	case i+2 == len(tokens):
+	case i+4 == len(tokens) && tokens[i+2] == "->":
+		r.target = tokens[i+3]
+	default:
+		return rule{}, &parseError{rs, "unexpected trailing tokens"}
+	}
+
+	// the member order of alternations does not matter, sorting them
+	// makes rules that only differ in it identical
+	r.pathTokens = aare.SplitPath(aare.Canonical(tokens[i]))
 	if r.pathTokens[0] == "" {
 		r.pathTokens = r.pathTokens[1:]
 	}
-	r.perms = tokens[i+1]
-	return r
+	for _, t := range r.pathTokens {
+		if reason := checkPathToken(t); reason != "" {
+			return rule{}, &parseError{rs, reason}
+		}
+	}
+
+	// w and a cannot be combined, w wins as it implies a
+	perms, _ := resolveAppendWrite(tokens[i+1])
+	if err := validatePerms(perms); err != nil {
+		return rule{}, &parseError{rs, err.Error()}
+	}
+	perms = canonicalPerms(perms)
+	if r.target != "" && !strings.ContainsRune(perms, 'x') {
+		return rule{}, &parseError{rs, "exec target without exec permissions"}
+	}
+	r.perms = perms + ","
+	m := parseMarkers(rs)
+	r.group, r.noMerge, r.fold = m.group, m.noMerge, m.fold
+	return r, nil
+}
+
+// bucket is what the optimizer trees are keyed on, only rules with the
+// same qualifiers, permissions, exec target and marker group may ever be
+// merged
+type bucket struct {
+	qualifiers string
+	perms      string
+	target     string
+	group      string
+}
+
+func (r *rule) bucket() bucket {
+	return bucket{
+		qualifiers: strings.Join(r.qualifiers, " "),
+		perms:      r.perms,
+		target:     r.target,
+		group:      r.group,
+	}
+}
+
+func (b bucket) format(path string) string {
+	// the trees put a / in front of every path, including those that
+	// start with a variable
+	if strings.HasPrefix(path, "/@{") {
+		path = path[1:]
+	}
+	perms := b.perms
+	if b.target != "" {
+		perms = fmt.Sprintf("%s -> %s,", strings.TrimSuffix(b.perms, ","), b.target)
+	}
+	if b.qualifiers != "" {
+		return fmt.Sprintf("  %s %s %s", b.qualifiers, path, perms)
+	}
+	return fmt.Sprintf("  %s %s", path, perms)
+}
+
+// rules returns the rules of the bucket for the paths, without indentation
+func (b bucket) rules(paths []string) []string {
+	var rules []string
+	for _, p := range paths {
+		rules = append(rules, strings.TrimSpace(b.format(p)))
+	}
+	return rules
 }
 
 func (r *rule) next() (string, bool) {
@@ -53,6 +203,19 @@ func newLeaf(p string) *leaf {
 	}
 }
 
+// sortedChildren returns the children ordered by their part, the passes
+// walk them in this order so the output does not depend on map ordering
+func (l *leaf) sortedChildren() []*leaf {
+	children := make([]*leaf, 0, len(l.children))
+	for _, c := range l.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].part < children[j].part
+	})
+	return children
+}
+
 func (l *leaf) addToken(p string) *leaf {
 	nl := l.children[p]
 	if nl == nil {
@@ -65,10 +228,9 @@ func (l *leaf) addToken(p string) *leaf {
 func (l *leaf) addRule(r rule) {
 	p, last := r.next()
 	if strings.HasPrefix(p, "{") {
-		pt := strings.Trim(p, "{}")
-		pts := strings.Split(pt, ",")
-		for _, t := range pts {
-			nl := l.addToken(t)
+		end := aare.ClosingBrace(p, 0)
+		for _, t := range aare.SplitAlternation(p[1:end]) {
+			nl := l.addToken(t + p[end+1:])
 			if !last {
 				cl := r.current
 				nl.addRule(r)
@@ -95,43 +257,248 @@ func (l *leaf) dump(ctx string) {
 	}
 }
 
-func (l *leaf) format(ctx, perms string) []string {
-	var lines []string
-	nctx := fmt.Sprintf("%s/%s", ctx, l.part)
+// paths returns the path of every rule below the leaf, ctx is the path of
+// the leaf itself
+func (l *leaf) paths(ctx string) []string {
 	if len(l.children) == 0 {
-		lines = append(lines, fmt.Sprintf("  %s %s", nctx, perms))
+		return []string{ctx}
+	}
+	var paths []string
+	for _, c := range l.sortedChildren() {
+		paths = append(paths, c.paths(ctx+"/"+c.part)...)
 	}
+	return paths
+}
 
-	for _, c := range l.children {
-		lines = append(lines, c.format(nctx, perms)...)
+// walkPaths calls fn with the paths of the tree in the order paths returns
+// them, without collecting them first
+func (l *leaf) walkPaths(ctx string, fn func(p string)) {
+	if len(l.children) == 0 {
+		fn(ctx)
+		return
+	}
+	for _, c := range l.sortedChildren() {
+		c.walkPaths(ctx+"/"+c.part, fn)
 	}
-	return lines
 }
 
 type aaOptimizer struct {
-	trees map[string]*leaf
+	trees map[bucket]*leaf
+	// patterns the passes must not introduce into rules that did not
+	// already have them
+	forbidden []string
+	// mergeSubsetPerms drops rules that are also granted by a tree with a
+	// superset of the permissions
+	mergeSubsetPerms bool
+	// generalizeHome folds the user directories below /home onto /home/*
+	generalizeHome bool
+	// foldPids folds the process ids below /proc onto a pattern matching
+	// any of them
+	foldPids bool
+	// foldUdev folds the minors of the udev device data onto a pattern
+	// matching any of them
+	foldUdev bool
+	// pidVariable folds process ids onto @{pid} instead of [0-9]*
+	pidVariable bool
+	// minDepth is the first path component the passes may put wildcards
+	// or alternations in
+	minDepth int
+	// maxGlobstars is the most ** a generated rule may have, 0 means no
+	// limit
+	maxGlobstars int
+	// foldSingleChar is how many siblings differing in a single
+	// character are folded onto a ?, 0 disables folding
+	foldSingleChar int
+	// fsRoot is the directory the paths are relative to on this system,
+	// the entries of directories the rules enumerate are only folded onto
+	// negated classes if set
+	fsRoot string
+	// onTransform is called for every transformation made by the passes
+	// if set
+	onTransform func(tx transformation)
+	// arenas hold the rules until the passes run if set, taking far fewer
+	// allocations to build than the trees
+	arenas map[bucket]*treeArena
+	// jobs is how many trees the passes work on at the same time, and mu
+	// serializes the calls to onTransform when they do
+	jobs int
+	mu   sync.Mutex
+	// progress is reported to if set, pass being the pass running
+	progress *progress
+	pass     string
+	// run tracks interruptions if set, passesDone counts the passes that
+	// ran or were skipped when resuming
+	run         *runState
+	passesDone  int
+	finalPasses bool
+	// hot are the paths hit often enough in the access logs to be kept
+	// out of alternations and wildcards, along with the directories above
+	// them, and noMerge those of the rules marked no-merge
+	hot     map[string]bool
+	noMerge map[string]bool
+	// folds are the patterns the siblings below each path are folded
+	// onto, from the fold markers of the rules, and foldPatterns those
+	// applying below every path
+	folds        map[string][]string
+	foldPatterns []string
 }
 
 func newAaOptimizer() *aaOptimizer {
 	return &aaOptimizer{
-		trees: make(map[string]*leaf),
+		trees: make(map[bucket]*leaf),
 	}
 }
 
-func (aa *aaOptimizer) addRule(rs string) {
-	r := newRule(rs)
+// addRule parses the rule and adds it to the tree of its bucket. The trees
+// have an unnamed root so rules with different first components never
+// share a node.
+func (aa *aaOptimizer) addRule(rs string) error {
+	r, err := newRule(rs)
+	if err != nil {
+		return err
+	}
 	if r.deny {
 		// ignore deny for now
-		return
+		return nil
+	}
+
+	if r.noMerge {
+		if aa.noMerge == nil {
+			aa.noMerge = make(map[string]bool)
+		}
+		markNode(aa.noMerge, "/"+strings.Join(r.pathTokens, "/"))
+	}
+	if r.fold != "" {
+		aa.addFold(r)
 	}
 
-	p, _ := r.next()
-	l := aa.trees[r.perms]
+	b := r.bucket()
+	if aa.arenas != nil {
+		ta := aa.arenas[b]
+		if ta == nil {
+			ta = newTreeArena()
+			aa.arenas[b] = ta
+		}
+		ta.addRule(0, r)
+		aa.progress.ingested()
+		return nil
+	}
+	l := aa.trees[b]
 	if l == nil {
-		l = newLeaf(p)
-		aa.trees[r.perms] = l
+		l = newLeaf("")
+		aa.trees[b] = l
 	}
 	l.addRule(r)
+	aa.progress.ingested()
+	return nil
+}
+
+func (aa *aaOptimizer) transformed(pass string, widening bool, inputs, outputs []string) {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	aa.onTransform(transformation{Pass: pass, Inputs: inputs, Outputs: outputs, Widening: widening})
+}
+
+// mayIntroduce reports whether a pass is allowed to put the part into rules
+// that did not have it before
+func (aa *aaOptimizer) mayIntroduce(part string) bool {
+	for _, f := range aa.forbidden {
+		if strings.Contains(part, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// mayGeneralize reports whether a pass is allowed to put wildcards or
+// alternations into the children of the node at ctx
+func (aa *aaOptimizer) mayGeneralize(ctx string) bool {
+	return strings.Count(ctx, "/")+1 >= aa.minDepth
+}
+
+// mayGlobstar reports whether a pass is allowed to turn the rules for the
+// inputs into the ones for the outputs, none of the rules it generates may
+// have more ** than the limit
+func (aa *aaOptimizer) mayGlobstar(inputs, outputs func() []string) bool {
+	if aa.maxGlobstars <= 0 {
+		return true
+	}
+	existing := make(map[string]bool)
+	for _, p := range inputs() {
+		existing[p] = true
+	}
+	for _, p := range outputs() {
+		if !existing[p] && strings.Count(p, "**") > aa.maxGlobstars {
+			return false
+		}
+	}
+	return true
+}
+
+// removeGranted removes every rule of l that o has as well. Parents left
+// without children are removed too, otherwise they would become rules.
+func (l *leaf) removeGranted(o *leaf) {
+	for _, c := range l.children {
+		oc := o.children[c.part]
+		if oc == nil {
+			continue
+		}
+		if len(c.children) == 0 && len(oc.children) == 0 {
+			delete(l.children, c.part)
+			continue
+		}
+		if len(c.children) > 0 && len(oc.children) > 0 {
+			c.removeGranted(oc)
+			if len(c.children) == 0 {
+				delete(l.children, c.part)
+			}
+		}
+	}
+}
+
+// Combine things like:
+// /sys/devices/foo r,
+// /sys/devices/foo rw,
+func (aa *aaOptimizer) optimizeSubsetPerms() {
+	for b, l := range aa.trees {
+		for ob, o := range aa.trees {
+			// never across qualifiers, owner rules grant less than
+			// unqualified ones
+			if b.qualifiers != ob.qualifiers || b.target != ob.target || !permsStrictSubset(b.perms, ob.perms) {
+				continue
+			}
+			var before []string
+			if aa.onTransform != nil {
+				before = l.paths("")
+			}
+			l.removeGranted(o)
+			if aa.onTransform != nil {
+				if removed := removedPaths(before, l); len(removed) > 0 {
+					aa.transformed("subset-perms", false, b.rules(removed), ob.rules(removed))
+				}
+			}
+		}
+		if len(l.children) == 0 {
+			delete(aa.trees, b)
+		}
+	}
+}
+
+// removedPaths returns the paths that are no longer in the tree
+func removedPaths(before []string, l *leaf) []string {
+	after := make(map[string]bool)
+	if len(l.children) > 0 {
+		for _, p := range l.paths("") {
+			after[p] = true
+		}
+	}
+	var removed []string
+	for _, p := range before {
+		if !after[p] {
+			removed = append(removed, p)
+		}
+	}
+	return removed
 }
 
 func (aa *aaOptimizer) combineLeafs(dst, src *leaf) {
@@ -148,7 +515,7 @@ func (aa *aaOptimizer) combineLeafs(dst, src *leaf) {
 // Combine things like:
 // /sys/devices/*/xxx r,
 // /sys/devices/**/xxx r,
-func (aa *aaOptimizer) optimizeTreePass0(l *leaf) {
+func (aa *aaOptimizer) optimizeTreePass0(b bucket, ctx string, l *leaf) {
 	// /tmp/*   => Files directly in /tmp.
 	// /tmp/*/  => Directories directly in /tmp.
 	// /tmp/**  => Files and directories anywhere underneath /tmp.
@@ -165,29 +532,44 @@ func (aa *aaOptimizer) optimizeTreePass0(l *leaf) {
 	}
 
 	if swc != nil && dwc != nil {
+		var inputs []string
+		if aa.onTransform != nil {
+			inputs = b.rules(append(swc.paths(ctx+"/*"), dwc.paths(ctx+"/**")...))
+		}
 		if len(dwc.children) == 0 {
 			// combine /* and /*/ with /**, /** covers anything
 			// when they have identical perms and overrules that
 			delete(l.children, "*")
-		} else if len(dwc.children) > 0 && len(swc.children) > 0 {
+			if aa.onTransform != nil {
+				aa.transformed("pass0", false, inputs, b.rules(dwc.paths(ctx+"/**")))
+			}
+		} else if len(dwc.children) > 0 && len(swc.children) > 0 && aa.mayIntroduce(dwc.part) && aa.mayGeneralize(ctx) &&
+			aa.mayGlobstar(func() []string {
+				return append(swc.paths(ctx+"/*"), dwc.paths(ctx+"/**")...)
+			}, func() []string {
+				return append(swc.paths(ctx+"/**"), dwc.paths(ctx+"/**")...)
+			}) {
 			// combine /*/ with /**/
 			aa.combineLeafs(dwc, swc)
 			delete(l.children, "*")
+			if aa.onTransform != nil {
+				aa.transformed("pass0", true, inputs, b.rules(dwc.paths(ctx+"/**")))
+			}
 		}
 	}
 
 	for _, c := range l.children {
-		aa.optimizeTreePass0(c)
+		aa.optimizeTreePass0(b, ctx+"/"+c.part, c)
 	}
 }
 
 func (aa *aaOptimizer) optimizePass0() {
-	for _, l := range aa.trees {
-		aa.optimizeTreePass0(l)
-	}
+	aa.eachTree(func(b bucket, l *leaf) {
+		aa.optimizeTreePass0(b, "", l)
+	})
 }
 
-func (aa *aaOptimizer) optimizeTreePass1(l *leaf) bool {
+func (aa *aaOptimizer) optimizeTreePass1(b bucket, ctx string, l *leaf) bool {
 	if len(l.children) == 0 {
 		return true
 	}
@@ -196,8 +578,10 @@ func (aa *aaOptimizer) optimizeTreePass1(l *leaf) bool {
 	// must be identical
 	var parts []string
 	children := make(map[string]*leaf)
-	for _, c := range l.children {
-		if c.part != "" && aa.optimizeTreePass1(c) {
+	for _, c := range l.sortedChildren() {
+		// hot paths and no-merge rules are left as rules of their own,
+		// hot ones being cheaper to match than an alternation
+		if c.part != "" && aa.optimizeTreePass1(b, ctx+"/"+c.part, c) && !aa.keptApart(ctx+"/"+c.part) {
 			parts = append(parts, c.part)
 		} else {
 			children[c.part] = c
@@ -207,6 +591,12 @@ func (aa *aaOptimizer) optimizeTreePass1(l *leaf) bool {
 	if len(parts) < 2 {
 		return false
 	}
+	var inputs []string
+	if aa.onTransform != nil {
+		for _, pc := range parts {
+			inputs = append(inputs, ctx+"/"+pc)
+		}
+	}
 
 	// If one the children is a * or **. then ignore all else
 	for _, pc := range parts {
@@ -216,6 +606,10 @@ func (aa *aaOptimizer) optimizeTreePass1(l *leaf) bool {
 		}
 	}
 
+	if len(parts) > 1 && !aa.mayGeneralize(ctx) {
+		return false
+	}
+
 	// ok none of our children have children, consolidate
 	// them
 	var p string
@@ -224,8 +618,22 @@ func (aa *aaOptimizer) optimizeTreePass1(l *leaf) bool {
 	} else {
 		p = fmt.Sprintf("{%s}", strings.Join(parts, ","))
 	}
+	if !aa.mayGlobstar(func() []string {
+		var paths []string
+		for _, pc := range parts {
+			paths = append(paths, ctx+"/"+pc)
+		}
+		return paths
+	}, func() []string {
+		return []string{ctx + "/" + p}
+	}) {
+		return false
+	}
 	l.children = children
 	l.children[p] = newLeaf(p)
+	if aa.onTransform != nil {
+		aa.transformed("pass1", false, b.rules(inputs), b.rules([]string{ctx + "/" + p}))
+	}
 	return false
 }
 
@@ -233,9 +641,9 @@ func (aa *aaOptimizer) optimizeTreePass1(l *leaf) bool {
 // /sys/devices/**/uevent r,
 // /sys/devices/**/read_ahead_kb r,
 func (aa *aaOptimizer) optimizePass1() {
-	for _, l := range aa.trees {
-		aa.optimizeTreePass1(l)
-	}
+	aa.eachTree(func(b bucket, l *leaf) {
+		aa.optimizeTreePass1(b, "", l)
+	})
 }
 
 func (aa *aaOptimizer) identicalChildren(l, r *leaf) bool {
@@ -255,72 +663,258 @@ func (aa *aaOptimizer) identicalChildren(l, r *leaf) bool {
 }
 
 func (aa *aaOptimizer) containsUnbracketedComma(p string) bool {
-	var sawBracket bool
-	for _, r := range p {
-		if r == '{' {
-			sawBracket = true
-		} else if r == ',' && !sawBracket {
-			return true
+	return aare.HasUnbracedComma(p)
+}
+
+// bracePart puts the braces around parts merged by pass 2 that the fixup
+// has not gotten to yet
+func bracePart(p string) string {
+	if aare.HasUnbracedComma(p) && !strings.HasPrefix(p, "{") {
+		return "{" + p + "}"
+	}
+	return p
+}
+
+// factorGlobSuffix rewrites an alternation whose alternatives all end in
+// a *, like {eth*,wlan*}, into {eth,wlan}*. The alternation is returned
+// as it is unless the result is valid AARE matching the same paths.
+func factorGlobSuffix(p string) string {
+	if !strings.HasPrefix(p, "{") || aare.ClosingBrace(p, 0) != len(p)-1 {
+		return p
+	}
+	alts := aare.SplitAlternation(p[1 : len(p)-1])
+	var stems []string
+	for _, a := range alts {
+		stem := strings.TrimSuffix(a, "*")
+		if stem == a || stem == "" || strings.HasSuffix(stem, "*") || strings.HasSuffix(stem, `\`) || strings.ContainsAny(stem, "{}") {
+			return p
 		}
+		stems = append(stems, stem)
 	}
-	return false
+	factored := "{" + strings.Join(stems, ",") + "}*"
+	if checkPathToken(factored) != "" {
+		return p
+	}
+	before, ok := aare.Expand(p)
+	after, ok2 := aare.Expand(factored)
+	if !ok || !ok2 || strings.Join(before, ",") != strings.Join(after, ",") {
+		return p
+	}
+	return factored
 }
 
-func (aa *aaOptimizer) optimizeTreePass2(l *leaf) {
-	if len(l.children) > 1 {
-		for _, cl := range l.children {
-			for _, rl := range l.children {
-				if rl == cl {
+func (aa *aaOptimizer) optimizeTreePass2(b bucket, ctx string, l *leaf) {
+	if len(l.children) > 1 && aa.mayGeneralize(ctx) {
+		children := l.sortedChildren()
+		for i, cl := range children {
+			// skip children already merged into an earlier one
+			if l.children[cl.part] != cl || aa.keptApart(ctx+"/"+cl.part) {
+				continue
+			}
+			for _, rl := range children[i+1:] {
+				if l.children[rl.part] != rl || aa.keptApart(ctx+"/"+rl.part) {
 					continue
 				}
-				if aa.identicalChildren(cl, rl) {
-					p := fmt.Sprintf("%s,%s", strings.Trim(cl.part, "{}"), strings.Trim(rl.part, "{}"))
+				p := fmt.Sprintf("%s,%s", strings.Trim(cl.part, "{}"), strings.Trim(rl.part, "{}"))
+				if aa.identicalChildren(cl, rl) && aa.mayGlobstar(func() []string {
+					return append(cl.paths(ctx+"/"+bracePart(cl.part)), rl.paths(ctx+"/"+bracePart(rl.part))...)
+				}, func() []string {
+					return cl.paths(ctx + "/" + bracePart(p))
+				}) {
+					var inputs []string
+					if aa.onTransform != nil {
+						inputs = b.rules(append(cl.paths(ctx+"/"+bracePart(cl.part)), rl.paths(ctx+"/"+bracePart(rl.part))...))
+					}
 					delete(l.children, cl.part)
 					delete(l.children, rl.part)
 					cl.part = p
 					l.children[p] = cl
+					if aa.onTransform != nil {
+						aa.transformed("pass2", false, inputs, b.rules(cl.paths(ctx+"/"+bracePart(p))))
+					}
 				}
 			}
 		}
 	}
 
 	// fixup namings
-	for _, c := range l.children {
-		if aa.containsUnbracketedComma(c.part) {
-			if !strings.HasPrefix(c.part, "{") {
-				p := fmt.Sprintf("{%s}", c.part)
-				delete(l.children, c.part)
-				c.part = p
-				l.children[p] = c
-			}
+	for _, c := range l.sortedChildren() {
+		p := c.part
+		if aa.containsUnbracketedComma(p) && !strings.HasPrefix(p, "{") {
+			p = fmt.Sprintf("{%s}", p)
+		}
+		p = factorGlobSuffix(p)
+		if p != c.part {
+			delete(l.children, c.part)
+			c.part = p
+			l.children[p] = c
 		}
 	}
 
 	for _, c := range l.children {
-		aa.optimizeTreePass2(c)
+		aa.optimizeTreePass2(b, ctx+"/"+c.part, c)
 	}
 }
 
 func (aa *aaOptimizer) optimizePass2() {
-	for _, l := range aa.trees {
-		aa.optimizeTreePass2(l)
+	aa.eachTree(func(b bucket, l *leaf) {
+		aa.optimizeTreePass2(b, "", l)
+	})
+}
+
+func (aa *aaOptimizer) optimize() {
+	aa.thawArenas()
+	//fmt.Printf("original:\n")
+	//aa.dump()
+	if aa.mergeSubsetPerms && aa.startPass("subset perms pass") {
+		aa.optimizeSubsetPerms()
+	}
+	if aa.generalizeHome && aa.startPass("home pass") {
+		aa.optimizeHome()
+	}
+	if aa.foldPids && aa.startPass("pid pass") {
+		aa.optimizePids()
+	}
+	if (len(aa.folds) > 0 || len(aa.foldPatterns) > 0) && aa.startPass("fold pass") {
+		aa.optimizeFolds()
+	}
+	if aa.foldSingleChar > 0 && aa.startPass("single character pass") {
+		aa.optimizeSingleChars()
+	}
+	if aa.fsRoot != "" && aa.startPass("negated class pass") {
+		aa.optimizeNegated()
+	}
+	if aa.startPass("pass 0") {
+		aa.optimizePass0()
+	}
+	//aa.dump()
+	if aa.foldUdev && aa.startPass("udev pass") {
+		aa.optimizeUdev()
+	}
+
+	// must be last passes, they also merge the alternations split up when
+	// ingesting the rules, so they run even when resuming
+	aa.finalPasses = true
+	if aa.startPass("pass 1") {
+		aa.optimizePass1()
+	}
+	//aa.dump()
+	if aa.startPass("pass 2") {
+		aa.optimizePass2()
+	}
+	//aa.dump()
+	if aa.run != nil {
+		aa.run.finished(aa.passesDone)
 	}
 }
 
 func (aa *aaOptimizer) dump() {
 	for _, t := range aa.trees {
-		t.dump("")
+		for _, c := range t.children {
+			c.dump("")
+		}
 	}
 }
 
-func (aa *aaOptimizer) format() []string {
+// formatBucket formats the rules of the tree for the bucket
+func (aa *aaOptimizer) formatBucket(b bucket) []string {
 	var lines []string
-	for p, t := range aa.trees {
-		lines = append(lines, t.format("", p)...)
-	}
+	aa.walkBucket(b, func(l string) {
+		lines = append(lines, l)
+	})
 	return lines
 }
 
+// walkBucket calls fn with every rule of the tree for the bucket, in tree
+// order
+func (aa *aaOptimizer) walkBucket(b bucket, fn func(l string)) {
+	t := aa.trees[b]
+	if t == nil || len(t.children) == 0 {
+		return
+	}
+	// the passes may leave alternations unordered, the output is always
+	// canonical. Equal rules come out next to each other.
+	last := ""
+	walkLexical("", []*leaf{t}, func(p string) {
+		l := b.format(aare.Canonical(p))
+		if l != last {
+			last = l
+			fn(l)
+		}
+	})
+}
+
+// walkLexical calls fn with the paths below the nodes, which all stand
+// for the path ctx, in the lexical order of the paths as they are
+// written. Children whose parts are the same once their alternations are
+// canonical are walked together.
+func walkLexical(ctx string, nodes []*leaf, fn func(p string)) {
+	type entry struct {
+		// key sorts the entry, a / ends it for the paths below a node
+		key   string
+		path  string
+		nodes []*leaf
+	}
+	var entries []*entry
+	below := make(map[string]*entry)
+	for _, n := range nodes {
+		for _, c := range n.children {
+			p := ctx + "/" + aare.Canonical(c.part)
+			// like format, without the / in front of a variable
+			key := p
+			if strings.HasPrefix(key, "/@{") {
+				key = key[1:]
+			}
+			if len(c.children) == 0 {
+				entries = append(entries, &entry{key: key, path: p})
+				continue
+			}
+			e := below[p]
+			if e == nil {
+				e = &entry{key: key + "/", path: p}
+				below[p] = e
+				entries = append(entries, e)
+			}
+			e.nodes = append(e.nodes, c)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	for _, e := range entries {
+		if e.nodes == nil {
+			fn(e.path)
+			continue
+		}
+		walkLexical(e.path, e.nodes, fn)
+	}
+}
+
+func sortBuckets(buckets []bucket) {
+	sort.Slice(buckets, func(i, j int) bool {
+		// ungrouped rules come first
+		if buckets[i].group != buckets[j].group {
+			return buckets[i].group < buckets[j].group
+		}
+		if buckets[i].qualifiers != buckets[j].qualifiers {
+			return buckets[i].qualifiers < buckets[j].qualifiers
+		}
+		if buckets[i].perms != buckets[j].perms {
+			return buckets[i].perms < buckets[j].perms
+		}
+		return buckets[i].target < buckets[j].target
+	})
+}
+
+func (aa *aaOptimizer) buckets() []bucket {
+	var buckets []bucket
+	for b := range aa.trees {
+		buckets = append(buckets, b)
+	}
+	sortBuckets(buckets)
+	return buckets
+}
+
 func readLines(path string) ([]string, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -329,96 +923,937 @@ func readLines(path string) ([]string, error) {
 	defer file.Close()
 
 	var lines []string
-	scanner := bufio.NewScanner(file)
+	scanner := newScanner(file)
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
 	return lines, scanner.Err()
 }
 
-func writeLines(lines []string, path string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+// version is set at build time through -ldflags "-X main.version=..."
+var version = "devel"
 
-	w := bufio.NewWriter(file)
-	for _, line := range lines {
-		fmt.Fprintln(w, line)
-	}
-	return w.Flush()
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
 }
 
-func insert(a []string, index int, s string) []string {
-	if len(a) == index {
-		return append(a, s)
-	}
-	a = append(a[:index+1], a[index:]...)
-	a[index] = s
-	return a
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func usage() {
+	fmt.Println("usage: aaoptimizer [flags] [input...] [output]")
+	fmt.Println("       aaoptimizer [flags] --output-dir [directory] [input...]")
+	fmt.Println("       aaoptimizer lint [flags] [profile]")
+	fmt.Println("       aaoptimizer stats [flags] [profile]")
+	fmt.Println("       aaoptimizer undo [flags] [profile] [output]")
+	fmt.Println("       aaoptimizer cache [flags] prune")
+	fmt.Println("       aaoptimizer verify-corpus [flags] [directory]")
+	fmt.Println("       aaoptimizer rename [flags] [profile] [output]")
+	fmt.Println("       aaoptimizer simulate [flags] [profile] [other]")
+	fmt.Println("       aaoptimizer export-regex [flags] [profile]")
+	fmt.Println("       aaoptimizer why [flags] [profile] [path] [perms]")
+	fmt.Println("       aaoptimizer matches [flags] [profile] [line]")
+	fmt.Println("       aaoptimizer init [flags] [binary] [output]")
+	fmt.Println("       aaoptimizer import-strace [flags] [capture] [profile] [output]")
+	fmt.Println("       aaoptimizer record [flags] [profile] [output]")
+	fmt.Println("       aaoptimizer abstractions [flags] [profile] [output]")
+	fmt.Println("       aaoptimizer export [flags] [profile] [output]")
+	fmt.Println("       aaoptimizer diff [flags] [old] [new]")
+	fmt.Println("       aaoptimizer selftest [flags]")
+	fmt.Println("flags may also be set through AAOPT_ environment variables, like AAOPT_JOBS for --jobs or")
+	fmt.Println("AAOPT_LINT_FORMAT for lint --format, or in the AAOPT_CONFIG file, ~/.config/aaoptimizer/config by")
+	fmt.Println("default, the command line taking precedence over the environment and the environment over the file")
+	flag.PrintDefaults()
 }
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("usage: aaoptimizer [input] [output]")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "lint":
+			lintMain(os.Args[2:])
+			return
+		case "stats":
+			statsMain(os.Args[2:])
+			return
+		case "undo":
+			undoMain(os.Args[2:])
+			return
+		case "cache":
+			cacheMain(os.Args[2:])
+			return
+		case "verify-corpus":
+			verifyCorpusMain(os.Args[2:])
+			return
+		case "rename":
+			renameMain(os.Args[2:])
+			return
+		case "simulate":
+			simulateMain(os.Args[2:])
+			return
+		case "export-regex":
+			exportRegexMain(os.Args[2:])
+			return
+		case "why":
+			whyMain(os.Args[2:])
+			return
+		case "matches":
+			matchesMain(os.Args[2:])
+			return
+		case "init":
+			initMain(os.Args[2:])
+			return
+		case "import-strace":
+			importStraceMain(os.Args[2:])
+			return
+		case "record":
+			recordMain(os.Args[2:])
+			return
+		case "abstractions":
+			abstractionsMain(os.Args[2:])
+			return
+		case "export":
+			exportMain(os.Args[2:])
+			return
+		case "diff":
+			diffMain(os.Args[2:])
+			return
+		case "selftest":
+			selftestMain(os.Args[2:])
+			return
+		}
+	}
+
+	var paths stringList
+	flag.Var(&paths, "path", "path prefix to optimize, may be given multiple times, rules below nested prefixes go with the deepest one (default /sys/devices)")
+	auto := flag.Bool("auto", false, "detect path prefixes shared by many rules and optimize each of them")
+	autoMin := flag.Int("auto-min", 10, "minimum number of rules a prefix must exceed to be picked by --auto")
+	writeUndo := flag.Bool("sidecar", false, "write a [output].aaopt.json sidecar that allows undoing the optimization")
+	align := flag.String("align", "none", "align the permission column of the generated rules, or of every rule in the file (none|block|file)")
+	sortBy := flag.String("sort", "lexical", "order of the generated rules ("+strings.Join(sortStrategies, "|")+")")
+	groupByPerms := flag.Bool("group-by-perms", false, "group the generated rules per permission set, each with a section comment")
+	groupComment := flag.String("group-comment", defaultGroupComment, "template of the section comment, may use {{.Qualifiers}}, {{.Perms}}, {{.Target}}, {{.Description}}, {{.Area}}, {{.Prefix}} and {{.Count}}")
+	header := flag.String("header", defaultHeader, "template of the comment starting each generated block, may use {{.Version}}, {{.Date}}, {{.Prefix}}, {{.Profile}} and {{.Count}}")
+	footer := flag.String("footer", "", "template of the comment ending each generated block, allows replacing the block on later runs")
+	var forbidden stringList
+	var excludePatterns stringList
+	flag.Var(&excludePatterns, "exclude-pattern", "rules to leave as they are, a glob over the rule text where * matches anything, or a regular expression prefixed by re:, may be given multiple times")
+	flag.Var(&forbidden, "forbid-pattern", "pattern the optimizer must never introduce into rules that did not have it, i.e '**', may be given multiple times")
+	onlyPerms := flag.String("only-perms", "", "comma separated permission sets of the rules to optimize, i.e r,rk, other rules are left as they are")
+	mergeSubsetPerms := flag.Bool("merge-subset-perms", false, "drop rules whose permissions are a strict subset of another rule for the same path")
+	bareRules := flag.String("bare-rules", "pass", "what to do with rules without permissions, fail the run, pass them through with a warning or assume --bare-perms (error|pass|assume)")
+	barePerms := flag.String("bare-perms", "r", "permissions assumed for rules without permissions with --bare-rules assume")
+	minDepth := flag.Int("min-depth", 0, "never put wildcards or alternations in the path components before this one, i.e 3 keeps /sys/devices/ from becoming /sys/*/, 0 means no limit")
+	var folds stringList
+	flag.Var(&folds, "fold", "fold the siblings matching this pattern, like usb[0-9]*, onto it below every path, widening the rules, may be given multiple times")
+	foldSingleChar := flag.Int("fold-single-char", 0, "fold this many or more siblings that differ in a single character, like sda, sdb and sdc, onto sd?, widening the rules, 0 disables folding")
+	negatedClasses := flag.Bool("negated-classes", false, "fold the entries of a directory the rules enumerate almost all of onto a negated class like [^.]* excluding the others, widening the rules")
+	fsRoot := flag.String("fs-root", "/", "directory the paths of the profile are relative to when looking at the entries of directories")
+	maxGlobstars := flag.Int("max-globstars", 0, "never generate rules with more ** than this, enumerating the paths instead, 0 means no limit")
+	maxLineLength := flag.Int("max-line-length", 0, "split generated rules longer than this into several rules, 0 means no limit")
+	maxExpansion := flag.Int("max-expansion", 0, "split generated rules whose alternations expand into more patterns than this, failing if they cannot be split, 0 means no limit")
+	maxGrowth := flag.String("max-growth", "", "leave the profile untouched if the optimized one has more rules or bytes than this percentage above the original, i.e 0%")
+	minReduction := flag.String("min-reduction", "", "leave the profile untouched unless the optimized one has at least this percentage fewer rules or bytes, i.e 20%")
+	fragment := flag.String("fragment", "auto", "whether the input is a bare list of rules rather than a complete profile, detected if auto (auto|yes|no)")
+	strict := flag.Bool("strict", false, "fail without writing the output if a rule below the prefixes cannot be parsed as it is, instead of passing it through or fixing it up")
+	lossless := flag.Bool("lossless", false, "verify the rules generated for each region grant exactly what the original rules did, leaving the region untouched otherwise")
+	followIncludes := flag.Bool("follow-includes", false, "follow the includes of the profile, failing on include cycles and missing files")
+	includeBase := flag.String("include-base", defaultIncludeBase, "directory <...> includes are relative to")
+	includeGraphFile := flag.String("include-graph", "", "with --follow-includes, export the include graph to this file, as DOT if it ends in .dot, otherwise as JSON")
+	dropRedundantRules := flag.String("drop-redundant", "", "with --follow-includes, remove the rules a file the profile includes already grants, or comment them out (remove|comment)")
+	writeBack := flag.Bool("write-back", false, "with --follow-includes, also optimize the included files in the directory of the profile and write them back in place, for the prefixes only they have rules for")
+	useTunables := flag.Bool("use-tunables", false, "rewrite generated path prefixes matching a tunable, i.e /proc to @{PROC}")
+	generalizeHome := flag.Bool("generalize-home", false, "fold the home directories of specific users onto /home/*, or @{HOME} with --use-tunables, widening the rules")
+	foldPids := flag.Bool("fold-pids", false, "fold the process ids below /proc onto [0-9]*, or @{pid} with --use-tunables, widening the rules")
+	foldUdev := flag.Bool("fold-udev", false, "fold the minors of the device data below /run/udev/data onto [0-9]*, like c236:0 and c236:1 onto c236:[0-9]*, widening the rules")
+	noCache := flag.Bool("no-cache", false, "do not use the cache of earlier results")
+	cacheDir := flag.String("cache-dir", defaultCacheDir(), "directory earlier results are cached in")
+	incremental := flag.Bool("incremental", false, "only optimize the rules that changed since an earlier run, reusing cached results for the rest")
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile to this file")
+	memProfile := flag.String("memprofile", "", "write a memory profile to this file when done")
+	traceFile := flag.String("trace", "", "write an execution trace to this file")
+	txLogFile := flag.String("tx-log", "", "write one JSON line per transformation made by the optimizer to this file")
+	changeSetFile := flag.String("change-set", "", "write one JSON line per optimized profile with the rules removed and added, the widening transformations and the changes of each pass to this file")
+	sarifFile := flag.String("sarif", "", "report the transformations widening access as SARIF to this file")
+	overlayFile := flag.String("overlay", "", "file with local rules merged into the profile before optimizing, tagged with a comment naming the file")
+	accessFrequency := flag.String("access-frequency", "", "file with the hit count of paths from the access logs, one path and count per line, keeping the rules of hot paths simple")
+	hotHits := flag.Int("hot-hits", 100, "fewest hits in the --access-frequency file that make a path hot")
+	splitThreshold := flag.Int("split-threshold", 0, "move the generated rules of profiles with more rules than this into include files below [output].d, named after what they cover, 0 disables splitting")
+	valuesFile := flag.String("values", "", "file with the values of the %VAR% template variables of the input, may define several instances each written to its own output")
+	keepOriginal := flag.String("keep-original", "", "keep the optimized-away rules, either as comments below the generated block or in a sidecar .orig file (comments|file)")
+	checkLoadedPolicy := flag.Bool("check-loaded", false, "report whether the profiles of the input are loaded in the kernel, and in which mode")
+	diffLoaded := flag.Bool("diff-loaded", false, "compile the input and leave it untouched unless it matches the policy loaded in the kernel, implies --check-loaded")
+	apparmorFs := flag.String("apparmorfs", defaultApparmorFs, "directory the kernel exposes the loaded policy in")
+	outputDir := flag.String("output-dir", "", "optimize every input on its own, writing it below this directory at its path relative to the working directory, directories are optimized file by file")
+	backups := flag.Int("backup", 0, "keep this many earlier versions of the output, as .[output].aaopt-bak.1 being the most recent")
+	reloadCmd := flag.String("reload-cmd", "", "command run through sh once the output is written, %f is replaced by the output, i.e 'apparmor_parser -r %f'")
+	reloadOnChangeOnly := flag.Bool("reload-on-change-only", false, "only run --reload-cmd if the output changed")
+	parallel := flag.Int("jobs", 1, "number of permission trees optimized at the same time")
+	showVersion := flag.Bool("version", false, "print the version, the syntax features and the passes supported as JSON and exit")
+	completion := flag.String("completion", "", "print the completion script for the shell and exit (bash|zsh|fish)")
+	timeout := flag.Duration("timeout", 0, "stop starting passes once this much time passed, like 30s, keeping the passes completed and leaving the regions not started yet in place, 0 means no limit")
+	compactTrees := flag.Bool("compact-trees", false, "ingest the rules into compact trees taking far fewer allocations, for very large inputs, the passes still run on the regular trees")
+	progressFormat := flag.String("progress", "none", "report the progress of long runs to stderr ("+strings.Join(progressFormats, "|")+")")
+	stamp := flag.Bool("stamp", false, "record a hash of the output and the options in it, and leave inputs carrying a matching one untouched without optimizing them")
+	resume := flag.Bool("resume", false, "continue an interrupted run from the [output].partial result it left behind, if there is one")
+	stream := flag.Bool("stream", false, "read the input line by line, keeping only the lines that are not optimized in memory, for very large generated profiles")
+	scanBuffer := flag.Int("scan-buffer", bufio.MaxScanTokenSize, "longest line in bytes the input may have")
+	flag.Usage = usage
+	parseFlags(flag.CommandLine, os.Args[1:])
+
+	if *showVersion {
+		if err := printVersion(); err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *completion != "" {
+		if err := writeCompletion(os.Stdout, *completion); err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+	if len(os.Args) == 1 {
+		usage()
+		os.Exit(-1)
+	}
+	if reason := checkPositional(flag.Args(), *outputDir); reason != "" {
+		fmt.Printf("aaoptimizer: %s\n", reason)
+		fmt.Println("run 'aaoptimizer --help' for the usage")
+		os.Exit(-1)
+	}
+
+	if *keepOriginal != "" && *keepOriginal != "comments" && *keepOriginal != "file" {
+		fmt.Printf("aaoptimizer: invalid --keep-original %q, must be comments or file\n", *keepOriginal)
 		os.Exit(-1)
 	}
 
-	input := os.Args[1]
-	output := os.Args[2]
+	if *align != "none" && *align != "block" && *align != "file" {
+		fmt.Printf("aaoptimizer: invalid --align %q, must be none, block or file\n", *align)
+		os.Exit(-1)
+	}
 
-	lines, err := readLines(input)
+	if !validSortStrategy(*sortBy) {
+		fmt.Printf("aaoptimizer: invalid --sort %q, must be one of %s\n", *sortBy, strings.Join(sortStrategies, ", "))
+		os.Exit(-1)
+	}
+
+	if *bareRules != "error" && *bareRules != "pass" && *bareRules != "assume" {
+		fmt.Printf("aaoptimizer: invalid --bare-rules %q, must be error, pass or assume\n", *bareRules)
+		os.Exit(-1)
+	}
+
+	maxGrowthPercent, err := parsePercent(*maxGrowth)
 	if err != nil {
-		fmt.Printf("aaoptimizer: %v", err)
-		return
+		fmt.Printf("aaoptimizer: invalid --max-growth: %v\n", err)
+		os.Exit(-1)
+	}
+	minReductionPercent, err := parsePercent(*minReduction)
+	if err != nil {
+		fmt.Printf("aaoptimizer: invalid --min-reduction: %v\n", err)
+		os.Exit(-1)
 	}
 
-	aa := newAaOptimizer()
-	pathsToOptimize := []string{"/sys/devices"}
+	if *fragment != "auto" && *fragment != "yes" && *fragment != "no" {
+		fmt.Printf("aaoptimizer: invalid --fragment %q, must be auto, yes or no\n", *fragment)
+		os.Exit(-1)
+	}
 
-	// simple stupid replacement from the last encounter
-	insertAt := -1
-	var filteredLines []string
-	for i, l := range lines {
-		tl := strings.Trim(l, " ")
-		if !strings.HasPrefix(tl, pathsToOptimize[0]) {
-			filteredLines = append(filteredLines, l)
-			continue
+	if *lossless && *useTunables {
+		fmt.Println("aaoptimizer: --use-tunables may widen rules and cannot be combined with --lossless")
+		os.Exit(-1)
+	}
+	var exclude []*regexp.Regexp
+	for _, p := range excludePatterns {
+		re, err := parseExcludePattern(p)
+		if err != nil {
+			fmt.Printf("aaoptimizer: invalid --exclude-pattern %q: %v\n", p, err)
+			os.Exit(-1)
 		}
-		if insertAt == -1 {
-			insertAt = i
+		exclude = append(exclude, re)
+	}
+
+	var onlyPermSets map[string]bool
+	if *onlyPerms != "" {
+		onlyPermSets = make(map[string]bool)
+		for _, p := range strings.Split(*onlyPerms, ",") {
+			p = strings.TrimSpace(p)
+			if err := validatePerms(p); err != nil || p == "" {
+				fmt.Printf("aaoptimizer: invalid --only-perms %q\n", p)
+				os.Exit(-1)
+			}
+			onlyPermSets[canonicalPerms(p)] = true
 		}
-		aa.addRule(tl)
 	}
 
-	//fmt.Printf("original:\n")
-	//aa.dump()
-	fmt.Println("executing pass 0")
-	aa.optimizePass0()
-	//aa.dump()
+	for _, f := range folds {
+		if reason := checkFoldPattern(f); reason != "" {
+			fmt.Printf("aaoptimizer: invalid --fold %q: %s\n", f, reason)
+			os.Exit(-1)
+		}
+	}
+	if *lossless && len(folds) > 0 {
+		fmt.Println("aaoptimizer: --fold widens rules and cannot be combined with --lossless")
+		os.Exit(-1)
+	}
+	if *lossless && *foldSingleChar > 0 {
+		fmt.Println("aaoptimizer: --fold-single-char widens rules and cannot be combined with --lossless")
+		os.Exit(-1)
+	}
+	if *lossless && *negatedClasses {
+		fmt.Println("aaoptimizer: --negated-classes widens rules and cannot be combined with --lossless")
+		os.Exit(-1)
+	}
+	if *splitThreshold < 0 {
+		fmt.Println("aaoptimizer: --split-threshold cannot be negative")
+		os.Exit(-1)
+	}
+	// undo only restores the generated blocks, it cannot bring back the
+	// lines realigned around them or the blocks moved to include files
+	if *writeUndo && (*align == "file" || *splitThreshold > 0) {
+		fmt.Println("aaoptimizer: --sidecar cannot be combined with --align file or --split-threshold")
+		os.Exit(-1)
+	}
+	if *hotHits < 1 {
+		fmt.Println("aaoptimizer: --hot-hits must be at least 1")
+		os.Exit(-1)
+	}
+	if *foldSingleChar == 1 {
+		fmt.Println("aaoptimizer: --fold-single-char must be at least 2")
+		os.Exit(-1)
+	}
 
-	// must be last passes
-	fmt.Println("executing pass 1")
-	aa.optimizePass1()
-	//aa.dump()
-	fmt.Println("executing pass 2")
-	aa.optimizePass2()
-	//aa.dump()
+	if *lossless && *generalizeHome {
+		fmt.Println("aaoptimizer: --generalize-home widens rules and cannot be combined with --lossless")
+		os.Exit(-1)
+	}
+	if *lossless && *foldPids {
+		fmt.Println("aaoptimizer: --fold-pids widens rules and cannot be combined with --lossless")
+		os.Exit(-1)
+	}
+	if *lossless && *foldUdev {
+		fmt.Println("aaoptimizer: --fold-udev widens rules and cannot be combined with --lossless")
+		os.Exit(-1)
+	}
 
-	// insert a small header
-	insert(filteredLines, insertAt, "\n  # generated by aa-optimizer app")
-	insertAt++
+	// the stamp only covers the input and the options, not the files
+	// these read
+	if *stamp && (*overlayFile != "" || *valuesFile != "" || *accessFrequency != "" || *followIncludes || *stream) {
+		fmt.Println("aaoptimizer: --stamp cannot be combined with --overlay, --values, --access-frequency, --follow-includes or --stream")
+		os.Exit(-1)
+	}
 
-	// insert into filteredLines
-	rls := aa.format()
-	for _, r := range rls {
-		filteredLines = insert(filteredLines, insertAt, r)
-		insertAt++
+	if *reloadOnChangeOnly && *reloadCmd == "" {
+		fmt.Println("aaoptimizer: --reload-on-change-only requires --reload-cmd")
+		os.Exit(-1)
+	}
+	// write replaces the output, returning whether it changed
+	write := func(lines []string, output string) (bool, error) {
+		changed := !unchanged(output, lines)
+		if changed && *backups > 0 {
+			if err := rotateBackups(output, *backups); err != nil {
+				return false, fmt.Errorf("cannot back up %s: %v", output, err)
+			}
+		}
+		return changed, writeLines(lines, output)
+	}
+	reload := func(output string, changed bool) {
+		if *reloadCmd == "" || (*reloadOnChangeOnly && !changed) {
+			return
+		}
+		if err := runReload(*reloadCmd, output); err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *scanBuffer <= 0 {
+		fmt.Println("aaoptimizer: --scan-buffer must be positive")
+		os.Exit(-1)
+	}
+	scanBufferSize = *scanBuffer
+
+	validProgress := false
+	for _, f := range progressFormats {
+		validProgress = validProgress || f == *progressFormat
+	}
+	if !validProgress {
+		fmt.Printf("aaoptimizer: invalid --progress %q, must be one of %s\n", *progressFormat, strings.Join(progressFormats, ", "))
+		os.Exit(-1)
+	}
+	prog := newProgress(*progressFormat)
+
+	if *parallel < 1 {
+		fmt.Println("aaoptimizer: --jobs must be at least 1")
+		os.Exit(-1)
 	}
 
-	err = writeLines(filteredLines, output)
+	if *stream {
+		// these need every line of the input at hand
+		unsupported := map[string]bool{
+			"auto": true, "sidecar": true, "footer": true, "bare-rules": true, "max-expansion": true, "max-growth": true,
+			"min-reduction": true, "lossless": true, "follow-includes": true, "drop-redundant": true, "split-threshold": true, "use-tunables": true,
+			"incremental": true, "overlay": true, "values": true, "keep-original": true,
+			"check-loaded": true, "diff-loaded": true, "resume": true, "change-set": true,
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if unsupported[f.Name] {
+				fmt.Printf("aaoptimizer: --%s cannot be combined with --stream\n", f.Name)
+				os.Exit(-1)
+			}
+		})
+		if *align == "file" || *sortBy == "original-first-seen" {
+			fmt.Println("aaoptimizer: --align file and --sort original-first-seen cannot be combined with --stream")
+			os.Exit(-1)
+		}
+	}
+
+	if *writeBack && !*followIncludes {
+		fmt.Println("aaoptimizer: --write-back requires --follow-includes")
+		os.Exit(-1)
+	}
+	if *dropRedundantRules != "" && *dropRedundantRules != "remove" && *dropRedundantRules != "comment" {
+		fmt.Printf("aaoptimizer: invalid --drop-redundant %q, must be remove or comment\n", *dropRedundantRules)
+		os.Exit(-1)
+	}
+	if *dropRedundantRules != "" && !*followIncludes {
+		fmt.Println("aaoptimizer: --drop-redundant requires --follow-includes")
+		os.Exit(-1)
+	}
+
+	stopProfiling, err := startProfiling(*cpuProfile, *memProfile, *traceFile)
 	if err != nil {
-		fmt.Printf("aaoptimizer: %v", err)
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	defer stopProfiling()
+	// os.Exit skips the deferred call, the exits from here on stop the
+	// profilers first so their files are complete
+	exit := func(code int) {
+		stopProfiling()
+		os.Exit(code)
+	}
+
+	// every argument but the last is an input, several inputs are
+	// composed into one profile, unless each is written below the
+	// output directory
+	jobs := []batchJob{{inputs: flag.Args()[:flag.NArg()-1], output: flag.Arg(flag.NArg() - 1)}}
+	if *outputDir != "" {
+		jobs, err = batchJobs(flag.Args(), *outputDir)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			exit(-1)
+		}
+	}
+
+	// interrupted runs finish the current pass and leave a partial result
+	// behind, streamed ones have no result until done
+	run := newRunState()
+	if *timeout > 0 {
+		run.deadline = time.Now().Add(*timeout)
+	}
+	if !*stream {
+		run.handleInterrupts(exit)
+	}
+	runOptions := cacheOptions(flag.CommandLine, "no-cache", "cache-dir", "jobs", "compact-trees", "progress", "resume", "timeout")
+
+	var txl *txLog
+	if *txLogFile != "" {
+		txl, err = createTxLog(*txLogFile)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			exit(-1)
+		}
+	}
+	var csl *txLog
+	if *changeSetFile != "" {
+		csl, err = createTxLog(*changeSetFile)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			exit(-1)
+		}
+	}
+	var widenings []finding
+	// failed is set when an input could not be optimized, the others
+	// still are
+	failed := false
+	for _, job := range jobs {
+		inputs, output := job.inputs, job.output
+		input := strings.Join(inputs, ",")
+		if *outputDir != "" {
+			fmt.Printf("optimizing %s\n", input)
+			if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				exit(1)
+			}
+		}
+
+		if *stream {
+			if len(inputs) > 1 {
+				fmt.Println("aaoptimizer: --stream optimizes a single input")
+				exit(-1)
+			}
+			pathsToOptimize := []string(paths)
+			if len(pathsToOptimize) == 0 {
+				pathsToOptimize = []string{"/sys/devices"}
+			}
+			opts := defaultOptions(input, &prefixSet{paths: pathsToOptimize, variables: loadTunables(inputs)})
+			opts.align = *align
+			opts.sort = *sortBy
+			opts.forbidden = forbidden
+			opts.exclude = exclude
+			opts.onlyPerms = onlyPermSets
+			opts.mergeSubsetPerms = *mergeSubsetPerms
+			opts.generalizeHome = *generalizeHome
+			opts.foldPids = *foldPids
+			opts.foldUdev = *foldUdev
+			opts.minDepth = *minDepth
+			opts.maxGlobstars = *maxGlobstars
+			opts.foldSingleChar = *foldSingleChar
+			opts.folds = folds
+			opts.maxLineLength = *maxLineLength
+			opts.jobs = *parallel
+			opts.compactTrees = *compactTrees
+			opts.progress = prog
+			opts.run = run
+			opts.strict = *strict
+			opts.fragment = *fragment == "yes"
+			if *accessFrequency != "" {
+				hits, err := loadAccessFrequency(*accessFrequency)
+				if err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					exit(-1)
+				}
+				opts.hot = hotNodes(hits, *hotHits)
+			}
+			if *negatedClasses {
+				opts.fsRoot = *fsRoot
+			}
+			opts.markers, err = newBlockMarkers(*header, "")
+			if err != nil {
+				fmt.Printf("aaoptimizer: invalid --header: %v\n", err)
+				exit(-1)
+			}
+			if *groupByPerms {
+				opts.groupTemplate, err = parseGroupTemplate(*groupComment)
+				if err != nil {
+					fmt.Printf("aaoptimizer: invalid --group-comment: %v\n", err)
+					exit(-1)
+				}
+			}
+			if txl != nil || *sarifFile != "" {
+				opts.transformed = func(tx transformation) {
+					if txl != nil {
+						txl.write(tx)
+					}
+					if tx.Widening {
+						widenings = append(widenings, wideningFinding(tx))
+					}
+				}
+			}
+			if *backups > 0 {
+				if err := rotateBackups(output, *backups); err != nil {
+					fmt.Printf("aaoptimizer: cannot back up %s: %v\n", output, err)
+					exit(1)
+				}
+			}
+			if err := streamOptimize(input, output, opts); err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				exit(1)
+			}
+			reload(output, true)
+			continue
+		}
+
+		composed, err := composeInputs(inputs)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			failed = true
+			continue
+		}
+
+		if *checkLoadedPolicy || *diffLoaded {
+			for _, in := range inputs {
+				lines, err := readLines(in)
+				if err == nil {
+					err = checkLoaded(lines, in, *apparmorFs, *diffLoaded)
+				}
+				if err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					exit(1)
+				}
+			}
+		}
+
+		tunableFiles := append([]string(nil), inputs...)
+		var includedFiles []string
+		if *followIncludes {
+			graph := &includeGraph{Root: input}
+			seen := make(map[string]bool)
+			for _, in := range inputs {
+				seen[in] = true
+			}
+			graph.Files = append(graph.Files, inputs...)
+			for _, in := range inputs {
+				g, err := buildIncludeGraph(in, *includeBase)
+				if err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					exit(1)
+				}
+				for _, f := range g.Files {
+					if !seen[f] {
+						seen[f] = true
+						graph.Files = append(graph.Files, f)
+						includedFiles = append(includedFiles, f)
+					}
+				}
+				graph.Edges = append(graph.Edges, g.Edges...)
+			}
+			if *includeGraphFile != "" {
+				if err := writeIncludeGraph(graph, *includeGraphFile); err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					exit(1)
+				}
+			}
+			tunableFiles = graph.Files
+		}
+
+		instances := []instance{{}}
+		keyFiles := tunableFiles
+		if *valuesFile != "" {
+			instances, err = loadInstances(*valuesFile)
+			if err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				exit(-1)
+			}
+			if len(instances) > 1 && !templateVariable.MatchString(output) {
+				fmt.Println("aaoptimizer: the output must use a variable like %NAME% with several instances")
+				exit(-1)
+			}
+			keyFiles = append(append([]string(nil), keyFiles...), *valuesFile)
+		}
+		var overlay []string
+		if *overlayFile != "" {
+			overlay, err = readLines(*overlayFile)
+			if err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				exit(-1)
+			}
+			keyFiles = append(append([]string(nil), keyFiles...), *overlayFile)
+		}
+		var hot map[string]bool
+		if *accessFrequency != "" {
+			hits, err := loadAccessFrequency(*accessFrequency)
+			if err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				exit(-1)
+			}
+			hot = hotNodes(hits, *hotHits)
+			keyFiles = append(append([]string(nil), keyFiles...), *accessFrequency)
+		}
+
+		for i, inst := range instances {
+			lines, err := inst.applyLines(composed)
+			if err != nil {
+				fmt.Printf("aaoptimizer: %s: %v\n", input, err)
+				exit(1)
+			}
+			output, err := inst.apply(output)
+			if err != nil {
+				fmt.Printf("aaoptimizer: output: %v\n", err)
+				exit(1)
+			}
+			if inst.name != "" {
+				fmt.Printf("instance %s\n", inst.name)
+			}
+			if *stamp && stamped(lines, runOptions) {
+				fmt.Println("input carries a matching stamp, leaving it untouched")
+				changed, err := write(lines, output)
+				if err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					failed = true
+					continue
+				}
+				reload(output, changed)
+				continue
+			}
+
+			pathsToOptimize := []string(paths)
+			if *auto {
+				for _, c := range detectPrefixes(lines, *autoMin) {
+					fmt.Printf("auto-detected prefix %s (%d rules)\n", c.prefix, c.count)
+					pathsToOptimize = append(pathsToOptimize, c.prefix)
+				}
+			} else if len(pathsToOptimize) == 0 {
+				pathsToOptimize = []string{"/sys/devices"}
+			}
+			prefixes := &prefixSet{paths: pathsToOptimize, variables: loadTunables(tunableFiles)}
+			if overlay != nil {
+				local, err := inst.applyLines(overlay)
+				if err != nil {
+					fmt.Printf("aaoptimizer: %s: %v\n", *overlayFile, err)
+					exit(1)
+				}
+				lines = applyOverlay(lines, local, *overlayFile, prefixes)
+			}
+			if *dropRedundantRules != "" {
+				lines, err = dropRedundant(lines, inputs[0], *includeBase, *dropRedundantRules)
+				if err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					exit(1)
+				}
+			}
+
+			opts := &options{
+				file:         input,
+				prefixes:     prefixes,
+				keepOriginal: *keepOriginal,
+				align:        *align,
+				sort:         *sortBy,
+				forbidden:    forbidden,
+				exclude:      exclude,
+				onlyPerms:    onlyPermSets,
+
+				mergeSubsetPerms: *mergeSubsetPerms,
+				generalizeHome:   *generalizeHome,
+				foldPids:         *foldPids,
+				foldUdev:         *foldUdev,
+				bareRules:        *bareRules,
+				barePerms:        canonicalPerms(*barePerms),
+				minDepth:         *minDepth,
+				maxGlobstars:     *maxGlobstars,
+				foldSingleChar:   *foldSingleChar,
+				folds:            folds,
+				jobs:             *parallel,
+				compactTrees:     *compactTrees,
+				progress:         prog,
+				run:              run,
+				hot:              hot,
+				splitThreshold:   *splitThreshold,
+				maxLineLength:    *maxLineLength,
+				maxExpansion:     *maxExpansion,
+				lossless:         *lossless,
+				strict:           *strict,
+				maxGrowth:        maxGrowthPercent,
+				minReduction:     minReductionPercent,
+				fragment:         *fragment == "yes" || (*fragment == "auto" && isFragment(lines)),
+			}
+			// the negated class pass reads the directories below
+			// --fs-root, which no cache key covers
+			if *incremental && !*noCache && *cacheDir != "" && !*negatedClasses {
+				opts.treeCache = filepath.Join(*cacheDir, "trees")
+			}
+			if *negatedClasses {
+				opts.fsRoot = *fsRoot
+			}
+			if *useTunables {
+				opts.tunables = tunablePrefixes(loadTunables(tunableFiles))
+			}
+			opts.markers, err = newBlockMarkers(*header, *footer)
+			if err != nil {
+				fmt.Printf("aaoptimizer: invalid --header or --footer: %v\n", err)
+				exit(-1)
+			}
+			if *groupByPerms {
+				opts.groupTemplate, err = parseGroupTemplate(*groupComment)
+				if err != nil {
+					fmt.Printf("aaoptimizer: invalid --group-comment: %v\n", err)
+					exit(-1)
+				}
+			}
+			var cs *changeSet
+			if csl != nil {
+				cs = newChangeSet(output)
+			}
+			if txl != nil || *sarifFile != "" || cs != nil {
+				opts.transformed = func(tx transformation) {
+					if txl != nil {
+						txl.write(tx)
+					}
+					if tx.Widening {
+						widenings = append(widenings, wideningFinding(tx))
+					}
+					if cs != nil {
+						cs.transformed(tx)
+					}
+				}
+				// cached results do not hold the transformations
+				opts.treeCache = ""
+			}
+			// the cache only holds the output, not what is needed for the
+			// sidecar files or the transformations, nor the directories the
+			// negated class pass reads
+			useCache := !*noCache && *cacheDir != "" && !*writeUndo && opts.keepOriginal != "file" && opts.transformed == nil && !*writeBack && opts.splitThreshold == 0 && opts.fsRoot == ""
+			var key string
+			if useCache {
+				key, err = cacheKey(keyFiles, runOptions+"\x00instance="+inst.name)
+				if err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					exit(1)
+				}
+				if cached, ok := cacheLookup(*cacheDir, key); ok {
+					fmt.Println("input unchanged, using cached result")
+					changed, err := write(cached, output)
+					if err != nil {
+						fmt.Printf("aaoptimizer: %v\n", err)
+						failed = true
+						continue
+					}
+					reload(output, changed)
+					continue
+				}
+			}
+
+			ingest := lines
+			run.reset(0)
+			if *resume {
+				t, err := readResumeToken(resumeTokenPath(output))
+				if err == nil && t.Options != runOptions {
+					err = fmt.Errorf("%s was interrupted with different options", t.Partial)
+				}
+				if err == nil {
+					ingest, err = readLines(t.Partial)
+				}
+				if err != nil && !os.IsNotExist(err) {
+					fmt.Printf("aaoptimizer: cannot resume: %v\n", err)
+					exit(1)
+				}
+				if err == nil {
+					fmt.Printf("resuming from %s\n", t.Partial)
+					run.reset(t.Passes)
+				}
+			}
+
+			optimized, regions, err := optimizeLines(ingest, opts)
+			if err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				exit(1)
+			}
+			if run.interrupted.Load() {
+				t := &resumeToken{Input: input, Partial: partialPath(output), Passes: run.completed, Options: runOptions}
+				if t.Passes < 0 {
+					t.Passes = 0
+				}
+				err := writeLines(optimized, t.Partial)
+				if err == nil {
+					err = writeResumeToken(t, resumeTokenPath(output))
+				}
+				if err != nil {
+					fmt.Printf("aaoptimizer: cannot write partial result: %v\n", err)
+					exit(1)
+				}
+				fmt.Printf("aaoptimizer: wrote the partial result to %s, continue with --resume\n", t.Partial)
+				exit(1)
+			}
+			if *resume {
+				os.Remove(partialPath(output))
+				os.Remove(resumeTokenPath(output))
+			}
+			if reason := checkGates(lines, optimized, opts); reason != "" {
+				fmt.Printf("aaoptimizer: %s, leaving the profile untouched\n", reason)
+				optimized, regions = lines, nil
+				if cs != nil {
+					cs = newChangeSet(output)
+				}
+			}
+			if opts.splitThreshold > 0 {
+				var files []splitFile
+				optimized, files = splitOutput(lines, optimized, regions, output, opts)
+				if err := writeSplitFiles(files, output); err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					exit(1)
+				}
+			}
+			timedOut := run.timedOut.Load()
+			if timedOut {
+				fmt.Printf("aaoptimizer: %s: out of time, only partially optimized\n", input)
+			}
+			// the sidecar is made from the output without the stamp, which
+			// undo drops
+			unstamped := optimized
+			if *stamp && !timedOut {
+				optimized = stampLines(optimized, opts.markers, runOptions)
+			}
+			// the included files are shared by every instance
+			if *writeBack && i == 0 {
+				var flat []string
+				var sources []source
+				for _, in := range inputs {
+					l, s, err := flattenIncludes(in, *includeBase)
+					if err != nil {
+						fmt.Printf("aaoptimizer: %v\n", err)
+						exit(1)
+					}
+					flat = append(flat, l...)
+					sources = append(sources, s...)
+				}
+				for _, f := range includedFiles {
+					if err := writeBackInclude(f, filepath.Dir(input), flat, sources, *opts, *backups); err != nil {
+						fmt.Printf("aaoptimizer: %v\n", err)
+						exit(1)
+					}
+				}
+			}
+			if useCache && !timedOut {
+				if err := cacheStore(*cacheDir, key, optimized); err != nil {
+					fmt.Printf("aaoptimizer: cannot cache result: %v\n", err)
+				}
+			}
+			changed, err := write(optimized, output)
+			if err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				failed = true
+				continue
+			}
+
+			if *writeUndo {
+				err = writeSidecar(newSidecar(input, lines, unstamped, regions), sidecarPath(output))
+				if err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					failed = true
+					continue
+				}
+			}
+
+			if opts.keepOriginal == "file" {
+				err = writeLines(originalLines(lines, regions), output+".orig")
+				if err != nil {
+					fmt.Printf("aaoptimizer: %v\n", err)
+					failed = true
+				}
+			}
+			if cs != nil {
+				cs.addRegions(regions)
+				csl.write(cs)
+			}
+			reload(output, changed)
+		}
+	}
+
+	if txl != nil {
+		if err := txl.close(); err != nil {
+			fmt.Printf("aaoptimizer: cannot write transformation log: %v\n", err)
+			exit(1)
+		}
+	}
+	if csl != nil {
+		if err := csl.close(); err != nil {
+			fmt.Printf("aaoptimizer: cannot write change set: %v\n", err)
+			exit(1)
+		}
+	}
+	if *sarifFile != "" {
+		if err := writeSarifFile(*sarifFile, []lintCheck{wideningCheck}, widenings); err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			exit(1)
+		}
+	}
+	if failed {
+		exit(1)
 	}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// FuzzNewRule makes sure no rule, however malformed, makes the parser
+// panic, and that the rules it rejects are rejected with a parseError
+func FuzzNewRule(f *testing.F) {
+	for _, seed := range []string{
+		"/sys/devices/** r,",
+		"owner /sys/devices/{a,b}/c rw, # aaopt: group=usb",
+		"audit deny /proc/[0-9]*/stat r,",
+		"/usr/bin/foo Px -> bar,",
+		"file,",
+		"/a/{b,c/d} r,",
+		`/a/\{b r,`,
+		"/a/[/]b r,",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, rs string) {
+		r, err := newRule(rs)
+		if err != nil {
+			var pe *parseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("%q: unexpected error type %T: %v", rs, err, err)
+			}
+			return
+		}
+		if r.perms == "" {
+			t.Fatalf("%q: parsed without permissions", rs)
+		}
+		aa := newAaOptimizer()
+		aa.addRule(rs)
+		parseProfileRule(1, rs)
+	})
+}
+
+func TestOwnerRulesKeptApart(t *testing.T) {
+	lines := []string{
+		"profile test {",
+		"  owner /sys/devices/a/x r,",
+		"  owner /sys/devices/a/y r,",
+		"  /sys/devices/a/z r,",
+		"  /sys/devices/a/w r,",
+		"}",
+	}
+	opts := defaultOptions("test", &prefixSet{paths: []string{"/sys/devices"}})
+	optimized, _, err := optimizeLines(lines, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"owner /sys/devices/a/{x,y} r,": true,
+		"/sys/devices/a/{w,z} r,":       true,
+	}
+	for _, l := range optimized {
+		tl := strings.TrimSpace(l)
+		if _, err := newRule(tl); err == nil {
+			if !want[tl] {
+				t.Errorf("unexpected rule %q", tl)
+			}
+			delete(want, tl)
+		}
+	}
+	for r := range want {
+		t.Errorf("missing rule %q", r)
+	}
+
+	owner, _ := newRule("owner /sys/devices/a/x r,")
+	unqualified, _ := newRule("/sys/devices/a/x r,")
+	if owner.bucket() == unqualified.bucket() {
+		t.Errorf("owner and unqualified rules share the bucket %+v", owner.bucket())
+	}
+}
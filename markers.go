@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+)
+
+// Rules may carry a marker comment like # aaopt: no-merge, group=usb
+// controlling how the optimizer treats them:
+//
+//	keep      leaves the rule in place as it is
+//	no-merge  keeps the rule out of alternations and wildcards
+//	group=X   only merges the rule with others of the same group, which
+//	          are written together
+//	fold=P    folds the siblings of the deepest component of the rule
+//	          matching the pattern P, like [0-9]*, onto it
+//
+// The generated rules carry the markers of the rules they cover.
+const markerComment = "# aaopt:"
+
+type ruleMarkers struct {
+	keep    bool
+	noMerge bool
+	group   string
+	fold    string
+}
+
+// parseMarkers returns the markers of the rule on the line, unknown ones
+// are ignored
+func parseMarkers(l string) ruleMarkers {
+	var m ruleMarkers
+	i := strings.Index(l, markerComment)
+	if i < 0 {
+		return m
+	}
+	text := l[i+len(markerComment):]
+	// another trailing comment may follow, i.e # interfaces: x
+	if j := strings.Index(text, "#"); j >= 0 {
+		text = text[:j]
+	}
+	for _, item := range splitMarkers(text) {
+		name, value, _ := strings.Cut(item, "=")
+		switch name {
+		case "keep":
+			m.keep = true
+		case "no-merge":
+			m.noMerge = true
+		case "group":
+			m.group = value
+		case "fold":
+			m.fold = value
+		}
+	}
+	return m
+}
+
+// splitMarkers splits the markers on commas and blanks, but not those
+// within the brackets or braces of a fold pattern
+func splitMarkers(text string) []string {
+	var items []string
+	depth, start := 0, 0
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) {
+			switch text[i] {
+			case '[', '{':
+				depth++
+				continue
+			case ']', '}':
+				depth--
+				continue
+			case ',', ' ', '\t':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if i > start {
+			items = append(items, text[start:i])
+		}
+		start = i + 1
+	}
+	return items
+}
+
+// keptReason returns why the rule is left as it is if it is marked keep,
+// or ""
+func keptReason(tl string) string {
+	if parseMarkers(tl).keep {
+		return "marked " + markerComment + " keep"
+	}
+	return ""
+}
+
+// pinKept pins the selected rules marked keep, they are copied through as
+// they are
+func pinKept(lines []string, prefixes *prefixSet, pinned map[int]string) {
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		if _, ok := prefixes.selectPrefix(tl); !ok {
+			continue
+		}
+		if reason := keptReason(tl); reason != "" {
+			pinned[i] = reason
+		}
+	}
+}
+
+// markNode adds the path and every directory above it to the nodes
+func markNode(nodes map[string]bool, p string) {
+	p = strings.TrimSuffix(p, "/")
+	for p != "" && !nodes[p] {
+		nodes[p] = true
+		p = p[:strings.LastIndex(p, "/")]
+	}
+}
+
+// keptApart reports whether the node at the path is, or leads to, a hot
+// path or a rule marked no-merge, which the passes keep out of
+// alternations and wildcards
+func (aa *aaOptimizer) keptApart(path string) bool {
+	path = strings.TrimSuffix(path, "/")
+	return aa.hot[path] || aa.noMerge[path]
+}
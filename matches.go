@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// errWalkLimit ends a walk that reached one of its limits
+var errWalkLimit = errors.New("walk limit reached")
+
+// pathWalker looks for the existing paths matching a pattern below root,
+// giving up after visiting maxVisit entries or finding maxMatches
+type pathWalker struct {
+	root       string
+	maxVisit   int
+	maxMatches int
+
+	visited int
+	matches []string
+}
+
+func hasGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func (w *pathWalker) found(path string) error {
+	w.matches = append(w.matches, path)
+	if len(w.matches) >= w.maxMatches {
+		return errWalkLimit
+	}
+	return nil
+}
+
+// walk matches the remaining components of the pattern below dir, which
+// is the path on the system without the root
+func (w *pathWalker) walk(pattern, dir string, components []string) error {
+	if len(components) == 0 {
+		return w.found(dir)
+	}
+	c := components[0]
+	if c == "" {
+		// a trailing / only matches directories
+		if fi, err := os.Stat(filepath.Join(w.root, dir)); err == nil && fi.IsDir() {
+			return w.found(dir + "/")
+		}
+		return nil
+	}
+
+	if strings.Contains(c, "**") {
+		// match the rest of the pattern against everything below
+		return filepath.WalkDir(filepath.Join(w.root, dir), func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			w.visited++
+			if w.visited > w.maxVisit {
+				return errWalkLimit
+			}
+			rel := "/" + strings.TrimPrefix(strings.TrimPrefix(p, w.root), "/")
+			if d.IsDir() && aare.Match(pattern, rel+"/") {
+				return w.found(rel + "/")
+			}
+			if aare.Match(pattern, rel) {
+				return w.found(rel)
+			}
+			return nil
+		})
+	}
+
+	if !hasGlob(c) {
+		next := strings.TrimSuffix(dir, "/") + "/" + strings.ReplaceAll(c, `\`, "")
+		if _, err := os.Lstat(filepath.Join(w.root, next)); err != nil {
+			return nil
+		}
+		return w.walk(pattern, next, components[1:])
+	}
+
+	entries, err := os.ReadDir(filepath.Join(w.root, dir))
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		w.visited++
+		if w.visited > w.maxVisit {
+			return errWalkLimit
+		}
+		if !aare.Match(c, e.Name()) {
+			continue
+		}
+		if err := w.walk(pattern, strings.TrimSuffix(dir, "/")+"/"+e.Name(), components[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// existingMatches returns the existing paths the pattern matches below
+// root, and whether the walk had to stop early
+func existingMatches(pattern, root string, maxVisit, maxMatches int) ([]string, bool) {
+	w := &pathWalker{root: root, maxVisit: maxVisit, maxMatches: maxMatches}
+	patterns, ok := aare.Expand(pattern)
+	if !ok {
+		return nil, true
+	}
+	for _, p := range patterns {
+		components := aare.SplitPath(strings.TrimPrefix(p, "/"))
+		if err := w.walk(p, "", components); err != nil {
+			return w.matches, true
+		}
+	}
+	return w.matches, false
+}
+
+func matchesMain(args []string) {
+	fs := flag.NewFlagSet("matches", flag.ExitOnError)
+	root := fs.String("root", "/", "directory the paths of the profile are relative to")
+	maxVisit := fs.Int("max-visit", 100000, "stop after visiting this many directory entries")
+	maxMatches := fs.Int("max", 1000, "stop after finding this many matching paths")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer matches [flags] [profile] [line]")
+		fmt.Println("lists the existing paths on this system the rule on the line of the profile grants")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	line, err := strconv.Atoi(fs.Arg(1))
+	if err != nil {
+		fmt.Printf("aaoptimizer: invalid line %q\n", fs.Arg(1))
+		os.Exit(-1)
+	}
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	if line < 1 || line > len(lines) {
+		fmt.Printf("aaoptimizer: %s has no line %d\n", input, line)
+		os.Exit(-1)
+	}
+	r, ok := parseProfileRule(line, lines[line-1])
+	if !ok || !r.isFile() {
+		fmt.Printf("aaoptimizer: line %d of %s is not a file rule\n", line, input)
+		os.Exit(-1)
+	}
+
+	tunables := loadTunables([]string{input})
+	count := 0
+	truncated := false
+	for _, p := range resolveVariable(r.path, tunables, 0) {
+		for strings.Contains(p, "//") {
+			p = strings.ReplaceAll(p, "//", "/")
+		}
+		matches, stopped := existingMatches(p, *root, *maxVisit, *maxMatches-count)
+		for _, m := range matches {
+			fmt.Println(m)
+		}
+		count += len(matches)
+		if stopped || count >= *maxMatches {
+			truncated = true
+			break
+		}
+	}
+	fmt.Printf("%q matches %d existing paths", r.text, count)
+	if truncated {
+		fmt.Print(", stopped early, there may be more")
+	}
+	fmt.Println()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// When the rules enumerate almost every entry of a directory, a * would
+// also grant the few that were left out, which tend to be the sensitive
+// ones like .ssh. If the entries left out all start with characters none
+// of the enumerated ones start with, a negated class like [^.]* grants the
+// enumerated entries and any new ones while still excluding them.
+
+// negatedMinCoverage is the share of the entries of a directory the rules
+// must enumerate before a negated class is considered
+const negatedMinCoverage = 0.75
+
+// negatedClass returns the [^...]* pattern matching every member but none
+// of the excluded names, if there is one
+func negatedClass(members, excluded []string) (string, bool) {
+	chars := make(map[byte]bool)
+	for _, e := range excluded {
+		c := e[0]
+		if !(c == '.' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return "", false
+		}
+		chars[c] = true
+	}
+	for _, m := range members {
+		if chars[m[0]] {
+			return "", false
+		}
+	}
+	var class []string
+	for c := range chars {
+		class = append(class, string(c))
+	}
+	sort.Strings(class)
+	return "[^" + strings.Join(class, "") + "]*", true
+}
+
+// foldNegated replaces the groups of children with identical subtrees that
+// enumerate most entries of the directory at ctx with a negated class, if
+// the entries they leave out can be excluded by one
+func (aa *aaOptimizer) foldNegated(b bucket, ctx string, l *leaf) {
+	if !isLiteralPath(ctx) {
+		return
+	}
+	entries, err := os.ReadDir(filepath.Join(aa.fsRoot, ctx))
+	if err != nil || len(entries) == 0 {
+		return
+	}
+
+	var groups [][]*leaf
+	for _, c := range l.sortedChildren() {
+		if !isLiteralPart(c.part) || aa.keptApart(ctx+"/"+c.part) {
+			continue
+		}
+		added := false
+		for i, g := range groups {
+			if aa.identicalChildren(g[0], c) {
+				groups[i] = append(g, c)
+				added = true
+				break
+			}
+		}
+		if !added {
+			groups = append(groups, []*leaf{c})
+		}
+	}
+
+	for _, g := range groups {
+		members := make(map[string]bool)
+		var names []string
+		for _, c := range g {
+			members[c.part] = true
+			names = append(names, c.part)
+		}
+		var excluded []string
+		covered := 0
+		for _, e := range entries {
+			if members[e.Name()] {
+				covered++
+			} else {
+				excluded = append(excluded, e.Name())
+			}
+		}
+		if len(g) < 2 || len(excluded) == 0 || float64(covered) < negatedMinCoverage*float64(len(entries)) {
+			continue
+		}
+		pattern, ok := negatedClass(names, excluded)
+		if !ok || l.children[pattern] != nil {
+			continue
+		}
+
+		fmt.Printf("aaoptimizer: generalizing %d entries of %s to %s, which excludes %s\n", len(g), ctx, pattern, strings.Join(excluded, ", "))
+		var inputs []string
+		if aa.onTransform != nil {
+			for _, c := range g {
+				inputs = append(inputs, c.paths(ctx+"/"+c.part)...)
+			}
+		}
+		folded := newLeaf(pattern)
+		folded.children = g[0].children
+		for _, c := range g {
+			delete(l.children, c.part)
+		}
+		l.children[pattern] = folded
+		if aa.onTransform != nil {
+			aa.transformed("negated-class", true, b.rules(inputs), b.rules(folded.paths(ctx+"/"+pattern)))
+		}
+	}
+}
+
+// isLiteralPath reports whether every component of the path is literal,
+// so it names a single directory
+func isLiteralPath(ctx string) bool {
+	for _, p := range strings.Split(strings.TrimPrefix(ctx, "/"), "/") {
+		if !isLiteralPart(p) {
+			return false
+		}
+	}
+	return ctx != ""
+}
+
+func (aa *aaOptimizer) optimizeTreeNegated(b bucket, ctx string, l *leaf) {
+	if aa.mayGeneralize(ctx) && aa.mayIntroduce("[^") {
+		aa.foldNegated(b, ctx, l)
+	}
+	for _, c := range l.sortedChildren() {
+		aa.optimizeTreeNegated(b, ctx+"/"+c.part, c)
+	}
+}
+
+// Generalize things like:
+// /home/jane/Documents/** r,
+// /home/jane/Music/** r,
+// /home/jane/Pictures/** r,
+// to /home/jane/[^.]*/** r, if .ssh is the only other entry of /home/jane
+func (aa *aaOptimizer) optimizeNegated() {
+	aa.eachTree(func(b bucket, l *leaf) {
+		aa.optimizeTreeNegated(b, "", l)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// AppArmor policy is mostly order independent, but exec transitions that
+// overlap and deny rules mixed in between allow rules are easy to get wrong
+// when moved around. Rules found to be order sensitive are pinned, i.e they
+// are never ingested by the optimizer and stay where they are.
+
+// execRules are the exec rules of a file along with the header line of
+// the profile each belongs to, exec rules only compete with those of the
+// same profile. Profiles are told apart by their header rather than their
+// block, so the rules may be gathered while reading the file separately.
+type execRules struct {
+	rules  []profileRule
+	owners []int
+}
+
+// headerLine returns the header line of the profile, -1 for none
+func headerLine(pb *profileBlock) int {
+	if pb == nil {
+		return -1
+	}
+	return pb.header
+}
+
+// add adds the rule of the line if it is an exec rule
+func (er *execRules) add(line int, l string, owner *profileBlock) {
+	if pr, ok := parseProfileRule(line, l); ok && pr.isExec() {
+		er.rules = append(er.rules, pr)
+		er.owners = append(er.owners, headerLine(owner))
+	}
+}
+
+// orderSensitive returns why the selected rule of the line must not be
+// moved, or "" if it may be
+func (er *execRules) orderSensitive(line int, tl string, owner *profileBlock) string {
+	r, ok := parseProfileRule(line, tl)
+	if !ok {
+		// bare rules are never parsed, but may still deny
+		if isBareRule(tl) && strings.Contains(" "+tl, " deny ") {
+			return "deny rules are never moved"
+		}
+		return ""
+	}
+	if r.deny {
+		return "deny rules are never moved"
+	}
+	if !r.isExec() {
+		return ""
+	}
+	for i, o := range er.rules {
+		if o.line == r.line || (o.perms == r.perms && o.target == r.target) || er.owners[i] != headerLine(owner) {
+			continue
+		}
+		if aare.Intersects(r.path, o.path) {
+			return fmt.Sprintf("exec transition overlaps with line %d", o.line)
+		}
+	}
+	return ""
+}
+
+// orderSensitiveLines returns the lines selected by the prefixes that must
+// not be moved, along with the reason why.
+func orderSensitiveLines(lines []string, prefixes *prefixSet) map[int]string {
+	_, owners := findProfiles(lines)
+	var er execRules
+	for i, l := range lines {
+		er.add(i+1, l, owners[i])
+	}
+
+	pinned := make(map[int]string)
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		if _, ok := prefixes.selectPrefix(tl); !ok {
+			continue
+		}
+		if reason := er.orderSensitive(i+1, tl, owners[i]); reason != "" {
+			pinned[i] = reason
+		}
+	}
+	return pinned
+}
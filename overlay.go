@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+)
+
+// An overlay holds local rules merged into the profile before optimizing,
+// so they survive regenerating the profile. Every overlay rule is tagged
+// with a trailing # overlay: comment naming the file, which is carried
+// over to the generated rules covering it.
+
+// applyOverlay merges the overlay rules into the lines. A rule matching
+// one of the prefixes is put after the last rule of the profile with the
+// same prefix so it is optimized along with them, anything else goes in
+// front of the closing brace of the last profile.
+func applyOverlay(lines, overlay []string, name string, prefixes *prefixSet) []string {
+	end := len(lines)
+	endIndent := ""
+	if pb := lastProfile(lines); pb != nil {
+		end = pb.end
+		endIndent = "  "
+	}
+
+	// the last line of each prefix in the profile
+	last := make(map[string]int)
+	for i, l := range lines[:end] {
+		if p, ok := prefixes.selectPrefix(strings.TrimSpace(l)); ok && ruleKind(l) != "" {
+			last[p] = i
+		}
+	}
+
+	after := make(map[int][]string)
+	var tail []string
+	for _, l := range overlay {
+		tl := strings.TrimSpace(l)
+		if tl == "" || strings.HasPrefix(tl, "#") {
+			continue
+		}
+		tagged := tl + " # overlay: " + name
+		p, ok := prefixes.selectPrefix(tl)
+		if i, found := last[p]; ok && found {
+			indent := lines[i][:len(lines[i])-len(strings.TrimLeft(lines[i], " \t"))]
+			after[i] = append(after[i], indent+tagged)
+			continue
+		}
+		tail = append(tail, endIndent+tagged)
+	}
+
+	var merged []string
+	for i, l := range lines {
+		if i == end {
+			merged = append(merged, tail...)
+		}
+		merged = append(merged, l)
+		merged = append(merged, after[i]...)
+	}
+	if end == len(lines) {
+		merged = append(merged, tail...)
+	}
+	return merged
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+)
+
+// eachTree calls fn with the tree of every bucket, working on up to
+// aa.jobs trees at the same time. The trees share no nodes, so the passes
+// working on one tree at a time need no locking beyond that of
+// onTransform.
+func (aa *aaOptimizer) eachTree(fn func(b bucket, l *leaf)) {
+	if aa.progress != nil {
+		var mu sync.Mutex
+		done, pass, each := 0, aa.pass, fn
+		fn = func(b bucket, l *leaf) {
+			each(b, l)
+			mu.Lock()
+			done++
+			aa.progress.treeDone(pass, done, len(aa.trees))
+			mu.Unlock()
+		}
+	}
+	if aa.jobs <= 1 || len(aa.trees) < 2 {
+		for b, l := range aa.trees {
+			fn(b, l)
+		}
+		return
+	}
+
+	type tree struct {
+		b bucket
+		l *leaf
+	}
+	work := make(chan tree)
+	var wg sync.WaitGroup
+	for i := 0; i < aa.jobs && i < len(aa.trees); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range work {
+				fn(t.b, t.l)
+			}
+		}()
+	}
+	for b, l := range aa.trees {
+		work <- tree{b, l}
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// benchmarkRules returns the rules of a large profile granting many
+// permission sets, each of which gets its own tree
+func benchmarkRules() []string {
+	var rules []string
+	for _, perms := range []string{"r", "w", "rw", "rk", "rwk", "m", "rm", "ix"} {
+		for i := 0; i < 40; i++ {
+			for j := 0; j < 25; j++ {
+				rules = append(rules, fmt.Sprintf("/sys/devices/pci0000:00/0000:00:%02d.0/usb%d/%d-%d/power/control %s,", i, j%4, i, j, perms))
+			}
+		}
+	}
+	return rules
+}
+
+func benchmarkJobs(b *testing.B, jobs int) {
+	rules := benchmarkRules()
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// the passes report on stdout
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		aa := newAaOptimizer()
+		aa.jobs = jobs
+		for _, r := range rules {
+			if err := aa.addRule(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+		aa.optimize()
+	}
+}
+
+func BenchmarkOptimizeJobs1(b *testing.B) {
+	benchmarkJobs(b, 1)
+}
+
+func BenchmarkOptimizeJobsNumCPU(b *testing.B) {
+	benchmarkJobs(b, runtime.NumCPU())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// profileRule is a single rule line of a profile as seen by the analysis
+// code, unlike rule it is not consumed by the optimizer passes
+type profileRule struct {
+	// line is 1-based
+	line int
+	// src is set to where the rule came from if includes were inlined
+	src   source
+	text  string
+	audit bool
+	deny  bool
+	owner bool
+
+	// fileKeyword is set when the rule starts with the file keyword, a
+	// bare file rule grants access to every file
+	fileKeyword bool
+	catchAll    bool
+
+	// capability rules
+	capability   bool
+	capabilities []string
+
+	// file rules, path is as written, quotes included
+	path   string
+	perms  string
+	target string
+}
+
+func (pr *profileRule) isFile() bool {
+	return pr.path != ""
+}
+
+// ref refers to the rule in messages
+func (pr *profileRule) ref() string {
+	if pr.src.file != "" {
+		return pr.src.String()
+	}
+	return fmt.Sprintf("line %d", pr.line)
+}
+
+func (pr *profileRule) isExec() bool {
+	return pr.isFile() && strings.Contains(pr.perms, "x")
+}
+
+func stripComment(l string) string {
+	if i := strings.Index(l, "#"); i >= 0 {
+		return l[:i]
+	}
+	return l
+}
+
+// parseProfileRule parses the rule on the line, only capability and file
+// rules are understood, anything else reports false.
+func parseProfileRule(line int, l string) (profileRule, bool) {
+	tl := strings.TrimSpace(stripComment(l))
+	if !strings.HasSuffix(tl, ",") {
+		return profileRule{}, false
+	}
+
+	pr := profileRule{line: line, text: tl}
+	tokens := aare.Fields(strings.TrimSuffix(tl, ","))
+qualifiers:
+	for len(tokens) > 0 {
+		switch tokens[0] {
+		case "audit":
+			pr.audit = true
+		case "deny":
+			pr.deny = true
+		case "owner":
+			pr.owner = true
+		case "file":
+			pr.fileKeyword = true
+		case "allow":
+		default:
+			break qualifiers
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		if pr.fileKeyword {
+			pr.catchAll = true
+			return pr, true
+		}
+		return profileRule{}, false
+	}
+
+	if tokens[0] == "capability" {
+		pr.capability = true
+		pr.capabilities = tokens[1:]
+		return pr, true
+	}
+
+	if len(tokens) < 2 || !isPath(tokens[0]) {
+		return profileRule{}, false
+	}
+	pr.path = tokens[0]
+	pr.perms = tokens[1]
+	if len(tokens) >= 4 && tokens[2] == "->" {
+		pr.target = tokens[3]
+	}
+	return pr, true
+}
+
+// isPath reports whether the word of a rule is a path, quoted or not
+func isPath(t string) bool {
+	t = aare.Unquote(t)
+	return strings.HasPrefix(t, "/") || strings.HasPrefix(t, "@")
+}
+
+// ruleKind returns the type of the rule on the line, i.e file, capability
+// or network, or an empty string if the line is not a rule.
+func ruleKind(l string) string {
+	tl := strings.TrimSpace(stripComment(l))
+	if !strings.HasSuffix(tl, ",") {
+		return ""
+	}
+	tokens := aare.Fields(strings.TrimSuffix(tl, ","))
+	for len(tokens) > 0 {
+		switch tokens[0] {
+		case "audit", "deny", "owner", "allow", "quiet":
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	switch t := tokens[0]; {
+	case t == "file" || isPath(t):
+		return "file"
+	case t == "set" && len(tokens) > 1 && tokens[1] == "rlimit":
+		return "rlimit"
+	case strings.HasPrefix(t, "@{") || strings.Contains(t, "="):
+		return "variable"
+	default:
+		return t
+	}
+}
+
+// isBareRule reports whether the line is a file rule without any
+// permissions, i.e deny /foo/bar,
+func isBareRule(l string) bool {
+	tl := strings.TrimSpace(stripComment(l))
+	if !strings.HasSuffix(tl, ",") {
+		return false
+	}
+	tokens := aare.Fields(strings.TrimSuffix(tl, ","))
+	for len(tokens) > 1 {
+		switch tokens[0] {
+		case "audit", "deny", "owner", "allow", "file":
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	return len(tokens) == 1 && (strings.HasPrefix(tokens[0], "/") || strings.HasPrefix(tokens[0], "@"))
+}
+
+// rulePath returns the path of the file rule on the line, skipping its
+// qualifiers. Unlike parseProfileRule it does not need the permissions, so
+// it finds the path of bare rules too.
+func rulePath(l string) (string, bool) {
+	tokens := aare.Fields(strings.TrimSuffix(strings.TrimSpace(stripComment(l)), ","))
+	for len(tokens) > 1 {
+		switch tokens[0] {
+		case "audit", "deny", "owner", "allow", "file":
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	if len(tokens) == 0 || !(strings.HasPrefix(tokens[0], "/") || strings.HasPrefix(tokens[0], "@{")) {
+		return "", false
+	}
+	return tokens[0], true
+}
+
+// parseProfileRules parses all the rules it understands from the lines.
+func parseProfileRules(lines []string) []profileRule {
+	var rules []profileRule
+	for i, l := range lines {
+		if pr, ok := parseProfileRule(i+1, l); ok {
+			rules = append(rules, pr)
+		}
+	}
+	return rules
+}
+
+// permsCover reports whether every permission in specific is also
+// in general, w grants append as well.
+func permsCover(general, specific string) bool {
+	for _, p := range specific {
+		if p == 'a' && strings.ContainsRune(general, 'w') {
+			continue
+		}
+		if !strings.ContainsRune(general, p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuleKind(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want string
+	}{
+		{"  /sys/devices/a r,", "file"},
+		{`  "/sys/devices/quoted path" r,`, "file"},
+		{`  /sys/devices/escaped\ path r,`, "file"},
+		{"  owner @{HOME}/.config/** rw,", "file"},
+		{"  deny /sys/devices/bare,", "file"},
+		{"  audit capability net_admin,", "capability"},
+		{"  network inet stream,", "network"},
+		{"  set rlimit nofile <= 1024,", "rlimit"},
+		{"  # /sys/devices/a r,", ""},
+		{"profile test {", ""},
+	} {
+		if got := ruleKind(tc.line); got != tc.want {
+			t.Errorf("ruleKind(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestStatsTokenizing(t *testing.T) {
+	lines := []string{
+		"profile test {",
+		`  "/sys/devices/quoted path" r,`,
+		`  /sys/devices/escaped\ path/x w,`,
+		"  deny /sys/devices/bare,",
+		"  /sys/{devices/a,class/b}/c r,",
+		"}",
+	}
+	stats := collectStats("test", lines, "")
+	if len(stats) != 1 {
+		t.Fatalf("got %d profiles, want 1", len(stats))
+	}
+	ps := stats[0]
+	if len(ps.kinds) != 1 || ps.kinds["file"] != 4 {
+		t.Errorf("rule types %v, want 4 file rules", ps.kinds)
+	}
+	if len(ps.perms) != 2 || ps.perms["r"] != 2 || ps.perms["w"] != 1 {
+		t.Errorf("permissions %v, want r twice and w once", ps.perms)
+	}
+	for p := range ps.prefixes {
+		if strings.ContainsAny(p, `"{}`) {
+			t.Errorf("bogus prefix %q", p)
+		}
+	}
+	if ps.prefixes[`/sys/devices/escaped\ path`] != 1 {
+		t.Errorf("prefixes %v lack the escaped path", ps.prefixes)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the order file permissions are canonically written in, exec modes
+// follow these
+const permOrder = "mrwalk"
+
+// canonicalPerms rewrites the permissions of a rule into canonical order
+// so equivalent permission sets always compare equal, i.e kr and rk.
+func canonicalPerms(perms string) string {
+	perms = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(perms), ","))
+
+	var sb strings.Builder
+	for _, p := range permOrder {
+		if strings.ContainsRune(perms, p) {
+			sb.WriteRune(p)
+		}
+	}
+
+	// exec modes are written as the transition, its fallback and x, i.e
+	// Pix or PUx
+	for _, p := range execOrder {
+		if strings.ContainsRune(perms, p) {
+			sb.WriteRune(p)
+		}
+	}
+	return sb.String()
+}
+
+const execOrder = "pPcCuUix"
+
+// validatePerms checks the permissions are a combination apparmor_parser
+// accepts
+func validatePerms(perms string) error {
+	perms = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(perms), ","))
+	if perms == "" {
+		return fmt.Errorf("no permissions")
+	}
+	for _, p := range perms {
+		if !strings.ContainsRune(permOrder, p) && !strings.ContainsRune(execOrder, p) {
+			return fmt.Errorf("unknown permission %q", p)
+		}
+	}
+	if strings.ContainsRune(perms, 'w') && strings.ContainsRune(perms, 'a') {
+		return fmt.Errorf("w and a conflict, w implies a")
+	}
+
+	transitions := countRunes(perms, "pPcC")
+	unconfined := countRunes(perms, "uU")
+	inherit := countRunes(perms, "i")
+	qualifiers := transitions + unconfined + inherit
+	switch {
+	case !strings.ContainsRune(perms, 'x'):
+		if qualifiers > 0 {
+			return fmt.Errorf("exec mode in %q without x", perms)
+		}
+	case qualifiers == 0:
+		return fmt.Errorf("x without an exec mode, i.e ix or Px")
+	case transitions > 1 || unconfined > 1 || inherit > 1 || (unconfined > 0 && inherit > 0):
+		return fmt.Errorf("conflicting exec modes in %q", perms)
+	case transitions == 0 && qualifiers > 1:
+		return fmt.Errorf("fallback without a transition in %q", perms)
+	}
+	return nil
+}
+
+func countRunes(s, set string) int {
+	n := 0
+	for _, r := range s {
+		if strings.ContainsRune(set, r) {
+			n++
+		}
+	}
+	return n
+}
+
+// permsStrictSubset reports whether every permission of a is in b, and b
+// has at least one more
+func permsStrictSubset(a, b string) bool {
+	a = strings.TrimSuffix(a, ",")
+	b = strings.TrimSuffix(b, ",")
+	return a != b && permsCover(b, a)
+}
+
+// resolveAppendWrite drops a from permissions that also have w, which
+// apparmor_parser rejects, w already grants append
+func resolveAppendWrite(perms string) (string, bool) {
+	if !strings.ContainsRune(perms, 'w') || !strings.ContainsRune(perms, 'a') {
+		return perms, false
+	}
+	return strings.ReplaceAll(perms, "a", ""), true
+}
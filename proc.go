@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// learned profiles are full of the process ids they happened to see, i.e
+// /proc/1234/stat, which never match again. Sibling pids are folded onto
+// a pattern matching any pid.
+
+// pidPattern returns the pattern the ids below the path are folded onto
+func (aa *aaOptimizer) pidPattern(ctx string) string {
+	switch {
+	case !aa.pidVariable:
+		return "[0-9]*"
+	case strings.HasSuffix(ctx, "/task"):
+		return "@{tid}"
+	}
+	return "@{pid}"
+}
+
+func isPid(part string) bool {
+	n, err := strconv.Atoi(part)
+	return err == nil && n > 0 && !strings.HasPrefix(part, "0")
+}
+
+// isPidDir reports whether the children of the path are named after
+// process or thread ids, /proc and /proc/<pid>/task
+func isPidDir(ctx string) bool {
+	if ctx == "/proc" {
+		return true
+	}
+	parts := strings.Split(ctx, "/")
+	return len(parts) == 4 && parts[1] == "proc" && parts[3] == "task"
+}
+
+func (aa *aaOptimizer) foldPidDir(b bucket, ctx string, l *leaf) {
+	pattern := aa.pidPattern(ctx)
+	var pids []*leaf
+	for _, c := range l.sortedChildren() {
+		if isPid(c.part) && !aa.keptApart(ctx+"/"+c.part) {
+			pids = append(pids, c)
+		}
+	}
+	// a lone pid is folded only into an existing pattern
+	folded := l.children[pattern]
+	if len(pids) == 0 || (len(pids) == 1 && folded == nil) || !aa.mayIntroduce(pattern) || !aa.mayGeneralize(ctx) {
+		return
+	}
+
+	var inputs []string
+	if aa.onTransform != nil {
+		if folded != nil {
+			inputs = folded.paths(ctx + "/" + pattern)
+		}
+		for _, c := range pids {
+			inputs = append(inputs, c.paths(ctx+"/"+c.part)...)
+		}
+	}
+	if folded == nil {
+		folded = newLeaf(pattern)
+		l.children[pattern] = folded
+	}
+	for _, c := range pids {
+		delete(l.children, c.part)
+		aa.combineLeafs(folded, c)
+	}
+	if aa.onTransform != nil {
+		aa.transformed("pids", true, b.rules(inputs), b.rules(folded.paths(ctx+"/"+pattern)))
+	}
+}
+
+func (aa *aaOptimizer) optimizeTreePids(b bucket, ctx string, l *leaf) {
+	if isPidDir(ctx) {
+		aa.foldPidDir(b, ctx, l)
+	}
+	for _, c := range l.sortedChildren() {
+		aa.optimizeTreePids(b, ctx+"/"+c.part, c)
+	}
+}
+
+// Combine things like:
+// /proc/1234/stat r,
+// /proc/5678/stat r,
+func (aa *aaOptimizer) optimizePids() {
+	aa.eachTree(func(b bucket, l *leaf) {
+		aa.optimizeTreePids(b, "", l)
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+)
+
+// profileBlock is a profile, child profile or hat in a policy file
+type profileBlock struct {
+	name string
+	// header and end are the line indices of the opening line and the
+	// closing brace
+	header int
+	end    int
+	parent *profileBlock
+}
+
+// profileName extracts the name of the profile from a block header, the
+// boolean is false if the block is not a profile, i.e a conditional.
+func profileName(header string) (string, bool) {
+	tokens := strings.Fields(strings.TrimSuffix(header, "{"))
+	if len(tokens) == 0 {
+		return "", false
+	}
+	switch tokens[0] {
+	case "if", "else":
+		return "", false
+	case "profile", "hat":
+		if len(tokens) < 2 {
+			return "", false
+		}
+		return tokens[1], true
+	}
+	return tokens[0], true
+}
+
+// profileTracker follows the profile blocks of a file line by line
+type profileTracker struct {
+	blocks []*profileBlock
+	// stack holds the enclosing profile of every open block, including
+	// conditionals
+	stack   []*profileBlock
+	current *profileBlock
+}
+
+// next takes the line with index i and returns the innermost profile it
+// belongs to, or nil for lines outside any profile. Blocks still open
+// have an end of -1.
+func (pt *profileTracker) next(i int, l string) *profileBlock {
+	tl := strings.TrimSpace(stripComment(l))
+	switch {
+	case strings.HasPrefix(tl, "}") && strings.HasSuffix(tl, "{"):
+		// } else {
+	case strings.HasSuffix(tl, "{"):
+		pt.stack = append(pt.stack, pt.current)
+		if name, ok := profileName(tl); ok {
+			pb := &profileBlock{name: name, header: i, end: -1, parent: pt.current}
+			if pt.current != nil {
+				pb.name = pt.current.name + "//" + strings.TrimPrefix(name, "^")
+			}
+			pt.blocks = append(pt.blocks, pb)
+			pt.current = pb
+		}
+	case strings.HasPrefix(tl, "}"):
+		owner := pt.current
+		if len(pt.stack) > 0 {
+			if pt.current != nil && pt.current != pt.stack[len(pt.stack)-1] {
+				pt.current.end = i
+			}
+			pt.current = pt.stack[len(pt.stack)-1]
+			pt.stack = pt.stack[:len(pt.stack)-1]
+		}
+		return owner
+	}
+	return pt.current
+}
+
+// findProfiles returns the profile blocks of the file, and for each line
+// the innermost profile it belongs to, or nil for lines outside any
+// profile.
+func findProfiles(lines []string) ([]*profileBlock, []*profileBlock) {
+	var pt profileTracker
+	owners := make([]*profileBlock, len(lines))
+	for i, l := range lines {
+		owners[i] = pt.next(i, l)
+	}
+	for _, pb := range pt.blocks {
+		if pb.end < 0 {
+			pb.end = len(lines) - 1
+		}
+	}
+	return pt.blocks, owners
+}
+
+// lastProfile returns the last top level profile of the lines, the hats
+// and child profiles nested in it are part of it, or nil if there is none
+func lastProfile(lines []string) *profileBlock {
+	blocks, _ := findProfiles(lines)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if blocks[i].parent == nil {
+			return blocks[i]
+		}
+	}
+	return nil
+}
+
+// isFragment reports whether the lines are a bare list of rules rather than
+// a complete profile, as generated by snapd interface backends or udev
+// helpers
+func isFragment(lines []string) bool {
+	if blocks, _ := findProfiles(lines); len(blocks) > 0 {
+		return false
+	}
+	for _, l := range lines {
+		if ruleKind(l) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var progressFormats = []string{"none", "plain", "json"}
+
+// progressInterval is how often progress is reported at most, the end of
+// every pass is always reported
+const progressInterval = time.Second
+
+// progressEvent is one progress report, as written with --progress json
+type progressEvent struct {
+	// Stage is either "ingest" or "pass"
+	Stage string `json:"stage"`
+	// Rules is the number of rules ingested so far
+	Rules int    `json:"rules"`
+	Pass  string `json:"pass,omitempty"`
+	// Percent, Trees and Done tell how many of the trees the pass is done
+	// with
+	Percent int `json:"percent"`
+	Trees   int `json:"trees,omitempty"`
+	Done    int `json:"done,omitempty"`
+}
+
+// progress reports the progress of long runs to stderr, it is shared by
+// the optimizers of every region and safe to use from several goroutines.
+// A nil progress reports nothing.
+type progress struct {
+	format string
+	w      io.Writer
+
+	mu    sync.Mutex
+	last  time.Time
+	rules int
+}
+
+func newProgress(format string) *progress {
+	if format == "none" {
+		return nil
+	}
+	return &progress{format: format, w: os.Stderr}
+}
+
+func (p *progress) report(ev progressEvent, force bool) {
+	now := time.Now()
+	if !force && now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+	if p.format == "json" {
+		json.NewEncoder(p.w).Encode(ev)
+		return
+	}
+	if ev.Stage == "ingest" {
+		fmt.Fprintf(p.w, "progress: %d rules ingested\n", ev.Rules)
+		return
+	}
+	fmt.Fprintf(p.w, "progress: %s %d%% (%d of %d trees)\n", ev.Pass, ev.Percent, ev.Done, ev.Trees)
+}
+
+// ingested counts a rule added to one of the trees
+func (p *progress) ingested() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules++
+	p.report(progressEvent{Stage: "ingest", Rules: p.rules}, false)
+}
+
+// treeDone reports that the pass is done with another of the trees
+func (p *progress) treeDone(pass string, done, trees int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report(progressEvent{
+		Stage:   "pass",
+		Rules:   p.rules,
+		Pass:    pass,
+		Percent: done * 100 / trees,
+		Trees:   trees,
+		Done:    done,
+	}, done == trees)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isDescendant returns whether the process is the root process or one of
+// its children, following the parents recorded in /proc
+func isDescendant(pid, root int, known map[int]bool) bool {
+	var chain []int
+	for pid > 1 {
+		if d, ok := known[pid]; ok {
+			for _, p := range chain {
+				known[p] = d
+			}
+			return d
+		}
+		if pid == root {
+			break
+		}
+		chain = append(chain, pid)
+		pid = parentPid(pid)
+	}
+	d := pid == root
+	for _, p := range chain {
+		known[p] = d
+	}
+	return d
+}
+
+// parentPid returns the parent of the process, or 0 if it is gone
+func parentPid(pid int) int {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(l, "PPid:"); ok {
+			ppid, _ := strconv.Atoi(strings.TrimSpace(v))
+			return ppid
+		}
+	}
+	return 0
+}
+
+// coveredMounts returns the mounts the file rules may grant access to, the
+// mount holding the literal directory a rule starts with and the mounts
+// below it
+func coveredMounts(mounts []string, rules []profileRule) []string {
+	covered := make(map[string]bool)
+	for _, pr := range rules {
+		if pr.deny || !(pr.isFile() || pr.catchAll) {
+			continue
+		}
+		dir := "/"
+		if pr.isFile() {
+			dir = pr.path
+			if i := strings.IndexAny(dir, "*?[{@"); i >= 0 {
+				dir = dir[:i]
+			}
+			dir = dir[:strings.LastIndex(dir, "/")+1]
+		}
+		holding := ""
+		for _, m := range mounts {
+			if strings.HasPrefix(m+"/", dir) {
+				covered[m] = true
+			}
+			if strings.HasPrefix(dir, strings.TrimSuffix(m, "/")+"/") && len(m) > len(holding) {
+				holding = m
+			}
+		}
+		if holding != "" {
+			covered[holding] = true
+		}
+	}
+	var result []string
+	for _, m := range mounts {
+		if covered[m] {
+			result = append(result, m)
+			covered[m] = false
+		}
+	}
+	return result
+}
+
+func recordMain(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	pid := fs.Int("pid", 0, "process to record, along with its children")
+	duration := fs.Duration("duration", 60*time.Second, "how long to record for, recording ends early if the process exits")
+	optimize := fs.Bool("optimize", true, "optimize the prefixes shared by many of the rules of the result")
+	autoMin := fs.Int("auto-min", 10, "minimum number of rules a prefix must exceed to be optimized")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer record [flags] [profile] [output]")
+		fmt.Println("records the file accesses of a running process with fanotify and merges them into the profile, needs CAP_SYS_ADMIN")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 2 || *pid <= 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+
+	la := newLearnedAccesses()
+	profileRules := parseProfileRules(lines)
+	fmt.Printf("recording process %d for %s\n", *pid, *duration)
+	if err := recordAccesses(*pid, *duration, la, profileRules); err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+
+	rules := la.rules(profileRules)
+	fmt.Printf("%d new rules from %d accessed paths\n", len(rules), len(la.perms))
+	merged, err := learnRules(lines, input, rules, *optimize, *autoMin)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeLines(merged, fs.Arg(1)); err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// from linux/fanotify.h
+const (
+	fanClassNotif    = 0x0
+	fanCloexec       = 0x1
+	fanNonblock      = 0x2
+	fanMarkAdd       = 0x1
+	fanMarkMount     = 0x10
+	fanAccess        = 0x1
+	fanModify        = 0x2
+	fanCloseWrite    = 0x8
+	fanOpen          = 0x20
+	fanOpenExec      = 0x1000
+	fanEventOnDir    = 0x40000000
+	fanMetadataLen   = 24
+	fanNoFd          = -1
+	fanRecordedMasks = fanAccess | fanModify | fanCloseWrite | fanOpen
+)
+
+// fanotifyEventMetadata is struct fanotify_event_metadata, read in the
+// byte order of the machine
+type fanotifyEventMetadata struct {
+	eventLen    uint32
+	vers        uint8
+	reserved    uint8
+	metadataLen uint16
+	mask        uint64
+	fd          int32
+	pid         int32
+}
+
+// atFdcwd makes fanotify_mark resolve relative paths from the working
+// directory, it is a variable as it is passed as an unsigned argument
+var atFdcwd = -0x64
+
+// mountPoints returns the mount points the process sees
+func mountPoints(pid int) ([]string, error) {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 5 {
+			mounts = append(mounts, fields[4])
+		}
+	}
+	return mounts, s.Err()
+}
+
+func fanotifyMark(fd int, mask uint64, path string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	// the mask is split over two arguments on 32 bit architectures,
+	// recordAccesses refuses to run there
+	_, _, errno := syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, uintptr(fd), fanMarkAdd|fanMarkMount,
+		uintptr(mask), uintptr(atFdcwd), uintptr(unsafe.Pointer(p)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// recordAccesses watches the mounts the rules of the profile cover with
+// fanotify for the duration, and records the file accesses of the process
+// and its children. Only notification events are used, nothing waits on
+// the recorder, so accesses of children exiting before they are traced back
+// to the process through /proc may be missed.
+func recordAccesses(pid int, duration time.Duration, la *learnedAccesses, rules []profileRule) error {
+	if unsafe.Sizeof(uintptr(0)) < 8 {
+		return fmt.Errorf("recording is not supported on 32 bit architectures")
+	}
+	r, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT, fanClassNotif|fanCloexec|fanNonblock,
+		uintptr(syscall.O_RDONLY|syscall.O_LARGEFILE), 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot initialize fanotify: %v", errno)
+	}
+	fd := int(r)
+	defer syscall.Close(fd)
+
+	mounts, err := mountPoints(pid)
+	if err != nil {
+		return err
+	}
+	mounts = coveredMounts(mounts, rules)
+	if len(mounts) == 0 {
+		return fmt.Errorf("the profile has no file rules telling which mounts to watch")
+	}
+	marked := 0
+	for _, m := range mounts {
+		// exec events need Linux 5.0, do without them on older kernels
+		err := fanotifyMark(fd, fanRecordedMasks|fanOpenExec, m)
+		if err == syscall.EINVAL {
+			err = fanotifyMark(fd, fanRecordedMasks, m)
+		}
+		if err == nil {
+			marked++
+		}
+	}
+	if marked == 0 {
+		return fmt.Errorf("cannot watch any of the mounts of process %d", pid)
+	}
+
+	known := make(map[int]bool)
+	// the buffer is made of words so the event metadata is aligned
+	words := make([]uint64, 8*1024)
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), len(words)*8)
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		var set syscall.FdSet
+		fdSet(&set, fd)
+		tv := syscall.NsecToTimeval(int64(100 * time.Millisecond))
+		if _, err := syscall.Select(fd+1, &set, nil, nil, &tv); err != nil && err != syscall.EINTR {
+			return err
+		}
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			if _, err := os.Stat("/proc/" + strconv.Itoa(pid)); err != nil {
+				fmt.Printf("process %d exited\n", pid)
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for off := 0; off+fanMetadataLen <= n; {
+			md := (*fanotifyEventMetadata)(unsafe.Pointer(&buf[off]))
+			eventLen, mask, efd, epid := int(md.eventLen), md.mask, int(md.fd), int(md.pid)
+			if eventLen < fanMetadataLen {
+				break
+			}
+			off += eventLen
+			if efd == fanNoFd {
+				continue
+			}
+			if mask&fanEventOnDir == 0 && isDescendant(epid, pid, known) {
+				if path, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(efd)); err == nil {
+					la.grant(path, eventPerms(path, mask))
+				}
+			}
+			syscall.Close(efd)
+		}
+	}
+	return nil
+}
+
+// fdSet adds the descriptor to the set, whose words are 32 or 64 bits
+// depending on the architecture
+func fdSet(set *syscall.FdSet, fd int) {
+	bits := int(unsafe.Sizeof(set.Bits[0])) * 8
+	set.Bits[fd/bits] |= 1 << (uint(fd) % uint(bits))
+}
+
+// eventPerms returns the permissions a fanotify event on the path needs
+func eventPerms(path string, mask uint64) string {
+	var perms string
+	if mask&(fanOpen|fanAccess) != 0 {
+		perms += "r"
+		if sharedLibrary.MatchString(path) {
+			perms += "m"
+		}
+	}
+	if mask&(fanModify|fanCloseWrite) != 0 {
+		perms += "w"
+	}
+	if mask&fanOpenExec != 0 {
+		perms += "ix"
+	}
+	return perms
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func recordAccesses(pid int, duration time.Duration, la *learnedAccesses, rules []profileRule) error {
+	return errors.New("recording needs fanotify, which is only available on Linux")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// includedRules returns the file rules each include of the profile pulls
+// in, by include line index. Missing optional includes grant nothing.
+func includedRules(lines []string, file, base string) (map[int][]abstraction, error) {
+	included := make(map[int][]abstraction)
+	for _, inc := range parseIncludes(lines) {
+		resolved := resolveInclude(inc, base, filepath.Dir(file))
+		if _, err := os.Stat(resolved); err != nil {
+			if inc.optional() {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: included file %s does not exist", file, inc.line, resolved)
+		}
+		for _, t := range includeTargets(resolved) {
+			flat, sources, err := flattenIncludes(t, base)
+			if err != nil {
+				return nil, err
+			}
+			a := abstraction{name: inc.path}
+			for _, pr := range parseProfileRules(flat) {
+				if pr.isFile() && !pr.deny {
+					pr.src = sources[pr.line-1]
+					a.rules = append(a.rules, pr)
+				}
+			}
+			included[inc.line-1] = append(included[inc.line-1], a)
+		}
+	}
+	return included, nil
+}
+
+// dropRedundant removes the rules of each profile that one of the files
+// the profile includes already grants, or comments them out if mode is
+// "comment". Only includes of the profile itself count, child profiles
+// and hats do not inherit them.
+func dropRedundant(lines []string, file, base, mode string) ([]string, error) {
+	included, err := includedRules(lines, file, base)
+	if err != nil {
+		return nil, err
+	}
+	_, owners := findProfiles(lines)
+	var incLines []int
+	for inc := range included {
+		incLines = append(incLines, inc)
+	}
+	sort.Ints(incLines)
+
+	out := append([]string(nil), lines...)
+	drop := make(map[int]bool)
+	for _, pr := range parseProfileRules(lines) {
+		i := pr.line - 1
+		for _, inc := range incLines {
+			if owners[inc] != owners[i] {
+				continue
+			}
+			found := false
+			for _, a := range included[inc] {
+				ar, ok := a.provider(pr)
+				if !ok {
+					continue
+				}
+				if mode == "comment" {
+					l := lines[i]
+					out[i] = l[:len(l)-len(strings.TrimLeft(l, " \t"))] + "# " + strings.TrimSpace(l) + " # granted by " + ar.src.String()
+					fmt.Printf("aaoptimizer: line %d: %q is already granted by <%s> at %s, commenting it out\n", pr.line, pr.text, a.name, ar.src)
+				} else {
+					drop[i] = true
+					fmt.Printf("aaoptimizer: line %d: %q is already granted by <%s> at %s, removing it\n", pr.line, pr.text, a.name, ar.src)
+				}
+				found = true
+				break
+			}
+			if found {
+				break
+			}
+		}
+	}
+	if len(drop) == 0 {
+		return out, nil
+	}
+	var kept []string
+	for i, l := range out {
+		if !drop[i] {
+			kept = append(kept, l)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// aareToRegex translates a pattern without variables into an anchored
+// regular expression understood by both Go and PCRE, following what
+// apparmor_parser does: * and ? never match a /, ** does, and a * or **
+// directly after a / never matches the empty string.
+func aareToRegex(p string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	depth := 0
+	rs := []rune(p)
+	for i := 0; i < len(rs); i++ {
+		switch c := rs[i]; c {
+		case '\\':
+			if i+1 < len(rs) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(string(rs[i])))
+		case '?':
+			sb.WriteString(`[^/\x00]`)
+		case '*':
+			class := `[^/\x00]`
+			if i+1 < len(rs) && rs[i+1] == '*' {
+				class = `[^\x00]`
+				for i+1 < len(rs) && rs[i+1] == '*' {
+					i++
+				}
+			}
+			if sb.Len() > 1 && strings.HasSuffix(sb.String(), "/") {
+				sb.WriteString(`[^/\x00]`)
+			}
+			sb.WriteString(class + "*")
+		case '[':
+			end := i + 1
+			if end < len(rs) && rs[end] == '^' {
+				end++
+			}
+			if end < len(rs) && rs[end] == ']' {
+				end++
+			}
+			for end < len(rs) && rs[end] != ']' {
+				end++
+			}
+			if end == len(rs) {
+				return "", fmt.Errorf("unterminated [ in pattern %q", p)
+			}
+			sb.WriteString("[" + strings.ReplaceAll(string(rs[i+1:end]), `\`, `\\`) + "]")
+			i = end
+		case '{':
+			depth++
+			sb.WriteString("(?:")
+		case '}':
+			if depth == 0 {
+				return "", fmt.Errorf("unbalanced } in pattern %q", p)
+			}
+			depth--
+			sb.WriteString(")")
+		case ',':
+			if depth > 0 {
+				sb.WriteString("|")
+			} else {
+				sb.WriteString(",")
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if depth != 0 {
+		return "", fmt.Errorf("unbalanced { in pattern %q", p)
+	}
+	sb.WriteString("$")
+	return sb.String(), nil
+}
+
+// patternRegex translates a pattern into a single regular expression,
+// alternating over the values of the variables it uses
+func patternRegex(p string, tunables map[string][]string) (string, error) {
+	resolved := resolveVariable(p, tunables, 0)
+	if len(resolved) == 0 {
+		return "", fmt.Errorf("pattern %q uses an undefined variable", p)
+	}
+
+	var res []string
+	for _, r := range resolved {
+		if strings.Contains(r, "@{") {
+			return "", fmt.Errorf("pattern %q uses an undefined variable", p)
+		}
+		re, err := aareToRegex(normalizePrefix(r))
+		if err != nil {
+			return "", err
+		}
+		if _, err := regexp.Compile(re); err != nil {
+			return "", fmt.Errorf("pattern %q: %v", p, err)
+		}
+		res = append(res, re)
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return "(?:" + strings.Join(res, "|") + ")", nil
+}
+
+type regexRule struct {
+	Line    int    `json:"line"`
+	Rule    string `json:"rule"`
+	Pattern string `json:"pattern"`
+	Regex   string `json:"regex"`
+	Perms   string `json:"perms"`
+	Deny    bool   `json:"deny,omitempty"`
+	Owner   bool   `json:"owner,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+func exportRegexMain(args []string) {
+	fs := flag.NewFlagSet("export-regex", flag.ExitOnError)
+	var tunableFiles stringList
+	fs.Var(&tunableFiles, "tunables", "file defining variables used by the profile, may be given multiple times")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer export-regex [flags] [profile]")
+		fmt.Println("writes the file rules of the profile as JSON, each with the regular expression its path translates to")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	tunables := loadTunables(append([]string{input}, tunableFiles...))
+
+	exported := []regexRule{}
+	failed := false
+	for _, r := range parseProfileRules(lines) {
+		if !r.isFile() {
+			continue
+		}
+		re, err := patternRegex(r.path, tunables)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "aaoptimizer: line %d: %v\n", r.line, err)
+			failed = true
+			continue
+		}
+		exported = append(exported, regexRule{r.line, r.text, r.path, re, canonicalPerms(r.perms), r.deny, r.owner, r.target})
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(exported); err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
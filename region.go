@@ -0,0 +1,753 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"test/aaoptimizer/aare"
+)
+
+// region is a run of consecutive rules matching the same prefix. Each
+// region is optimized on its own and the generated block replaces it in
+// place, so the ordering relative to the surrounding rules is kept.
+type region struct {
+	prefix string
+	// profile is the innermost profile the region is in, nil outside of
+	// any, regions never span several profiles
+	profile *profileBlock
+	// start and end are the line span [start, end) covered by the region
+	start int
+	end   int
+	rules []string
+	// lines are the 1-based line numbers of the rules
+	lines []int
+	// indent is the indentation of the rules, which the generated block
+	// keeps, and aligned is set if their permissions were aligned
+	indent  string
+	aligned bool
+
+	// annotations are those of the rules by line number, nil if the
+	// profile is not annotated
+	annotations map[int]annotations
+
+	// outStart and generated describe the block that replaced the region
+	// in the output
+	outStart  int
+	generated []string
+}
+
+// prefixSet selects the rules below one of the directory prefixes being
+// optimized
+type prefixSet struct {
+	paths []string
+	// variables are resolved before checking whether a rule is below a
+	// prefix, so @{sys}/devices/... is below /sys/devices
+	variables map[string][]string
+}
+
+// selectPrefix returns the prefix every path matched by the rule on the
+// line is below, if any. The qualifiers of the rule are skipped, so owner
+// and audit deny rules are selected as well. When prefixes nest, like /sys
+// and /sys/devices/virtual, the deepest one the rule is below wins, so
+// every rule belongs to exactly one region.
+func (ps *prefixSet) selectPrefix(tl string) (string, bool) {
+	path, ok := rulePath(tl)
+	if !ok {
+		return "", false
+	}
+
+	resolved := []string{path}
+	if strings.Contains(path, "@{") {
+		resolved = resolveVariable(path, ps.variables, 0)
+	}
+	best, found := "", false
+	for _, p := range ps.paths {
+		if found && prefixDepth(p) <= prefixDepth(best) {
+			continue
+		}
+		if strings.Contains(p, "@{") {
+			// a prefix using variables can only be matched as written
+			if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+				best, found = p, true
+			}
+			continue
+		}
+		below := len(resolved) > 0
+		for _, r := range resolved {
+			for strings.Contains(r, "//") {
+				r = strings.ReplaceAll(r, "//", "/")
+			}
+			if strings.Contains(r, "@{") || !underPrefix(r, p) {
+				below = false
+				break
+			}
+		}
+		if below {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+// prefixDepth is the number of path components of the prefix
+func prefixDepth(p string) int {
+	return strings.Count(strings.Trim(p, "/"), "/") + 1
+}
+
+// findRegions splits the lines into regions. Blank lines do not end a
+// region, but any other line, a pinned rule or a rule for a different
+// prefix does. Comments within a block generated by an earlier run do not
+// end a region either, and the region grows to replace the whole block.
+// Neither do interface comments, the generated rules carry them instead.
+func findRegions(lines []string, prefixes *prefixSet, pinned map[int]string, markers *blockMarkers) []*region {
+	spans := markers.generatedSpans(lines)
+	generated := make([]bool, len(lines))
+	for _, s := range spans {
+		for i := s.start; i < s.end; i++ {
+			generated[i] = true
+		}
+	}
+
+	_, owners := findProfiles(lines)
+	var regions []*region
+	var current *region
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		p, ok := prefixes.selectPrefix(tl)
+		if _, isPinned := pinned[i]; !ok || isPinned {
+			if tl != "" && !(generated[i] && strings.HasPrefix(tl, "#")) && !isInterfaceComment(tl) {
+				current = nil
+			}
+			continue
+		}
+
+		if current == nil || current.prefix != p || current.profile != owners[i] {
+			current = &region{prefix: p, profile: owners[i], start: i, indent: l[:len(l)-len(strings.TrimLeft(l, " \t"))]}
+			regions = append(regions, current)
+		}
+		current.end = i + 1
+		current.rules = append(current.rules, tl)
+		current.lines = append(current.lines, i+1)
+	}
+
+	for _, r := range regions {
+		r.aligned = columnsAligned(lines, r.lines)
+		// the header of a block generated by an earlier run, and the
+		// stamp below it, are replaced along with the rules, so
+		// optimizing the output again does not pile up headers
+		start := r.start
+		for start > 0 && stampLine.MatchString(lines[start-1]) {
+			start--
+		}
+		if start > 0 && markers.headerPattern.MatchString(lines[start-1]) {
+			r.start = start - 1
+			if r.start > 0 && strings.TrimSpace(lines[r.start-1]) == "" {
+				r.start--
+			}
+		}
+		for _, s := range spans {
+			if s.start >= r.end || s.end <= r.start {
+				continue
+			}
+			if s.start < r.start {
+				r.start = s.start
+				// the blank line put in front of the header
+				if r.start > 0 && strings.TrimSpace(lines[r.start-1]) == "" {
+					r.start--
+				}
+			}
+			if s.end > r.end {
+				r.end = s.end
+			}
+		}
+	}
+	return regions
+}
+
+// options controls how the profile is optimized
+type options struct {
+	// file the lines were read from
+	file     string
+	prefixes *prefixSet
+	// keepOriginal is either empty, "comments" or "file"
+	keepOriginal string
+	// align is either "none", "block" or "file"
+	align string
+	// sort is one of sortStrategies
+	sort string
+	// groupTemplate is the section comment of each permission group, the
+	// generated rules are not grouped if nil
+	groupTemplate *template.Template
+	markers       *blockMarkers
+	forbidden     []string
+	// exclude matches the rules that are left as they are
+	exclude []*regexp.Regexp
+	// onlyPerms holds the canonical permission sets of the rules that are
+	// optimized, every set is if empty
+	onlyPerms map[string]bool
+
+	mergeSubsetPerms bool
+	// generalizeHome folds the user directories below /home onto /home/*,
+	// widening the rules
+	generalizeHome bool
+	// foldPids folds the process ids below /proc onto a pattern matching
+	// any of them, widening the rules
+	foldPids bool
+	// foldUdev folds the minors of the udev device data onto a pattern
+	// matching any of them, widening the rules
+	foldUdev bool
+	// bareRules is either "error", "pass" or "assume", in which case the
+	// rule gets barePerms
+	bareRules string
+	barePerms string
+	// minDepth is the first path component generated rules may have
+	// wildcards or alternations in
+	minDepth int
+	// maxGlobstars is the most ** a generated rule may have, 0 means no
+	// limit
+	maxGlobstars int
+	// folds are the patterns siblings matching them are folded onto
+	folds []string
+	// foldSingleChar is how many siblings differing in a single
+	// character are folded onto a ?, 0 disables folding
+	foldSingleChar int
+	// fsRoot is the directory the paths are relative to on this system
+	// if directory entries may be folded onto negated classes
+	fsRoot string
+	// jobs is how many trees are optimized at the same time
+	jobs int
+	// compactTrees ingests the rules into arenas rather than leaf trees
+	compactTrees bool
+	// progress is reported to during long runs, nil if disabled
+	progress *progress
+	// run tracks whether the run was interrupted and the passes to skip
+	// when resuming, nil to always run every pass
+	run *runState
+	// maxLineLength splits generated rules longer than this, 0 means no
+	// limit
+	maxLineLength int
+	// maxExpansion splits generated rules whose alternations expand into
+	// more patterns than this, 0 means no limit
+	maxExpansion int
+	// tunables the generated rules are refolded onto, nil if disabled
+	tunables []tunablePrefix
+	// treeCache is the directory optimized trees are cached in for
+	// incremental runs, empty if disabled
+	treeCache string
+	// splitThreshold moves the generated blocks of profiles with more
+	// rules than this into include files, 0 disables splitting
+	splitThreshold int
+	// hot are the paths the passes keep out of alternations and
+	// wildcards, nil if no access frequencies were given
+	hot map[string]bool
+	// strict fails the run if a selected rule cannot be parsed as it is,
+	// rather than passing it through or fixing it up
+	strict bool
+	// lossless verifies the rules generated for each region grant
+	// exactly what the original rules did, leaving the region in place
+	// otherwise
+	lossless bool
+	// fragment is set if the lines are a bare list of rules, in which
+	// case the generated rules are not indented
+	fragment bool
+	// maxGrowth and minReduction, in percent, decide whether the optimized
+	// profile is worth replacing the original one, -1 disables them
+	maxGrowth    float64
+	minReduction float64
+	// transformed is called for every transformation made to the rules
+	// if set
+	transformed func(tx transformation)
+}
+
+// defaultOptions returns the options the main command uses when given no
+// flags, for the commands that optimize their result along the way
+func defaultOptions(file string, prefixes *prefixSet) *options {
+	markers, _ := newBlockMarkers(defaultHeader, "")
+	return &options{
+		file:         file,
+		prefixes:     prefixes,
+		align:        "none",
+		sort:         "lexical",
+		markers:      markers,
+		bareRules:    "pass",
+		maxGrowth:    -1,
+		minReduction: -1,
+	}
+}
+
+// handleBareRules applies opts.bareRules to the selected rules without any
+// permissions. Rules passed through are added to pinned, assumed rules
+// are rewritten in the returned lines.
+func handleBareRules(lines []string, opts *options, pinned map[int]string) ([]string, error) {
+	var ingest []string
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		if _, ok := opts.prefixes.selectPrefix(tl); !ok || !isBareRule(tl) {
+			continue
+		}
+		if _, isPinned := pinned[i]; isPinned {
+			continue
+		}
+
+		switch opts.bareRules {
+		case "error":
+			return nil, fmt.Errorf("line %d: rule %q has no permissions", i+1, tl)
+		case "assume":
+			if ingest == nil {
+				ingest = append([]string(nil), lines...)
+			}
+			ingest[i] = fmt.Sprintf("%s %s,", strings.TrimSuffix(strings.TrimSpace(stripComment(tl)), ","), opts.barePerms)
+			fmt.Printf("aaoptimizer: line %d: rule %q has no permissions, assuming %s\n", i+1, tl, opts.barePerms)
+		default:
+			pinned[i] = "rule has no permissions"
+			fmt.Printf("aaoptimizer: line %d: rule %q has no permissions, leaving it in place\n", i+1, tl)
+		}
+	}
+	if ingest == nil {
+		return lines, nil
+	}
+	return ingest, nil
+}
+
+// underPrefix reports whether every path the pattern matches is below
+// the directory prefix, or the prefix itself
+func underPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if path == prefix || path == prefix+"/" {
+		return true
+	}
+	// most rules spell the prefix out, which needs no matching
+	if strings.HasPrefix(path, prefix+"/") && isLiteralPath(prefix) {
+		return true
+	}
+	return aare.Covers(prefix+"/**", path)
+}
+
+// straddlesPrefix reports whether the pattern matches paths both below
+// the directory prefix and outside of it, i.e /sys/{devices,class}/** for
+// /sys/devices. The prefix itself counts as below it, so patterns like
+// /sys/devices{,/**} do not straddle it.
+func straddlesPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return !aare.Covers(prefix+"{,/,/**}", path) && aare.Intersects(path, prefix+"{,/**}")
+}
+
+// warnStraddling warns about the rules that are only partly below one of
+// the prefixes, these are never selected and so left in place
+func warnStraddling(lines []string, prefixes *prefixSet) {
+	for i, l := range lines {
+		pr, ok := parseProfileRule(i+1, l)
+		if !ok || !pr.isFile() {
+			continue
+		}
+		if _, ok := prefixes.selectPrefix(l); ok {
+			continue
+		}
+		for _, p := range prefixes.paths {
+			if straddlesPrefix(pr.path, p) {
+				fmt.Printf("aaoptimizer: line %d: %q is only partly below %s, leaving it in place\n", i+1, pr.text, p)
+				break
+			}
+		}
+	}
+}
+
+// pinUnparseable pins the selected rules the optimizer cannot parse, so
+// they are left in place instead of being dropped, and reports the rules
+// it had to fix up. It returns the 1-based lines of the rules it pinned
+// and of those it fixed up.
+func pinUnparseable(lines []string, prefixes *prefixSet, pinned map[int]string) (unparseable, fixedUp []int) {
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		if _, ok := prefixes.selectPrefix(tl); !ok {
+			continue
+		}
+		if _, isPinned := pinned[i]; isPinned {
+			continue
+		}
+		if _, err := newRule(tl); err != nil {
+			pinned[i] = err.Error()
+			unparseable = append(unparseable, i+1)
+			fmt.Printf("aaoptimizer: line %d: %v, leaving it in place\n", i+1, err)
+			continue
+		}
+		if !strings.HasSuffix(strings.TrimSpace(stripComment(tl)), ",") {
+			fixedUp = append(fixedUp, i+1)
+			fmt.Printf("aaoptimizer: line %d: %q lacks the trailing comma\n", i+1, tl)
+		}
+		if pr, ok := parseProfileRule(i+1, tl); ok {
+			if _, resolved := resolveAppendWrite(pr.perms); resolved {
+				fixedUp = append(fixedUp, i+1)
+				fmt.Printf("aaoptimizer: line %d: %q has both w and a, which conflict, using w\n", i+1, tl)
+			}
+		}
+	}
+	return unparseable, fixedUp
+}
+
+func lineList(lines []int) string {
+	var numbers []string
+	for _, n := range lines {
+		numbers = append(numbers, strconv.Itoa(n))
+	}
+	return strings.Join(numbers, ", ")
+}
+
+// warnUnparseable summarizes the rules left in place because they could
+// not be parsed, so none of them goes unnoticed
+func warnUnparseable(lines []int) {
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Printf("aaoptimizer: %d rules could not be parsed and were passed through as they are, on lines %s\n", len(lines), lineList(lines))
+}
+
+// strictError fails a --strict run over rules that could not be parsed as
+// they are
+func strictError(unparseable, fixedUp []int) error {
+	var reasons []string
+	if len(unparseable) > 0 {
+		reasons = append(reasons, "rules on lines "+lineList(unparseable)+" could not be parsed")
+	}
+	if len(fixedUp) > 0 {
+		reasons = append(reasons, "rules on lines "+lineList(fixedUp)+" had to be fixed up")
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return fmt.Errorf("strict mode: %s", strings.Join(reasons, " and "))
+}
+
+// optimizeLines runs the optimizer over every region of rules matching one
+// of the prefixes and returns the lines with each region replaced by its
+// generated block, along with the regions that were replaced.
+func optimizeLines(lines []string, opts *options) ([]string, []*region, error) {
+	prefixes := opts.prefixes
+	if line, msg := catchAllWarning(parseProfileRules(lines)); msg != "" {
+		fmt.Printf("aaoptimizer: line %d: %s\n", line, msg)
+	}
+
+	pinned := orderSensitiveLines(lines, prefixes)
+	for i := range lines {
+		if reason, ok := pinned[i]; ok {
+			fmt.Printf("aaoptimizer: line %d is order sensitive, leaving it in place: %s\n", i+1, reason)
+		}
+	}
+
+	pinKept(lines, prefixes, pinned)
+	pinExcluded(lines, opts, pinned)
+	pinPerms(lines, opts, pinned)
+	warnStraddling(lines, prefixes)
+
+	ingest, err := handleBareRules(lines, opts, pinned)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unparseable, fixedUp := pinUnparseable(ingest, prefixes, pinned)
+	if opts.strict {
+		if err := strictError(unparseable, fixedUp); err != nil {
+			return nil, nil, err
+		}
+	}
+	warnUnparseable(unparseable)
+
+	annotated := ruleAnnotations(ingest)
+
+	var out []string
+	var regions []*region
+	last := 0
+	for _, r := range findRegions(ingest, prefixes, pinned, opts.markers) {
+		r.annotations = annotated
+		if opts.run != nil && opts.run.outOfTime() {
+			fmt.Printf("aaoptimizer: lines %d-%d: out of time, leaving them in place\n", r.start+1, r.end)
+			opts.run.timedOut.Store(true)
+			continue
+		}
+		trees := optimizeRegion(r, opts)
+		if opts.lossless {
+			if err := verifyLossless(r, trees); err != nil {
+				fmt.Printf("aaoptimizer: lines %d-%d: %v, leaving them in place\n", r.start+1, r.end, err)
+				continue
+			}
+		}
+
+		out = append(out, lines[last:r.start]...)
+		r.outStart = len(out)
+		r.generated, err = generateBlock(trees, r, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		// profiles written by aa-genprof and aa-logprof already have a
+		// blank line in front of the rules
+		if r.start > 0 && strings.TrimSpace(lines[r.start-1]) == "" && r.generated[0] == "" {
+			r.generated = r.generated[1:]
+		}
+		out = append(out, r.generated...)
+		last = r.end
+		regions = append(regions, r)
+	}
+	out = append(out, lines[last:]...)
+
+	if opts.align == "file" {
+		width := alignWidth(out)
+		alignLines(out, width)
+		for _, r := range regions {
+			alignLines(r.generated, width)
+		}
+	} else if err := checkUntouched(lines, out, regions); err != nil {
+		return nil, nil, fmt.Errorf("self-check failed: %v", err)
+	}
+	return out, regions, nil
+}
+
+// checkUntouched verifies every line outside the regions made it into the
+// output exactly as it was, around the generated blocks
+func checkUntouched(lines, out []string, regions []*region) error {
+	last, outLast := 0, 0
+	compare := func(start, end, outStart int) error {
+		if outStart+end-start > len(out) {
+			return fmt.Errorf("lines %d-%d are missing from the output", start+1, end)
+		}
+		for i := start; i < end; i++ {
+			if lines[i] != out[outStart+i-start] {
+				return fmt.Errorf("line %d changed from %q to %q", i+1, lines[i], out[outStart+i-start])
+			}
+		}
+		return nil
+	}
+	for _, r := range regions {
+		if err := compare(last, r.start, outLast); err != nil {
+			return err
+		}
+		last, outLast = r.end, r.outStart+len(r.generated)
+	}
+	if err := compare(last, len(lines), outLast); err != nil {
+		return err
+	}
+	if outLast+len(lines)-last != len(out) {
+		return fmt.Errorf("the output has %d lines more than expected", len(out)-outLast-len(lines)+last)
+	}
+	return nil
+}
+
+// optimizeRegion runs the optimizer over the rules of the region and
+// returns the optimized rules of each bucket. With the tree cache enabled,
+// only the buckets whose rules changed since an earlier run are optimized.
+func optimizeRegion(r *region, opts *options) map[bucket][]string {
+	aa := opts.optimizer()
+	if opts.transformed != nil {
+		aa.onTransform = func(tx transformation) {
+			r.logTransformation(opts, tx)
+		}
+	}
+
+	// subset merging works across buckets, so they cannot be cached on
+	// their own
+	if opts.treeCache == "" || opts.mergeSubsetPerms {
+		for _, rl := range r.rules {
+			if err := aa.addRule(rl); err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+			}
+		}
+		aa.optimize()
+
+		trees := make(map[bucket][]string)
+		for _, b := range aa.buckets() {
+			trees[b] = aa.formatBucket(b)
+		}
+		return trees
+	}
+
+	rulesByBucket := make(map[bucket][]string)
+	var markedFolds []string
+	for _, rl := range r.rules {
+		rr, err := newRule(rl)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			continue
+		}
+		if rr.fold != "" {
+			markedFolds = append(markedFolds, rl)
+		}
+		if rr.deny {
+			continue
+		}
+		b := rr.bucket()
+		rulesByBucket[b] = append(rulesByBucket[b], rl)
+	}
+	sort.Strings(markedFolds)
+
+	trees := make(map[bucket][]string)
+	pending := make(map[bucket]string)
+	for b, rules := range rulesByBucket {
+		key := treeCacheKey(b, rules, opts, markedFolds)
+		if cached, ok := cacheLookup(opts.treeCache, key); ok {
+			trees[b] = cached
+			continue
+		}
+		for _, rl := range rules {
+			aa.addRule(rl)
+		}
+		pending[b] = key
+	}
+	if len(pending) == 0 {
+		return trees
+	}
+
+	aa.optimize()
+	for b, key := range pending {
+		trees[b] = aa.formatBucket(b)
+		if err := cacheStore(opts.treeCache, key, trees[b]); err != nil {
+			fmt.Printf("aaoptimizer: cannot cache result: %v\n", err)
+		}
+	}
+	return trees
+}
+
+// optimizer returns an optimizer set up according to the options
+func (opts *options) optimizer() *aaOptimizer {
+	aa := newAaOptimizer()
+	aa.forbidden = opts.forbidden
+	aa.mergeSubsetPerms = opts.mergeSubsetPerms
+	aa.pidVariable = opts.tunables != nil
+	aa.generalizeHome = opts.generalizeHome
+	aa.foldPids = opts.foldPids
+	aa.foldUdev = opts.foldUdev
+	aa.minDepth = opts.minDepth
+	aa.maxGlobstars = opts.maxGlobstars
+	aa.foldSingleChar = opts.foldSingleChar
+	aa.foldPatterns = opts.folds
+	aa.fsRoot = opts.fsRoot
+	aa.jobs = opts.jobs
+	aa.progress = opts.progress
+	aa.run = opts.run
+	aa.hot = opts.hot
+	if opts.compactTrees {
+		aa.arenas = make(map[bucket]*treeArena)
+	}
+	return aa
+}
+
+// coveredLines returns the lines of the rules of the region that are
+// covered by one of the rules given
+func (r *region) coveredLines(rules []string) []int {
+	type parsed struct {
+		b    bucket
+		path string
+	}
+	parse := func(rl string) (parsed, bool) {
+		rr, err := newRule(rl)
+		pr, ok := parseProfileRule(0, rl)
+		if err != nil || !ok || !pr.isFile() {
+			return parsed{}, false
+		}
+		// the generated rules only carry their group once annotated
+		b := rr.bucket()
+		b.group = ""
+		return parsed{b, pr.path}, true
+	}
+
+	var covering []parsed
+	for _, rl := range rules {
+		if p, ok := parse(rl); ok {
+			covering = append(covering, p)
+		}
+	}
+	var lines []int
+	for i, rl := range r.rules {
+		p, ok := parse(rl)
+		if !ok {
+			continue
+		}
+		for _, c := range covering {
+			if c.b == p.b && aare.Covers(c.path, p.path) {
+				lines = append(lines, r.lines[i])
+				break
+			}
+		}
+	}
+	return lines
+}
+
+// logTransformation passes the transformation made to the rules of the
+// region on to opts.transformed, if set
+func (r *region) logTransformation(opts *options, tx transformation) {
+	if opts.transformed == nil {
+		return
+	}
+	tx.File = opts.file
+	tx.Prefix = r.prefix
+	tx.Lines = r.coveredLines(tx.Inputs)
+	opts.transformed(tx)
+}
+
+// generateBlock renders the optimized rules of each bucket into the block
+// that replaces the region
+func generateBlock(trees map[bucket][]string, r *region, opts *options) ([]string, error) {
+	info := newBlockInfo(r)
+	block := []string{"", renderMarker(opts.markers.header, info)}
+
+	refolded := func(tx transformation) {
+		r.logTransformation(opts, tx)
+	}
+	ro := renderOptions{
+		indent:        "  ",
+		align:         opts.align == "block" || (opts.align == "none" && r.aligned),
+		sort:          opts.sort,
+		original:      r.rules,
+		group:         opts.groupTemplate,
+		prefix:        r.prefix,
+		maxLineLength: opts.maxLineLength,
+		maxExpansion:  opts.maxExpansion,
+	}
+	if len(opts.tunables) > 0 {
+		ro.refold = func(rules []string) []string {
+			return refoldTunables(rules, opts.tunables, refolded)
+		}
+	}
+	if r.annotations != nil {
+		ro.annotate = r.annotate
+	}
+	rules, err := renderLines(bucketRules(trees), ro)
+	if err != nil {
+		return nil, err
+	}
+	block = append(block, rules...)
+
+	if opts.keepOriginal == "comments" {
+		for _, rl := range r.rules {
+			block = append(block, "  # original: "+rl)
+		}
+	}
+	if opts.markers.footer != nil {
+		block = append(block, renderMarker(opts.markers.footer, info))
+	}
+	indent := r.indent
+	if opts.fragment {
+		indent = ""
+	}
+	if indent != "  " {
+		for i, l := range block {
+			if strings.HasPrefix(l, "  ") {
+				block[i] = indent + l[2:]
+			}
+		}
+	}
+	return block, nil
+}
+
+// originalLines returns the lines replaced by the regions, each region
+// introduced by a comment with its original line span
+func originalLines(lines []string, regions []*region) []string {
+	var orig []string
+	for _, r := range regions {
+		orig = append(orig, fmt.Sprintf("# lines %d-%d", r.start+1, r.end))
+		orig = append(orig, lines[r.start:r.end]...)
+	}
+	return orig
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStraddlesPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"/sys/devices/a", false},
+		{"/sys/devices", false},
+		{"/sys/devices/", false},
+		{"/sys/devices/**", false},
+		{"/sys/devices{,/**}", false},
+		{"/sys/devices{,/}", false},
+		{"/sys/{devices,class}/**", true},
+		{"/sys/**", true},
+		{"/sys/devices*/**", true},
+		{"/sys/class/**", false},
+	} {
+		if got := straddlesPrefix(tc.path, "/sys/devices"); got != tc.want {
+			t.Errorf("straddlesPrefix(%q) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
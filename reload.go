@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// shellQuote quotes the string for use as a single word in sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runReload runs the reload command through sh, with %f replaced by the
+// written file
+func runReload(command, path string) error {
+	command = strings.ReplaceAll(command, "%f", shellQuote(path))
+	fmt.Printf("reloading: %s\n", command)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("reload command failed: %v", err)
+	}
+	return nil
+}
+
+// unchanged returns whether the file already holds the lines, files that
+// are not regular are never considered unchanged
+func unchanged(path string, lines []string) bool {
+	if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	current, err := readLines(path)
+	if err != nil || len(current) != len(lines) {
+		return false
+	}
+	for i := range lines {
+		if current[i] != lines[i] {
+			return false
+		}
+	}
+	return true
+}
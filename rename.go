@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// profileHeader matches the opening line of a profile, the groups are the
+// indentation, the profile keyword, the name, the attachment, the flags
+// and whatever follows the brace
+var profileHeader = regexp.MustCompile(`^(\s*)(profile\s+)?(\S+)(?:\s+((?:/|@\{)\S*))?(\s*(?:flags\s*=\s*)?\([^)]*\))?\s*\{(.*)$`)
+
+// renameHeader rewrites the name of the profile opened by the line, and
+// the attachment if attach is set, keeping its flags. The boolean is false
+// if the line does not open a profile named from.
+func renameHeader(l, from, to, attach string) (string, bool) {
+	m := profileHeader.FindStringSubmatch(l)
+	if m == nil || m[3] != from {
+		return l, false
+	}
+	indent, keyword, attachment, flags, rest := m[1], m[2], m[4], m[5], m[6]
+
+	if keyword == "" && (attach != "" || !strings.HasPrefix(to, "/")) {
+		// a profile named after its path attaches to it, keep doing so
+		// under the new name
+		keyword = "profile "
+		if attachment == "" {
+			attachment = from
+		}
+	}
+	if attach != "" {
+		attachment = attach
+	}
+
+	header := indent + keyword + to
+	if attachment != "" {
+		header += " " + attachment
+	}
+	return header + flags + " {" + rest, true
+}
+
+// renameTargets rewrites the exec and change_profile targets of the line
+// naming the profile, or one of its children
+func renameTargets(l, from, to string) (string, bool) {
+	i := strings.Index(l, "->")
+	if i < 0 || ruleKind(l) == "" {
+		return l, false
+	}
+	target := strings.TrimSpace(stripComment(l[i+2:]))
+	name := strings.TrimSuffix(target, ",")
+	if name != from && !strings.HasPrefix(name, from+"//") {
+		return l, false
+	}
+	renamed := to + strings.TrimPrefix(name, from)
+	return l[:i+2] + strings.Replace(l[i+2:], name, renamed, 1), true
+}
+
+// renameProfile renames the profile in the lines, updating the references
+// to it, and returns how many lines were changed
+func renameProfile(lines []string, from, to, attach string) ([]string, int) {
+	renamed := make([]string, len(lines))
+	changed := 0
+	for i, l := range lines {
+		nl, ok := renameHeader(l, from, to, attach)
+		if !ok {
+			nl, ok = renameTargets(l, from, to)
+		}
+		if ok {
+			changed++
+		}
+		renamed[i] = nl
+	}
+	return renamed, changed
+}
+
+func renameMain(args []string) {
+	fs := flag.NewFlagSet("rename", flag.ExitOnError)
+	from := fs.String("from", "", "name of the profile to rename")
+	to := fs.String("to", "", "new name of the profile")
+	attach := fs.String("attach", "", "new attachment path of the profile, kept as it is if not given")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer rename [flags] [profile] [output]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 || *from == "" || *to == "" {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	output := input
+	if fs.NArg() > 1 {
+		output = fs.Arg(1)
+	}
+
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	renamed, changed := renameProfile(lines, *from, *to, *attach)
+	if changed == 0 {
+		fmt.Printf("aaoptimizer: no profile named %s in %s\n", *from, input)
+		os.Exit(1)
+	}
+	if err := writeLines(renamed, output); err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	fmt.Printf("renamed %s to %s, %d lines changed\n", *from, *to, changed)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRenameProfile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		line string
+		// from is foo unless set
+		from   string
+		attach string
+		want   string
+	}{
+		{name: "keeps attachment and flags", line: "profile foo /usr/bin/foo flags=(attach_disconnected) {", want: "profile bar /usr/bin/foo flags=(attach_disconnected) {"},
+		{name: "new attachment", line: "profile foo /usr/bin/foo flags=(complain) {", attach: "/usr/bin/bar", want: "profile bar /usr/bin/bar flags=(complain) {"},
+		{name: "flags without attachment", line: "  profile foo (attach_disconnected) {", want: "  profile bar (attach_disconnected) {"},
+		{name: "named after its path", line: "/usr/bin/foo {", from: "/usr/bin/foo", want: "profile bar /usr/bin/foo {"},
+		{name: "named after another path", line: "/usr/bin/foo {", want: "/usr/bin/foo {"},
+		{name: "other profile", line: "profile foobar /usr/bin/foobar {", want: "profile foobar /usr/bin/foobar {"},
+		{name: "exec target", line: "  /usr/bin/foo Px -> foo,", want: "  /usr/bin/foo Px -> bar,"},
+		{name: "exec target of a child", line: "  /usr/bin/foo Cx -> foo//child, # comment", want: "  /usr/bin/foo Cx -> bar//child, # comment"},
+		{name: "change_profile", line: "  change_profile -> foo,", want: "  change_profile -> bar,"},
+		{name: "other target", line: "  /usr/bin/foo Px -> foobar,", want: "  /usr/bin/foo Px -> foobar,"},
+		{name: "rule without target", line: "  /usr/bin/foo r,", want: "  /usr/bin/foo r,"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			from := tc.from
+			if from == "" {
+				from = "foo"
+			}
+			renamed, _ := renameProfile([]string{tc.line}, from, "bar", tc.attach)
+			if renamed[0] != tc.want {
+				t.Errorf("got %q, want %q", renamed[0], tc.want)
+			}
+		})
+	}
+}
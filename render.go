@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// bucketSource holds the optimized rules of each bucket, either as the
+// trees of an optimizer or as rules read back from the cache
+type bucketSource interface {
+	// buckets returns the buckets in the order they are written
+	buckets() []bucket
+	// walkBucket calls fn with every rule of the bucket, in lexical order
+	// of their paths like --sort lexical orders them
+	walkBucket(b bucket, fn func(l string))
+}
+
+// bucketRules are the formatted rules of each bucket
+type bucketRules map[bucket][]string
+
+func (br bucketRules) buckets() []bucket {
+	var buckets []bucket
+	for b := range br {
+		buckets = append(buckets, b)
+	}
+	sortBuckets(buckets)
+	return buckets
+}
+
+func (br bucketRules) walkBucket(b bucket, fn func(l string)) {
+	rules := append([]string(nil), br[b]...)
+	sortRules(rules, "lexical", nil)
+	for _, l := range rules {
+		fn(l)
+	}
+}
+
+// renderOptions controls how render writes the optimized rules
+type renderOptions struct {
+	// indent replaces the two spaces the rules are indented with
+	indent string
+	// align pads the paths so the permissions of all rules start at the
+	// same column
+	align bool
+	// sort is the sorting strategy of --sort, applied to the rules of
+	// each group comment or marker group, empty keeps the order of the
+	// source. original are the rules optimized, for original-first-seen.
+	sort     string
+	original []string
+	// group is the template of the comment put in front of the rules of
+	// each bucket, nil to not group them, and prefix the prefix it is
+	// rendered for
+	group  *template.Template
+	prefix string
+	// maxLineLength wraps longer rules by splitting their alternations,
+	// 0 disables it
+	maxLineLength int
+	// maxExpansion splits rules whose alternations expand into more
+	// patterns, 0 disables it
+	maxExpansion int
+	// refold rewrites the rules of each bucket, like refoldTunables, and
+	// annotate appends the trailing comments of the rules, nil for none
+	refold   func(rules []string) []string
+	annotate func(rules []string)
+}
+
+// streamed reports whether the rules can be written straight from the
+// source, one by one, as nothing needs the rules of a segment together.
+// The sources walk their buckets in lexical order, which the buckets of a
+// segment are merged in.
+func (opts *renderOptions) streamed() bool {
+	return (opts.sort == "" || opts.sort == "lexical") && opts.maxExpansion <= 0 && opts.refold == nil && opts.annotate == nil
+}
+
+// mergeBuckets calls fn with the rules of the buckets of the segment in
+// lexical order of their paths, walking the buckets side by side. Rules
+// with the same path keep the order of their buckets, like the stable
+// sort of sortRules.
+func mergeBuckets(src bucketSource, segment []bucket, fn func(l string)) {
+	if len(segment) == 1 {
+		src.walkBucket(segment[0], fn)
+		return
+	}
+	type walk struct {
+		rules chan string
+		rule  string
+		path  string
+		ok    bool
+	}
+	next := func(w *walk) {
+		w.rule, w.ok = <-w.rules
+		if w.ok {
+			pr, _ := parseProfileRule(0, w.rule)
+			w.path = pr.path
+		}
+	}
+	walks := make([]*walk, len(segment))
+	for i, b := range segment {
+		w := &walk{rules: make(chan string, 64)}
+		walks[i] = w
+		go func(b bucket) {
+			src.walkBucket(b, func(l string) {
+				w.rules <- l
+			})
+			close(w.rules)
+		}(b)
+		next(w)
+	}
+	for {
+		var first *walk
+		for _, w := range walks {
+			if w.ok && (first == nil || w.path < first.path) {
+				first = w
+			}
+		}
+		if first == nil {
+			return
+		}
+		fn(first.rule)
+		next(first)
+	}
+}
+
+// segments splits the buckets into the runs of buckets written together:
+// one per group comment, otherwise one per marker group, so the rules of
+// a marker group are sorted together and stay together
+func (opts *renderOptions) segments(buckets []bucket) [][]bucket {
+	var segments [][]bucket
+	for i, b := range buckets {
+		if i == 0 || opts.group != nil || buckets[i-1].group != b.group {
+			segments = append(segments, nil)
+		}
+		segments[len(segments)-1] = append(segments[len(segments)-1], b)
+	}
+	return segments
+}
+
+// process collects the rules of the segment, and refolds, sorts, wraps,
+// splits and annotates them
+func (opts *renderOptions) process(src bucketSource, segment []bucket) ([]string, error) {
+	var rules []string
+	for _, b := range segment {
+		var bucketRules []string
+		src.walkBucket(b, func(l string) {
+			bucketRules = append(bucketRules, l)
+		})
+		if opts.refold != nil {
+			bucketRules = opts.refold(bucketRules)
+		}
+		rules = append(rules, bucketRules...)
+	}
+	if opts.sort != "" {
+		sortRules(rules, opts.sort, opts.original)
+	}
+	rules = wrapRules(rules, opts.maxLineLength)
+	rules, err := limitExpansion(rules, opts.maxExpansion)
+	if err != nil {
+		return nil, err
+	}
+	if opts.annotate != nil {
+		opts.annotate(rules)
+	}
+	return rules, nil
+}
+
+// render writes the rules of every bucket to w. Unless a sorting other
+// than lexical or the other options needing the rules of a segment
+// together are used, they are written one by one straight from the source
+// rather than collected first, and alignment walks the source twice to
+// find the column.
+func render(w io.Writer, src bucketSource, opts renderOptions) error {
+	segments := opts.segments(src.buckets())
+
+	// the rules of each segment, unless streamed
+	var processed [][]string
+	streamed := opts.streamed()
+	if !streamed {
+		for _, segment := range segments {
+			rules, err := opts.process(src, segment)
+			if err != nil {
+				return err
+			}
+			processed = append(processed, rules)
+		}
+	}
+	eachRule := func(i int, fn func(l string)) {
+		if !streamed {
+			for _, l := range processed[i] {
+				fn(l)
+			}
+			return
+		}
+		mergeBuckets(src, segments[i], func(l string) {
+			for _, wl := range wrapRules([]string{l}, opts.maxLineLength) {
+				fn(wl)
+			}
+		})
+	}
+
+	width := 0
+	if opts.align {
+		for i := range segments {
+			eachRule(i, func(l string) {
+				if head, _, ok := splitRuleColumns(l); ok && len(head) > width {
+					width = len(head)
+				}
+			})
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	emit := func(l string) {
+		if opts.align {
+			if head, rest, ok := splitRuleColumns(l); ok {
+				l = head + strings.Repeat(" ", width-len(head)+1) + rest
+			}
+		}
+		if opts.indent != "  " && strings.HasPrefix(l, "  ") {
+			l = opts.indent + l[2:]
+		}
+		bw.WriteString(l)
+		bw.WriteByte('\n')
+	}
+
+	for i, segment := range segments {
+		if opts.group != nil {
+			count := 0
+			eachRule(i, func(string) { count++ })
+			if count == 0 {
+				continue
+			}
+			emit(groupComment(opts.group, opts.prefix, segment[0], count))
+		}
+		eachRule(i, emit)
+	}
+	return bw.Flush()
+}
+
+// renderLines renders the rules into lines
+func renderLines(src bucketSource, opts renderOptions) ([]string, error) {
+	var sb strings.Builder
+	if err := render(&sb, src, opts); err != nil {
+		return nil, err
+	}
+	if sb.Len() == 0 {
+		return nil, nil
+	}
+	return strings.Split(strings.TrimSuffix(sb.String(), "\n"), "\n"), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// runState tracks interruptions of a run, it is shared by the optimizers
+// of every region
+type runState struct {
+	interrupted atomic.Bool
+	// skip is the number of passes a resumed run skips, having completed
+	// them before being interrupted
+	skip int
+
+	mu sync.Mutex
+	// completed is the fewest passes any region completed, -1 if no region
+	// was optimized
+	completed int
+
+	// deadline is when the run is out of time, passes are skipped from
+	// then on and timedOut is set once one was. Zero means no limit.
+	deadline time.Time
+	timedOut atomic.Bool
+}
+
+func newRunState() *runState {
+	return &runState{completed: -1}
+}
+
+// handleInterrupts lets the current pass finish on the first SIGINT or
+// SIGTERM, skipping the others so the partial result can be written. A
+// second one ends the program right away through exit.
+func (rs *runState) handleInterrupts(exit func(code int)) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		fmt.Println("aaoptimizer: interrupted, finishing the current pass")
+		rs.interrupted.Store(true)
+		<-c
+		exit(1)
+	}()
+}
+
+// reset starts tracking the run of another output, skipping the passes
+// completed before resuming it
+func (rs *runState) reset(skip int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.skip = skip
+	rs.completed = -1
+	rs.timedOut.Store(false)
+}
+
+// outOfTime reports whether the deadline of the run passed
+func (rs *runState) outOfTime() bool {
+	return !rs.deadline.IsZero() && time.Now().After(rs.deadline)
+}
+
+func (rs *runState) finished(passes int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.completed < 0 || passes < rs.completed {
+		rs.completed = passes
+	}
+}
+
+// startPass announces the pass about to run, returning false if it is to
+// be skipped because it completed before resuming, the run was interrupted
+// or it is out of time. Passes are never cut short, the deadline is only
+// checked in between.
+func (aa *aaOptimizer) startPass(name string) bool {
+	if aa.run != nil {
+		if aa.passesDone < aa.run.skip && !aa.finalPasses {
+			fmt.Printf("skipping %s, completed before resuming\n", name)
+			aa.passesDone++
+			return false
+		}
+		if aa.run.interrupted.Load() {
+			return false
+		}
+		if aa.run.outOfTime() {
+			fmt.Printf("skipping %s, out of time\n", name)
+			aa.run.timedOut.Store(true)
+			return false
+		}
+	}
+	fmt.Println("executing " + name)
+	aa.pass = name
+	aa.passesDone++
+	return true
+}
+
+// resumeToken records how far an interrupted run got, written next to
+// the partial result it is resumed from
+type resumeToken struct {
+	Input   string `json:"input"`
+	Partial string `json:"partial"`
+	// Passes is the number of passes every region completed
+	Passes int `json:"passes"`
+	// Options are the flags of the run, a resumed run must use the same
+	Options string `json:"options"`
+}
+
+func partialPath(output string) string {
+	return output + ".partial"
+}
+
+func resumeTokenPath(output string) string {
+	return output + ".resume"
+}
+
+func writeResumeToken(t *resumeToken, path string) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func readResumeToken(path string) (*resumeToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t resumeToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	return &t, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The subset of SARIF 2.1.0 needed to report findings, so they show up as
+// annotations in code review systems
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version"`
+	Rules   []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+// writeSarif writes the findings as a SARIF log, checks are the rules
+// reported on, along with their default severity
+func writeSarif(w io.Writer, checks []lintCheck, findings []finding) error {
+	driver := sarifDriver{Name: "aaoptimizer", Version: version}
+	for _, c := range checks {
+		driver.Rules = append(driver.Rules, sarifRule{ID: c.id, DefaultConfiguration: sarifConfiguration{c.severity.String()}})
+	}
+
+	results := []sarifResult{}
+	for _, f := range findings {
+		loc := sarifLocation{sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{f.file}}}
+		// lines start at 1, findings without one are about the whole file
+		if f.line > 0 {
+			loc.PhysicalLocation.Region = &sarifRegion{f.line}
+		}
+		results = append(results, sarifResult{
+			RuleID:    f.check,
+			Level:     f.severity.String(),
+			Message:   sarifMessage{f.message},
+			Locations: []sarifLocation{loc},
+		})
+	}
+
+	log := sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{{Tool: sarifTool{driver}, Results: results}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
+
+func writeSarifFile(path string, checks []lintCheck, findings []finding) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeSarif(f, checks, findings); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// wideningCheck is the rule widening transformations of the optimizer are
+// reported as, it is not run by lint
+var wideningCheck = lintCheck{id: "widening", severity: severityWarning}
+
+func wideningFinding(tx transformation) finding {
+	f := finding{
+		file:     tx.File,
+		message:  fmt.Sprintf("%s grants more than %s", strings.Join(tx.Outputs, " "), strings.Join(tx.Inputs, " ")),
+		check:    wideningCheck.id,
+		severity: wideningCheck.severity,
+	}
+	if len(tx.Lines) > 0 {
+		f.line = tx.Lines[0]
+	}
+	return f
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+
+	"test/aaoptimizer/aare"
+)
+
+// The selftest checks the internal matchers against apparmor_parser. The
+// parser cannot be asked whether a pattern matches a path, but it compiles
+// rules into a minimized DFA: adding a rule for the path to a profile
+// granting the pattern leaves the compiled policy unchanged exactly when
+// the pattern matches the path.
+
+var selftestPatterns = []string{
+	"/st/*",
+	"/st/**",
+	"/st/*/",
+	"/st/**/",
+	"/st/a?c",
+	"/st/a*b",
+	"/st/*.conf",
+	"/st/[abc]x",
+	"/st/[^abc]x",
+	"/st/[a-c]x",
+	"/st/{foo,bar}",
+	"/st/{foo,bar}/*",
+	"/st/{a,b}{c,d}",
+	"/st/**/x",
+	"/st/a/**/b",
+	`/st/\*`,
+}
+
+var selftestPaths = []string{
+	"/st/",
+	"/st/a",
+	"/st/ab",
+	"/st/abc",
+	"/st/ad",
+	"/st/ax",
+	"/st/bx",
+	"/st/dx",
+	"/st/x",
+	"/st/*",
+	"/st/.hidden",
+	"/st/b.conf",
+	"/st/foo",
+	"/st/bar",
+	"/st/foo/x",
+	"/st/a/b",
+	"/st/a/b/",
+	"/st/a/x",
+	"/st/a/x/b",
+	"/st/a/b/c/x",
+}
+
+// selftestCompiler compiles tiny profiles in a temporary directory
+type selftestCompiler struct {
+	parser string
+	dir    string
+	n      int
+}
+
+func (sc *selftestCompiler) compile(patterns ...string) ([]byte, error) {
+	var sb bytes.Buffer
+	sb.WriteString("profile selftest {\n")
+	for _, p := range patterns {
+		fmt.Fprintf(&sb, "  %s r,\n", p)
+	}
+	sb.WriteString("}\n")
+	sc.n++
+	file := filepath.Join(sc.dir, fmt.Sprintf("profile%d", sc.n))
+	if err := os.WriteFile(file, sb.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(sc.parser, "--skip-kernel-load", "--skip-cache", "--quiet", "--stdout", file).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%s failed on %s: %s", sc.parser, sb.String(), bytes.TrimSpace(ee.Stderr))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// parserMatches reports whether the parser considers the path matched by
+// the pattern, given the policy compiled for the pattern alone
+func (sc *selftestCompiler) parserMatches(pattern, path string, alone []byte) (bool, error) {
+	with, err := sc.compile(pattern, escapePath(path))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(alone, with), nil
+}
+
+// regexMatches matches the path with the regular expression export-regex
+// translates the pattern into
+func regexMatches(pattern, path string) (bool, error) {
+	re, err := aareToRegex(pattern)
+	if err != nil {
+		return false, err
+	}
+	return regexp.MustCompile(re).MatchString(path), nil
+}
+
+func selftestMain(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	parser := fs.String("parser", "apparmor_parser", "apparmor_parser binary to compare against")
+	verbose := fs.Bool("verbose", false, "print every pattern and path checked, not only the divergences")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer selftest [flags]")
+		fmt.Println("compares how the internal matchers and apparmor_parser match a corpus of patterns and paths, reporting any divergence")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+	// without a parser there is nothing to compare against, which is not
+	// a divergence
+	if _, err := exec.LookPath(*parser); err != nil {
+		fmt.Printf("selftest skipped, %s not found: install apparmor or point --parser at it\n", *parser)
+		return
+	}
+	dir, err := os.MkdirTemp("", "aaoptimizer-selftest")
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	sc := &selftestCompiler{parser: *parser, dir: dir}
+
+	// the comparison only works if compiling is deterministic and a
+	// covered rule is merged away
+	control := func() error {
+		alone, err := sc.compile("/st/*")
+		if err != nil {
+			return err
+		}
+		again, err := sc.compile("/st/*")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(alone, again) {
+			return fmt.Errorf("%s does not compile the same profile the same way twice", *parser)
+		}
+		covered, err := sc.parserMatches("/st/*", "/st/abc", alone)
+		if err == nil && !covered {
+			err = fmt.Errorf("%s does not merge a rule covered by another one", *parser)
+		}
+		return err
+	}
+	if err := control(); err != nil {
+		fmt.Printf("aaoptimizer: cannot compare with the parser: %v\n", err)
+		os.Exit(1)
+	}
+
+	divergences := 0
+	checked := 0
+	for _, pattern := range selftestPatterns {
+		alone, err := sc.compile(pattern)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(1)
+		}
+		for _, path := range selftestPaths {
+			want, err := sc.parserMatches(pattern, path, alone)
+			if err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				os.Exit(1)
+			}
+			checked++
+			aare := aare.Match(pattern, path)
+			re, err := regexMatches(pattern, path)
+			if err != nil {
+				fmt.Printf("aaoptimizer: %v\n", err)
+				os.Exit(1)
+			}
+			if aare == want && re == want {
+				if *verbose {
+					fmt.Printf("%s %s: %v\n", pattern, path, want)
+				}
+				continue
+			}
+			divergences++
+			fmt.Printf("%s %s: apparmor_parser %v, matcher %v, export-regex %v\n", pattern, path, want, aare, re)
+		}
+	}
+	if divergences > 0 {
+		fmt.Printf("%d of %d pattern and path pairs diverge from %s\n", divergences, checked, *parser)
+		os.Exit(1)
+	}
+	fmt.Printf("all %d pattern and path pairs match %s\n", checked, *parser)
+}
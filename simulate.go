@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// access is a single file access to evaluate against a profile, read from
+// a line like /etc/passwd r
+type access struct {
+	line  int
+	path  string
+	perms string
+}
+
+func loadAccesses(path string) ([]access, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var accesses []access
+	for i, l := range lines {
+		tokens := strings.Fields(stripComment(l))
+		if len(tokens) == 0 {
+			continue
+		}
+		if len(tokens) != 2 || !strings.HasPrefix(tokens[0], "/") {
+			return nil, fmt.Errorf("%s:%d: expected a path and its permissions", path, i+1)
+		}
+		accesses = append(accesses, access{i + 1, tokens[0], tokens[1]})
+	}
+	return accesses, nil
+}
+
+// decision is the outcome of evaluating an access, rule is the deny rule
+// refusing it or the first rule granting it, if any
+type decision struct {
+	allowed bool
+	rule    *profileRule
+}
+
+func (d decision) String() string {
+	s := "deny"
+	if d.allowed {
+		s = "allow"
+	}
+	if d.rule != nil {
+		s += " (" + d.rule.ref() + ")"
+	}
+	return s
+}
+
+// simulateAccess evaluates the access against the rules of a profile. A
+// matching deny rule always wins, otherwise every requested permission must
+// be granted by some rule. Owner rules are assumed to apply.
+func simulateAccess(rules []profileRule, a access) decision {
+	var granted string
+	var first *profileRule
+	for i := range rules {
+		r := &rules[i]
+		if r.capability || !(r.catchAll || aare.Match(r.path, a.path)) {
+			continue
+		}
+		perms := r.perms
+		if r.catchAll {
+			perms = permOrder + execOrder
+		}
+		if r.deny {
+			for _, p := range a.perms {
+				if permsCover(perms, string(p)) {
+					return decision{false, r}
+				}
+			}
+			continue
+		}
+		if first == nil {
+			first = r
+		}
+		granted += perms
+	}
+	if first == nil || !permsCover(granted, a.perms) {
+		return decision{}
+	}
+	return decision{true, first}
+}
+
+func simulateMain(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	accessesFile := fs.String("accesses", "", "file with the accesses to evaluate, one path and its permissions per line")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer simulate [flags] [profile] [other]")
+		fmt.Println("with two profiles, only the accesses they decide differently are printed")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 || *accessesFile == "" {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	accesses, err := loadAccesses(*accessesFile)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	var profiles [][]profileRule
+	for _, p := range fs.Args() {
+		lines, err := readLines(p)
+		if err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+			os.Exit(-1)
+		}
+		profiles = append(profiles, parseProfileRules(lines))
+	}
+
+	if len(profiles) == 1 {
+		for _, a := range accesses {
+			fmt.Printf("%s %s: %s\n", a.path, a.perms, simulateAccess(profiles[0], a))
+		}
+		return
+	}
+
+	differences := 0
+	for _, a := range accesses {
+		d1 := simulateAccess(profiles[0], a)
+		d2 := simulateAccess(profiles[1], a)
+		if d1.allowed == d2.allowed {
+			continue
+		}
+		fmt.Printf("%s %s: %s in %s, %s in %s\n", a.path, a.perms, d1, fs.Arg(0), d2, fs.Arg(1))
+		differences++
+	}
+	if differences > 0 {
+		fmt.Printf("%d of %d accesses decided differently\n", differences, len(accesses))
+		os.Exit(1)
+	}
+}
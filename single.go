@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+)
+
+// isLiteralPart reports whether the part is plain ASCII without any AARE
+// special characters, so it can be indexed byte by byte
+func isLiteralPart(part string) bool {
+	for i := 0; i < len(part); i++ {
+		if part[i] >= 0x80 || strings.IndexByte(`*?[]{}\@,`, part[i]) >= 0 {
+			return false
+		}
+	}
+	return part != ""
+}
+
+// foldSingleChars replaces siblings with identical children that only
+// differ in one character, like sda, sdb and sdc, with sd? once there are
+// at least aa.foldSingleChar of them. This widens the rules to any other
+// character in that position.
+func (aa *aaOptimizer) foldSingleChars(b bucket, ctx string, l *leaf) {
+	groups := make(map[string][]*leaf)
+	var keys []string
+	for _, c := range l.sortedChildren() {
+		if !isLiteralPart(c.part) || aa.keptApart(ctx+"/"+c.part) {
+			continue
+		}
+		for i := range c.part {
+			key := c.part[:i] + "?" + c.part[i+1:]
+			if groups[key] == nil {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], c)
+		}
+	}
+
+	for _, key := range keys {
+		candidates := groups[key]
+		for len(candidates) >= aa.foldSingleChar {
+			// the first candidate left in place and those identical to it
+			first := candidates[0]
+			var members, rest []*leaf
+			for _, c := range candidates {
+				if l.children[c.part] != c {
+					continue
+				}
+				if c == first || (l.children[first.part] == first && aa.identicalChildren(first, c)) {
+					members = append(members, c)
+				} else {
+					rest = append(rest, c)
+				}
+			}
+			candidates = rest
+			if len(members) < aa.foldSingleChar || l.children[first.part] != first {
+				continue
+			}
+
+			var inputs []string
+			if aa.onTransform != nil {
+				for _, c := range members {
+					inputs = append(inputs, c.paths(ctx+"/"+c.part)...)
+				}
+			}
+			folded := l.children[key]
+			if folded == nil {
+				folded = newLeaf(key)
+				folded.children = first.children
+				l.children[key] = folded
+			} else {
+				aa.combineLeafs(folded, first)
+			}
+			for _, c := range members {
+				delete(l.children, c.part)
+			}
+			if aa.onTransform != nil {
+				aa.transformed("single-char", true, b.rules(inputs), b.rules(folded.paths(ctx+"/"+key)))
+			}
+		}
+	}
+}
+
+func (aa *aaOptimizer) optimizeTreeSingleChars(b bucket, ctx string, l *leaf) {
+	if aa.mayGeneralize(ctx) && aa.mayIntroduce("?") {
+		aa.foldSingleChars(b, ctx, l)
+	}
+	for _, c := range l.sortedChildren() {
+		aa.optimizeTreeSingleChars(b, ctx+"/"+c.part, c)
+	}
+}
+
+// Generalize things like:
+// /sys/block/sda/size r,
+// /sys/block/sdb/size r,
+// /sys/block/sdc/size r,
+func (aa *aaOptimizer) optimizeSingleChars() {
+	aa.eachTree(func(b bucket, l *leaf) {
+		aa.optimizeTreeSingleChars(b, "", l)
+	})
+}
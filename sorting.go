@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+var sortStrategies = []string{"lexical", "depth-first", "length", "original-first-seen"}
+
+func validSortStrategy(s string) bool {
+	for _, ss := range sortStrategies {
+		if s == ss {
+			return true
+		}
+	}
+	return false
+}
+
+// compareDepthFirst orders paths as a depth first walk of the directory
+// tree would, with directories before the files next to them.
+func compareDepthFirst(a, b string) bool {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		aDir := i < len(as)-1
+		bDir := i < len(bs)-1
+		if aDir != bDir {
+			return aDir
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) > len(bs)
+}
+
+// firstSeen returns the index of the first original rule that the
+// generated rule covers
+func firstSeen(pr profileRule, originals []profileRule) int {
+	for i, o := range originals {
+		if o.perms == pr.perms && aare.Covers(pr.path, o.path) {
+			return i
+		}
+	}
+	return len(originals)
+}
+
+// sortRules sorts the generated rules according to the strategy, the
+// originals are the rules the block was generated from.
+func sortRules(rules []string, strategy string, originals []string) {
+	parsed := make([]profileRule, len(rules))
+	for i, r := range rules {
+		parsed[i], _ = parseProfileRule(i, r)
+	}
+
+	var less func(a, b profileRule) bool
+	switch strategy {
+	case "lexical":
+		less = func(a, b profileRule) bool {
+			return a.path < b.path
+		}
+	case "depth-first":
+		less = func(a, b profileRule) bool {
+			return compareDepthFirst(a.path, b.path)
+		}
+	case "length":
+		less = func(a, b profileRule) bool {
+			if len(a.path) != len(b.path) {
+				return len(a.path) < len(b.path)
+			}
+			return a.path < b.path
+		}
+	case "original-first-seen":
+		origs := parseProfileRules(originals)
+		seen := make(map[int]int)
+		for _, pr := range parsed {
+			seen[pr.line] = firstSeen(pr, origs)
+		}
+		less = func(a, b profileRule) bool {
+			if seen[a.line] != seen[b.line] {
+				return seen[a.line] < seen[b.line]
+			}
+			return a.path < b.path
+		}
+	default:
+		return
+	}
+
+	idx := make([]int, len(rules))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return less(parsed[idx[i]], parsed[idx[j]])
+	})
+
+	sorted := make([]string, len(rules))
+	for i, j := range idx {
+		sorted[i] = rules[j]
+	}
+	copy(rules, sorted)
+}
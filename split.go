@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitFile is an include file holding the rules of a generated block
+// moved out of a large profile
+type splitFile struct {
+	// name is the path the profile includes it by, relative to the
+	// directory of the profile
+	name  string
+	lines []string
+}
+
+// splitTopic names the include file of the rules below the prefix after
+// what they cover and whether they only read, like sysfs-ro or udev-rw
+func splitTopic(prefix string, rules []string) string {
+	parts := strings.Split(strings.Trim(prefix, "/"), "/")
+	var topic string
+	switch {
+	case strings.Contains(prefix, "udev"):
+		topic = "udev"
+	case parts[0] == "sys":
+		topic = "sysfs"
+	case parts[0] == "proc":
+		topic = "procfs"
+	case parts[0] == "":
+		topic = "root"
+	default:
+		topic = strings.Join(parts, "-")
+	}
+	for _, rl := range rules {
+		if pr, ok := parseProfileRule(0, rl); ok && strings.ContainsAny(pr.perms, "wakl") {
+			return topic + "-rw"
+		}
+	}
+	return topic + "-ro"
+}
+
+// splitOutput moves the rules of the generated blocks of every profile
+// with more than opts.splitThreshold rules into include files below the
+// output's .d directory, one per block, leaving the header and an include
+// of the file in place. The regions are updated to the blocks left in
+// place.
+func splitOutput(lines, out []string, regions []*region, output string, opts *options) ([]string, []splitFile) {
+	_, owners := findProfiles(lines)
+	counts := make(map[string]int)
+	for _, pr := range parseProfileRules(lines) {
+		if pb := owners[pr.line-1]; pb != nil {
+			counts[pb.name]++
+		} else {
+			counts[""]++
+		}
+	}
+
+	dir := filepath.Base(output) + ".d"
+	used := make(map[string]int)
+	var split []string
+	var files []splitFile
+	last := 0
+	for _, r := range regions {
+		split = append(split, out[last:r.outStart]...)
+		last = r.outStart + len(r.generated)
+		r.outStart = len(split)
+		if block, f, ok := splitBlock(r, counts, dir, used, opts); ok {
+			r.generated = block
+			files = append(files, f)
+		}
+		split = append(split, r.generated...)
+	}
+	if files == nil {
+		return out, nil
+	}
+	return append(split, out[last:]...), files
+}
+
+// splitBlock moves the rules of the block generated for the region into
+// an include file if its profile has more than opts.splitThreshold rules
+func splitBlock(r *region, counts map[string]int, dir string, used map[string]int, opts *options) ([]string, splitFile, bool) {
+	name := ""
+	if r.profile != nil {
+		name = r.profile.name
+	}
+	if counts[name] <= opts.splitThreshold {
+		return nil, splitFile{}, false
+	}
+
+	// the rules are everything between the header and the footer
+	start := 0
+	for start < len(r.generated) && !opts.markers.headerPattern.MatchString(r.generated[start]) {
+		start++
+	}
+	if start == len(r.generated) {
+		return nil, splitFile{}, false
+	}
+	end := len(r.generated)
+	if opts.markers.footerPattern != nil && opts.markers.footerPattern.MatchString(r.generated[end-1]) {
+		end--
+	}
+	indent := r.indent
+	if opts.fragment {
+		indent = ""
+	}
+	var rules []string
+	for _, l := range r.generated[start+1 : end] {
+		rules = append(rules, strings.TrimPrefix(l, indent))
+	}
+
+	topic := splitTopic(r.prefix, rules)
+	used[topic]++
+	if used[topic] > 1 {
+		topic = fmt.Sprintf("%s-%d", topic, used[topic])
+	}
+	f := splitFile{name: dir + "/" + topic, lines: rules}
+
+	block := append([]string(nil), r.generated[:start+1]...)
+	block = append(block, indent+"include \""+f.name+"\"")
+	block = append(block, r.generated[end:]...)
+	return block, f, true
+}
+
+// writeSplitFiles writes the include files next to the output
+func writeSplitFiles(files []splitFile, output string) error {
+	for _, f := range files {
+		path := filepath.Join(filepath.Dir(output), f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := writeLines(f.lines, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
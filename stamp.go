@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The stamp records the hash of an optimized profile along with the
+// options it was optimized with, so optimizing it again with the same
+// options can be skipped as long as it was not edited since.
+var stampLine = regexp.MustCompile(`^\s*#\s*aa-optimizer input-hash ([0-9a-f]{64})\s*$`)
+
+// stampHash hashes the lines but any stamp, along with the options and
+// the version of the tool
+func stampHash(lines []string, opts string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", version, opts)
+	for _, l := range lines {
+		if !stampLine.MatchString(l) {
+			fmt.Fprintf(h, "%s\n", l)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stamped reports whether the lines carry a stamp matching their content
+// and the options
+func stamped(lines []string, opts string) bool {
+	for _, l := range lines {
+		if m := stampLine.FindStringSubmatch(l); m != nil {
+			return m[1] == stampHash(lines, opts)
+		}
+	}
+	return false
+}
+
+// stampLines returns the lines with any earlier stamp replaced by one for
+// their current content. It goes right below the header of the first
+// generated block, or at the end if there is none.
+func stampLines(lines []string, markers *blockMarkers, opts string) []string {
+	var unstamped []string
+	for _, l := range lines {
+		if !stampLine.MatchString(l) {
+			unstamped = append(unstamped, l)
+		}
+	}
+	at, indent := len(unstamped), ""
+	for i, l := range unstamped {
+		if markers.headerPattern.MatchString(l) {
+			at, indent = i+1, l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+			break
+		}
+	}
+	stamp := indent + "# aa-optimizer input-hash " + stampHash(unstamped, opts)
+	out := append([]string(nil), unstamped[:at]...)
+	out = append(out, stamp)
+	return append(out, unstamped[at:]...)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// capabilities that more or less hand out root
+var dangerousCapabilities = map[string]bool{
+	"sys_admin":    true,
+	"sys_module":   true,
+	"sys_ptrace":   true,
+	"sys_rawio":    true,
+	"dac_override": true,
+	"mac_admin":    true,
+	"mac_override": true,
+	"setuid":       true,
+	"setgid":       true,
+}
+
+// riskScore is the complexity and attack surface score of a profile, the
+// total is what teams should track over time, the components explain it
+type riskScore struct {
+	rules        int
+	wildcards    float64
+	write        float64
+	exec         float64
+	capabilities float64
+}
+
+func (rs *riskScore) total() float64 {
+	return float64(rs.rules) + rs.wildcards + rs.write + rs.exec + rs.capabilities
+}
+
+// wildcardBreadth weighs the globs of a pattern by how much they match
+func wildcardBreadth(path string) float64 {
+	var breadth float64
+	for _, w := range aare.Wildcards(path) {
+		switch w {
+		case "**":
+			breadth += 3
+		case "*":
+			breadth += 1
+		case "[]":
+			breadth += 0.5
+		}
+	}
+	// every extra alternation member is another path granted
+	if expanded, ok := aare.Expand(path); ok {
+		breadth += float64(len(expanded)-1) * 0.1
+	}
+	return breadth
+}
+
+func (rs *riskScore) add(r profileRule) {
+	if r.deny {
+		return
+	}
+
+	if r.capability {
+		if len(r.capabilities) == 0 {
+			rs.capabilities += 50
+		}
+		for _, c := range r.capabilities {
+			if dangerousCapabilities[c] {
+				rs.capabilities += 5
+			} else {
+				rs.capabilities += 2
+			}
+		}
+		return
+	}
+
+	breadth := wildcardBreadth(aare.Unquote(r.path))
+	rs.wildcards += breadth
+	if strings.ContainsAny(r.perms, "wa") {
+		rs.write += 2 + breadth
+	}
+	if strings.ContainsAny(r.perms, "uU") {
+		// unconfined execution
+		rs.exec += 5 + breadth
+	} else if r.isExec() {
+		rs.exec += 3 + breadth
+	}
+}
+
+// profileStats are the metrics reported for a profile by stats
+type profileStats struct {
+	name         string
+	kinds        map[string]int
+	perms        map[string]int
+	prefixes     map[string]int
+	wildcards    map[string]int
+	includes     int
+	includeDepth int
+	score        riskScore
+}
+
+func newProfileStats(name string) *profileStats {
+	return &profileStats{
+		name:      name,
+		kinds:     make(map[string]int),
+		perms:     make(map[string]int),
+		prefixes:  make(map[string]int),
+		wildcards: make(map[string]int),
+	}
+}
+
+func (ps *profileStats) addFileRule(r profileRule) {
+	if perms := canonicalPerms(r.perms); perms != "" {
+		ps.perms[perms]++
+	}
+
+	path := aare.Unquote(r.path)
+	parts := aare.SplitPath(strings.TrimPrefix(path, "/"))
+	for d := autoMinDepth; d < len(parts); d++ {
+		prefix := "/" + strings.Join(parts[:d], "/")
+		// an alternation spanning components has no prefix within it
+		if aare.Check(prefix) != nil {
+			break
+		}
+		ps.prefixes[prefix]++
+	}
+
+	for _, w := range aare.Wildcards(path) {
+		ps.wildcards[w]++
+	}
+	if strings.Contains(path, "?") {
+		ps.wildcards["?"]++
+	}
+	if len(aare.Groups(path)) > 0 {
+		ps.wildcards["{}"]++
+	}
+}
+
+// collectStats gathers the metrics of every profile in the file, rules
+// outside any profile are reported as (global).
+func collectStats(path string, lines []string, base string) []*profileStats {
+	_, owners := findProfiles(lines)
+	var all []*profileStats
+	byName := make(map[string]*profileStats)
+	statsFor := func(line int) *profileStats {
+		name := "(global)"
+		if pb := owners[line-1]; pb != nil {
+			name = pb.name
+		}
+		ps := byName[name]
+		if ps == nil {
+			ps = newProfileStats(name)
+			byName[name] = ps
+			all = append(all, ps)
+		}
+		return ps
+	}
+
+	for i, l := range lines {
+		if kind := ruleKind(l); kind != "" {
+			ps := statsFor(i + 1)
+			ps.kinds[kind]++
+			ps.score.rules++
+		}
+	}
+	for _, r := range parseProfileRules(lines) {
+		ps := statsFor(r.line)
+		ps.score.add(r)
+		if r.isFile() {
+			ps.addFileRule(r)
+		}
+	}
+	for _, inc := range parseIncludes(lines) {
+		ps := statsFor(inc.line)
+		ps.includes++
+		for _, t := range includeTargets(resolveInclude(inc, base, filepath.Dir(path))) {
+			if d := includeDepth(t, base, map[string]bool{path: true}); d > ps.includeDepth {
+				ps.includeDepth = d
+			}
+		}
+	}
+	return all
+}
+
+func sortedCounts(counts map[string]int) []string {
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func printCounts(title string, counts map[string]int, top int) {
+	if len(counts) == 0 {
+		return
+	}
+	fmt.Printf("  %s:\n", title)
+	for i, k := range sortedCounts(counts) {
+		if top > 0 && i == top {
+			break
+		}
+		fmt.Printf("    %-30s %d\n", k, counts[k])
+	}
+}
+
+func statsMain(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of path prefixes to list")
+	base := fs.String("include-base", defaultIncludeBase, "directory <...> includes are relative to")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer stats [flags] [profile]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+
+	for _, ps := range collectStats(input, lines, *base) {
+		rs := &ps.score
+		fmt.Printf("profile %s:\n", ps.name)
+		fmt.Printf("  rules: %d\n", rs.rules)
+		fmt.Printf("  score: %.1f (wildcards %.1f, write %.1f, exec %.1f, capabilities %.1f)\n",
+			rs.total(), rs.wildcards, rs.write, rs.exec, rs.capabilities)
+		fmt.Printf("  includes: %d (depth %d)\n", ps.includes, ps.includeDepth)
+		printCounts("rule types", ps.kinds, 0)
+		printCounts("permissions", ps.perms, 0)
+		printCounts("wildcards", ps.wildcards, 0)
+		printCounts("top prefixes", ps.prefixes, *top)
+	}
+}
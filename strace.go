@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// strace -f -e trace=file,network output is turned into candidate rules
+// where audit logging is not available. Only calls that succeeded are
+// taken into account, and paths relative to a directory descriptor are
+// skipped as they cannot be resolved from the capture.
+
+// straceCall matches a complete call, i.e
+// [pid 123] openat(AT_FDCWD, "/etc/passwd", O_RDONLY|O_CLOEXEC) = 3
+var straceCall = regexp.MustCompile(`^(?:\[pid\s+\d+\]\s+|\d+\s+)?(\w+)\((.*)\)\s+=\s+(-?\d+|0x[0-9a-f]+)`)
+
+var sharedLibrary = regexp.MustCompile(`\.so(\.[0-9.]+)?$`)
+
+var straceString = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+
+// straceWrites are the calls modifying the path they are given
+var straceWrites = map[string]bool{
+	"creat": true, "mkdir": true, "mkdirat": true, "unlink": true, "unlinkat": true,
+	"rmdir": true, "rename": true, "renameat": true, "renameat2": true, "truncate": true,
+	"chmod": true, "fchmodat": true, "chown": true, "lchown": true, "fchownat": true,
+	"utimensat": true, "symlink": true, "symlinkat": true, "mknod": true, "mknodat": true,
+}
+
+// learnedAccesses accumulates the accesses seen in a capture or while
+// recording a process
+type learnedAccesses struct {
+	perms   map[string]string
+	network map[string]bool
+	skipped int
+}
+
+func newLearnedAccesses() *learnedAccesses {
+	return &learnedAccesses{
+		perms:   make(map[string]string),
+		network: make(map[string]bool),
+	}
+}
+
+func (si *learnedAccesses) grant(path, perms string) {
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t\"") {
+		si.skipped++
+		return
+	}
+	si.perms[path] += perms
+}
+
+// openPerms returns the permissions an open call with the arguments needs
+func openPerms(path, flags string) string {
+	perms := "r"
+	switch {
+	case strings.Contains(flags, "O_WRONLY"):
+		perms = "w"
+	case strings.Contains(flags, "O_RDWR"):
+		perms = "rw"
+	}
+	if strings.Contains(flags, "O_CREAT") || strings.Contains(flags, "O_TRUNC") {
+		perms += "w"
+	}
+	// shared libraries are mapped executable once opened
+	if sharedLibrary.MatchString(filepath.Base(path)) {
+		perms += "m"
+	}
+	return perms
+}
+
+func (si *learnedAccesses) add(l string) {
+	m := straceCall.FindStringSubmatch(strings.TrimSpace(l))
+	if m == nil || strings.HasPrefix(m[3], "-") {
+		return
+	}
+	call, args := m[1], m[2]
+	var paths []string
+	for _, s := range straceString.FindAllStringSubmatch(args, -1) {
+		paths = append(paths, s[1])
+	}
+	relative := strings.HasSuffix(call, "at") && !strings.HasPrefix(args, "AT_FDCWD")
+
+	switch {
+	case call == "open" || call == "openat":
+		if len(paths) == 0 || (relative && !strings.HasPrefix(paths[0], "/")) {
+			si.skipped++
+			return
+		}
+		si.grant(paths[0], openPerms(paths[0], args))
+	case call == "execve":
+		if len(paths) > 0 {
+			si.grant(paths[0], "ix")
+		}
+	case call == "link" || call == "linkat":
+		if len(paths) == 2 {
+			si.grant(paths[1], "l")
+		}
+	case straceWrites[call]:
+		for _, p := range paths {
+			if relative && !strings.HasPrefix(p, "/") {
+				si.skipped++
+				continue
+			}
+			si.grant(p, "w")
+		}
+	case call == "connect" || call == "bind":
+		if strings.Contains(args, "sun_path=") && len(paths) > 0 {
+			si.grant(paths[0], "rw")
+		}
+	case call == "socket":
+		si.addSocket(args)
+	}
+}
+
+func (si *learnedAccesses) addSocket(args string) {
+	families := map[string]string{"AF_INET": "inet", "AF_INET6": "inet6", "AF_UNIX": "unix", "AF_NETLINK": "netlink", "AF_PACKET": "packet"}
+	types := map[string]string{"SOCK_STREAM": "stream", "SOCK_DGRAM": "dgram", "SOCK_RAW": "raw", "SOCK_SEQPACKET": "seqpacket"}
+	parts := strings.Split(args, ",")
+	if len(parts) < 2 {
+		return
+	}
+	family := families[strings.TrimSpace(parts[0])]
+	typ := types[strings.Split(strings.TrimSpace(parts[1]), "|")[0]]
+	if family == "" {
+		return
+	}
+	rule := "network " + family
+	if typ != "" {
+		rule += " " + typ
+	}
+	si.network[rule+","] = true
+}
+
+// escapePath escapes the characters of a literal path that AARE treats
+// as special
+func escapePath(p string) string {
+	var sb strings.Builder
+	for _, c := range p {
+		if strings.ContainsRune(`*?[]{}\`, c) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// rules returns the rules for the accesses the profile does not grant yet
+func (si *learnedAccesses) rules(existing []profileRule) []string {
+	var rules []string
+	for path, perms := range si.perms {
+		// executing needs the binary to be readable and mapped
+		if strings.Contains(perms, "ix") {
+			perms += "mr"
+		}
+		perms = canonicalPerms(perms)
+		if simulateAccess(existing, access{path: path, perms: strings.ReplaceAll(perms, "i", "")}).allowed {
+			continue
+		}
+		rules = append(rules, escapePath(path)+" "+perms+",")
+	}
+	for n := range si.network {
+		rules = append(rules, n)
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+func importStraceMain(args []string) {
+	fs := flag.NewFlagSet("import-strace", flag.ExitOnError)
+	optimize := fs.Bool("optimize", true, "optimize the prefixes shared by many of the rules of the result")
+	autoMin := fs.Int("auto-min", 10, "minimum number of rules a prefix must exceed to be optimized")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer import-strace [flags] [capture] [profile] [output]")
+		fmt.Println("merges the accesses of a strace -f -e trace=file,network capture into the profile")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 3 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	capture, err := readLines(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	input := fs.Arg(1)
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+
+	si := newLearnedAccesses()
+	for _, l := range capture {
+		si.add(l)
+	}
+	rules := si.rules(parseProfileRules(lines))
+	fmt.Printf("%d new rules from %s", len(rules), fs.Arg(0))
+	if si.skipped > 0 {
+		fmt.Printf(", skipped %d accesses to relative or unusual paths", si.skipped)
+	}
+	fmt.Println()
+
+	merged, err := learnRules(lines, input, rules, *optimize, *autoMin)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeLines(merged, fs.Arg(2)); err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// learnRules merges learned rules into the profile, and optimizes the
+// prefixes shared by more than autoMin rules if asked to
+func learnRules(lines []string, input string, rules []string, optimize bool, autoMin int) ([]string, error) {
+	merged := mergeRules(lines, rules)
+	if !optimize {
+		return merged, nil
+	}
+	var paths []string
+	for _, c := range detectPrefixes(merged, autoMin) {
+		paths = append(paths, c.prefix)
+	}
+	if len(paths) == 0 {
+		return merged, nil
+	}
+	cs, err := optimizeProfile(merged, input, paths)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("optimized %d rules into %d\n", len(cs.Removed), len(cs.Added))
+	return cs.lines, nil
+}
+
+// mergeRules puts the rules in front of the closing brace of the last
+// profile, or appends them if there is none
+func mergeRules(lines, rules []string) []string {
+	end := len(lines)
+	indent := ""
+	if pb := lastProfile(lines); pb != nil {
+		end = pb.end
+		indent = "  "
+	}
+	merged := append([]string(nil), lines[:end]...)
+	for _, r := range rules {
+		merged = append(merged, indent+r)
+	}
+	return append(merged, lines[end:]...)
+}
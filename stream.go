@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// scanBufferSize is the longest line the profiles may have
+var scanBufferSize = bufio.MaxScanTokenSize
+
+// newScanner returns a line scanner accepting lines up to scanBufferSize
+func newScanner(r io.Reader) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 4096), scanBufferSize)
+	s.Split(scanRawLines)
+	return s
+}
+
+// scanRawLines splits lines like bufio.ScanLines but keeps a carriage
+// return at the end, so the lines left in place are written back exactly
+// as they were read
+func scanRawLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// streamRegion is a region of a streamed profile. Its rules are added to
+// the optimizer as they are read rather than kept around.
+type streamRegion struct {
+	prefix  string
+	profile *profileBlock
+	indent  string
+	count   int
+	// at is the index of the kept line the generated block goes in
+	// front of
+	at int
+	aa *aaOptimizer
+}
+
+// streamedProfile is a profile ingested by scanProfile, made of the lines
+// that are left as they are and the regions replacing the others
+type streamedProfile struct {
+	kept    []string
+	regions []*streamRegion
+}
+
+// scanExecRules reads the exec rules of the profile, which the order
+// sensitive rules are found with
+func scanExecRules(r io.Reader) (*execRules, error) {
+	er := &execRules{}
+	var pt profileTracker
+	i := 0
+	s := newScanner(r)
+	for s.Scan() {
+		l := s.Text()
+		er.add(i+1, l, pt.next(i, l))
+		i++
+	}
+	return er, s.Err()
+}
+
+// scanProfile reads the profile line by line, adding the rules below one
+// of the prefixes to the optimizer of their region and keeping only the
+// other lines. Rules are pinned like optimizeLines does, given the exec
+// rules of the profile, and regions end like they do in findRegions,
+// though earlier generated blocks are not known here.
+func scanProfile(r io.Reader, opts *options, er *execRules) (*streamedProfile, error) {
+	sp := &streamedProfile{}
+	var pt profileTracker
+	var current *streamRegion
+	// blank lines only belong to the region if another of its rules
+	// follows them
+	var blanks []string
+	var unparseable, fixedUp []int
+	n := 0
+	s := newScanner(r)
+	for s.Scan() {
+		l := s.Text()
+		owner := pt.next(n, l)
+		n++
+		tl := strings.TrimSpace(l)
+		if tl == "" {
+			if current != nil {
+				blanks = append(blanks, l)
+			} else {
+				sp.kept = append(sp.kept, l)
+			}
+			continue
+		}
+
+		p, ok := opts.prefixes.selectPrefix(tl)
+		if ok {
+			if reason := er.orderSensitive(n, tl, owner); reason != "" {
+				fmt.Printf("aaoptimizer: line %d is order sensitive, leaving it in place: %s\n", n, reason)
+				ok = false
+			} else if keptReason(tl) != "" || excludedReason(tl, opts) != "" || permsReason(n, tl, opts) != "" {
+				ok = false
+			}
+		}
+		if ok && isBareRule(tl) {
+			fmt.Printf("aaoptimizer: line %d: rule %q has no permissions, leaving it in place\n", n, tl)
+			ok = false
+		}
+		if ok {
+			if _, err := newRule(tl); err != nil {
+				fmt.Printf("aaoptimizer: line %d: %v, leaving it in place\n", n, err)
+				unparseable = append(unparseable, n)
+				ok = false
+			} else if !strings.HasSuffix(strings.TrimSpace(stripComment(tl)), ",") {
+				fmt.Printf("aaoptimizer: line %d: %q lacks the trailing comma\n", n, tl)
+				fixedUp = append(fixedUp, n)
+			}
+		}
+		if !ok {
+			sp.kept = append(sp.kept, blanks...)
+			sp.kept = append(sp.kept, l)
+			blanks, current = nil, nil
+			continue
+		}
+
+		if current == nil || current.prefix != p || current.profile != owner {
+			sp.kept = append(sp.kept, blanks...)
+			current = &streamRegion{
+				prefix:  p,
+				profile: owner,
+				indent:  l[:len(l)-len(strings.TrimLeft(l, " \t"))],
+				at:      len(sp.kept),
+				aa:      opts.optimizer(),
+			}
+			sp.regions = append(sp.regions, current)
+		}
+		blanks = nil
+		if err := current.aa.addRule(tl); err != nil {
+			fmt.Printf("aaoptimizer: %v\n", err)
+		}
+		current.count++
+	}
+	sp.kept = append(sp.kept, blanks...)
+	if opts.strict {
+		if err := strictError(unparseable, fixedUp); err != nil {
+			return nil, err
+		}
+	}
+	warnUnparseable(unparseable)
+	return sp, s.Err()
+}
+
+// optimize runs the optimizer over every region
+func (sp *streamedProfile) optimize(opts *options) {
+	for _, r := range sp.regions {
+		if opts.transformed != nil {
+			prefix := r.prefix
+			r.aa.onTransform = func(tx transformation) {
+				tx.File = opts.file
+				tx.Prefix = prefix
+				opts.transformed(tx)
+			}
+		}
+		r.aa.optimize()
+	}
+}
+
+// render writes the profile with every region replaced by its generated
+// block, rendering the rules straight from the trees
+func (sp *streamedProfile) render(w io.Writer, opts *options) error {
+	indent := func(r *streamRegion) string {
+		if opts.fragment {
+			return ""
+		}
+		return r.indent
+	}
+
+	last := 0
+	for _, r := range sp.regions {
+		for _, l := range sp.kept[last:r.at] {
+			fmt.Fprintln(w, l)
+		}
+		last = r.at
+		info := blockInfo{
+			Version: version,
+			Date:    time.Now().Format("2006-01-02"),
+			Prefix:  r.prefix,
+			Count:   r.count,
+		}
+		// like optimizeLines, a blank line in front of the rules is not
+		// doubled
+		if r.at == 0 || strings.TrimSpace(sp.kept[r.at-1]) != "" {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, indent(r)+strings.TrimPrefix(renderMarker(opts.markers.header, info), "  "))
+		err := render(w, r.aa, renderOptions{
+			indent:        indent(r),
+			align:         opts.align == "block",
+			sort:          opts.sort,
+			group:         opts.groupTemplate,
+			prefix:        r.prefix,
+			maxLineLength: opts.maxLineLength,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, l := range sp.kept[last:] {
+		fmt.Fprintln(w, l)
+	}
+	return nil
+}
+
+// streamOptimize optimizes the input into the output without holding the
+// lines of the rules being optimized in memory, for profiles too large
+// to be read whole
+func streamOptimize(input, output string, opts *options) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	er, err := scanExecRules(f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", input, err)
+	}
+	sp, err := scanProfile(f, opts, er)
+	if err != nil {
+		return fmt.Errorf("%s: %v", input, err)
+	}
+	sp.optimize(opts)
+	return writeFile(output, func(w *bufio.Writer) error {
+		return sp.render(w, opts)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// streamLines optimizes the lines the way --stream does
+func streamLines(t *testing.T, lines []string, opts *options) []string {
+	in := strings.Join(lines, "\n") + "\n"
+	er, err := scanExecRules(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := scanProfile(strings.NewReader(in), opts, er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.optimize(opts)
+	var buf bytes.Buffer
+	if err := sp.render(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func TestStreamMatchesNormal(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		lines   []string
+		exclude string
+		// pinned are the rules that must come through unchanged
+		pinned []string
+	}{{
+		name: "deny",
+		lines: []string{
+			"profile test {",
+			"  /sys/devices/a/x r,",
+			"  /sys/devices/a/y r,",
+			"  deny /sys/devices/secret r,",
+			"  /sys/devices/a/z r,",
+			"}",
+		},
+		pinned: []string{"  deny /sys/devices/secret r,"},
+	}, {
+		name: "keep",
+		lines: []string{
+			"profile test {",
+			"  /etc/foo r,",
+			"",
+			"  /sys/devices/a/x r,",
+			"  /sys/devices/a/y r, # aaopt: keep",
+			"  /sys/devices/a/z r,",
+			"  /sys/devices/a/w r,",
+			"}",
+		},
+		pinned: []string{"  /sys/devices/a/y r, # aaopt: keep"},
+	}, {
+		name: "exec overlap",
+		lines: []string{
+			"profile test {",
+			"  /sys/devices/bin/* Px,",
+			"  /sys/devices/bin/tool Cx,",
+			"  /sys/devices/c/x rw,",
+			"  /sys/devices/c/y rw,",
+			"}",
+		},
+		pinned: []string{"  /sys/devices/bin/* Px,", "  /sys/devices/bin/tool Cx,"},
+	}, {
+		name: "exclude",
+		lines: []string{
+			"profile test {",
+			"  /sys/devices/a/x r,",
+			"  /sys/devices/a/skip r,",
+			"  /sys/devices/a/y r,",
+			"}",
+		},
+		exclude: "*skip*",
+		pinned:  []string{"  /sys/devices/a/skip r,"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultOptions("test", &prefixSet{paths: []string{"/sys/devices"}})
+			if tc.exclude != "" {
+				re, err := parseExcludePattern(tc.exclude)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts.exclude = []*regexp.Regexp{re}
+			}
+			normal, _, err := optimizeLines(tc.lines, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamed := streamLines(t, tc.lines, opts)
+			if strings.Join(streamed, "\n") != strings.Join(normal, "\n") {
+				t.Errorf("--stream output differs\ngot:\n%s\nwant:\n%s", strings.Join(streamed, "\n"), strings.Join(normal, "\n"))
+			}
+			for _, p := range tc.pinned {
+				found := false
+				for _, l := range streamed {
+					found = found || l == p
+				}
+				if !found {
+					t.Errorf("pinned rule %q is missing from\n%s", p, strings.Join(streamed, "\n"))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Profiles may be templates using variables like %BINARY%, substituted
+// from a values file before optimizing. The values file holds VAR=value
+// lines, a [name] line starts the values of another instance of the
+// template, the values before the first one are shared by all instances.
+// The name of the instance is available as %NAME%.
+
+var templateVariable = regexp.MustCompile(`%([A-Za-z_][A-Za-z0-9_]*)%`)
+
+type instance struct {
+	name   string
+	values map[string]string
+}
+
+func loadInstances(path string) ([]instance, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := make(map[string]string)
+	var instances []instance
+	for i, l := range lines {
+		tl := strings.TrimSpace(l)
+		if tl == "" || strings.HasPrefix(tl, "#") {
+			continue
+		}
+		if strings.HasPrefix(tl, "[") && strings.HasSuffix(tl, "]") {
+			name := strings.TrimSpace(strings.Trim(tl, "[]"))
+			values := map[string]string{"NAME": name}
+			for k, v := range shared {
+				values[k] = v
+			}
+			instances = append(instances, instance{name, values})
+			continue
+		}
+		k, v, ok := strings.Cut(tl, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected VAR=value", path, i+1)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if len(instances) == 0 {
+			shared[k] = v
+		} else {
+			instances[len(instances)-1].values[k] = v
+		}
+	}
+	if len(instances) == 0 {
+		instances = append(instances, instance{values: shared})
+	}
+	return instances, nil
+}
+
+// apply substitutes the variables of the instance in s, variables the
+// instance has no value for are an error
+func (inst *instance) apply(s string) (string, error) {
+	if inst.values == nil {
+		return s, nil
+	}
+	var err error
+	out := templateVariable.ReplaceAllStringFunc(s, func(m string) string {
+		v, ok := inst.values[strings.Trim(m, "%")]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("no value for %s", m)
+			}
+			return m
+		}
+		return v
+	})
+	return out, err
+}
+
+func (inst *instance) applyLines(lines []string) ([]string, error) {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		var err error
+		if out[i], err = inst.apply(l); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the tunables every stock AppArmor install defines, used unless the
+// profile or its includes define them differently
+var defaultTunables = map[string][]string{
+	"PROC":     {"/proc/"},
+	"sys":      {"/sys/"},
+	"run":      {"/run/", "/var/run/"},
+	"HOMEDIRS": {"/home/"},
+	"HOME":     {"@{HOMEDIRS}/*/", "/root/"},
+}
+
+// parseVariable parses a variable definition like @{HOME}=/home/*/ /root/,
+// appending with += is supported.
+func parseVariable(l string) (string, []string, bool, bool) {
+	tl := strings.TrimSpace(stripComment(l))
+	if !strings.HasPrefix(tl, "@{") {
+		return "", nil, false, false
+	}
+	end := strings.Index(tl, "}")
+	if end < 0 {
+		return "", nil, false, false
+	}
+	name := tl[2:end]
+	rest := strings.TrimSpace(tl[end+1:])
+
+	appendValues := false
+	if strings.HasPrefix(rest, "+=") {
+		appendValues = true
+		rest = rest[2:]
+	} else if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	} else {
+		return "", nil, false, false
+	}
+	return name, strings.Fields(rest), appendValues, true
+}
+
+// loadTunables collects the variable definitions of the files on top of
+// the defaults.
+func loadTunables(files []string) map[string][]string {
+	tunables := make(map[string][]string)
+	for n, v := range defaultTunables {
+		tunables[n] = v
+	}
+
+	defined := make(map[string]bool)
+	for _, f := range files {
+		lines, err := readLines(f)
+		if err != nil {
+			continue
+		}
+		for _, l := range lines {
+			name, values, appendValues, ok := parseVariable(l)
+			if !ok {
+				continue
+			}
+			// the first definition replaces the default
+			if !appendValues && !defined[name] {
+				tunables[name] = nil
+			}
+			defined[name] = true
+			tunables[name] = append(tunables[name], values...)
+		}
+	}
+	return tunables
+}
+
+// resolveVariable expands the variables used in the value, returning all
+// the values it can take.
+func resolveVariable(value string, tunables map[string][]string, depth int) []string {
+	start := strings.Index(value, "@{")
+	if start < 0 || depth > 8 {
+		return []string{value}
+	}
+	end := strings.Index(value[start:], "}")
+	if end < 0 {
+		return []string{value}
+	}
+	end += start
+
+	var resolved []string
+	for _, v := range tunables[value[start+2:end]] {
+		for _, r := range resolveVariable(v, tunables, depth+1) {
+			joined := value[:start] + r + value[end+1:]
+			resolved = append(resolved, resolveVariable(joined, tunables, depth+1)...)
+		}
+	}
+	return resolved
+}
+
+func normalizePrefix(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.ReplaceAll(p, "//", "/")
+	}
+	return strings.TrimSuffix(p, "/")
+}
+
+type tunablePrefix struct {
+	name   string
+	prefix string
+	// others are the other values of the variable, which the rewritten
+	// rule grants too
+	others []string
+}
+
+// tunablePrefixes returns the path prefixes the tunables stand for,
+// longest first.
+func tunablePrefixes(tunables map[string][]string) []tunablePrefix {
+	var prefixes []tunablePrefix
+	for name := range tunables {
+		var values []string
+		for _, v := range tunables[name] {
+			for _, r := range resolveVariable(v, tunables, 0) {
+				if strings.HasPrefix(r, "/") {
+					values = append(values, normalizePrefix(r))
+				}
+			}
+		}
+		for i, v := range values {
+			if v == "" {
+				continue
+			}
+			tp := tunablePrefix{name: name, prefix: v}
+			tp.others = append(tp.others, values[:i]...)
+			tp.others = append(tp.others, values[i+1:]...)
+			prefixes = append(prefixes, tp)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i].prefix) != len(prefixes[j].prefix) {
+			return len(prefixes[i].prefix) > len(prefixes[j].prefix)
+		}
+		// prefer the variable with the fewest values
+		if len(prefixes[i].others) != len(prefixes[j].others) {
+			return len(prefixes[i].others) < len(prefixes[j].others)
+		}
+		return prefixes[i].name < prefixes[j].name
+	})
+	return prefixes
+}
+
+// refoldTunables rewrites the paths of the generated rules to use the
+// variables matching their prefix. Variables with several values widen the
+// rule, which is reported. Every rewrite is passed to transformed.
+func refoldTunables(rules []string, prefixes []tunablePrefix, transformed func(tx transformation)) []string {
+	var refolded []string
+	for _, l := range rules {
+		pr, ok := parseProfileRule(0, l)
+		if !ok || !pr.isFile() {
+			refolded = append(refolded, l)
+			continue
+		}
+
+		for _, tp := range prefixes {
+			if pr.path != tp.prefix && !strings.HasPrefix(pr.path, tp.prefix+"/") {
+				continue
+			}
+			path := "@{" + tp.name + "}" + pr.path[len(tp.prefix):]
+			if len(tp.others) > 0 {
+				fmt.Printf("aaoptimizer: rewriting %s to @{%s} also grants %s\n", tp.prefix, tp.name, strings.Join(tp.others, ", "))
+			}
+			nl := strings.Replace(l, pr.path, path, 1)
+			transformed(transformation{
+				Pass:     "tunables",
+				Inputs:   []string{strings.TrimSpace(l)},
+				Outputs:  []string{strings.TrimSpace(nl)},
+				Widening: len(tp.others) > 0,
+			})
+			l = nl
+			break
+		}
+		refolded = append(refolded, l)
+	}
+	return refolded
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+)
+
+// transformation is a single change made to the rules, written as one JSON
+// line to the --tx-log file
+type transformation struct {
+	Pass string `json:"pass"`
+	// File is the file the original rules are in
+	File   string `json:"file"`
+	Prefix string `json:"prefix"`
+	// Inputs are the rules replaced by Outputs
+	Inputs  []string `json:"inputs"`
+	Outputs []string `json:"outputs"`
+	// Widening is set if Outputs grant more than Inputs did
+	Widening bool `json:"widening"`
+	// Lines are the lines of the original rules covered by Inputs
+	Lines []int `json:"lines"`
+}
+
+type txLog struct {
+	f   *os.File
+	w   *bufio.Writer
+	err error
+}
+
+func createTxLog(path string) (*txLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &txLog{f: f, w: w}, nil
+}
+
+// write logs the value as one JSON line, the first error is kept and
+// returned by close
+func (t *txLog) write(v any) {
+	if t.err != nil {
+		return
+	}
+	t.err = json.NewEncoder(t.w).Encode(v)
+}
+
+func (t *txLog) close() error {
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	if err := t.f.Close(); t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// udev keeps the data of each device in /run/udev/data, named after its
+// type and major:minor numbers, i.e c236:0 or b8:16. Device heavy profiles
+// grant many of these, so they are folded by type and major instead of
+// being listed in generic alternations.
+var udevDevice = regexp.MustCompile(`^([bc])([0-9]+):([0-9]+|\*|\[0-9\]\*)$`)
+
+// udevMajor collects the minors granted for one type and major
+type udevMajor struct {
+	minors   []string
+	numeric  int
+	wildcard string
+}
+
+// fold returns the minor part covering all the minors, and whether it
+// grants more than the minors did
+func (um *udevMajor) fold() (string, bool) {
+	switch {
+	case um.wildcard == "*":
+		return "*", false
+	case um.wildcard != "":
+		return um.wildcard, false
+	case um.numeric > 1:
+		return "[0-9]*", true
+	}
+	return um.minors[0], false
+}
+
+func (aa *aaOptimizer) foldUdevDevices(b bucket, ctx string, l *leaf) {
+	if !aa.mayGeneralize(ctx) {
+		return
+	}
+	majors := make(map[string]map[string]*udevMajor)
+	parts := make(map[string][]string)
+	for _, c := range l.sortedChildren() {
+		m := udevDevice.FindStringSubmatch(c.part)
+		if m == nil || len(c.children) > 0 || aa.keptApart(ctx+"/"+c.part) {
+			continue
+		}
+		typ, major, minor := m[1], m[2], m[3]
+		if majors[major] == nil {
+			majors[major] = make(map[string]*udevMajor)
+		}
+		um := majors[major][typ]
+		if um == nil {
+			um = &udevMajor{}
+			majors[major][typ] = um
+		}
+		um.minors = append(um.minors, minor)
+		if _, err := strconv.Atoi(minor); err == nil {
+			um.numeric++
+		} else if um.wildcard != "*" {
+			um.wildcard = minor
+		}
+		parts[major] = append(parts[major], c.part)
+	}
+
+	var sorted []string
+	for major := range majors {
+		sorted = append(sorted, major)
+	}
+	sort.Strings(sorted)
+
+	for _, major := range sorted {
+		folded := make(map[string]string)
+		widening := false
+		for typ, um := range majors[major] {
+			minor, widens := um.fold()
+			if widens && !aa.mayIntroduce(minor) {
+				minor, widens = "", false
+			}
+			folded[typ] = minor
+			widening = widening || widens
+		}
+
+		var news []string
+		bm, hasB := folded["b"]
+		cm, hasC := folded["c"]
+		if hasB && hasC && bm != "" && bm == cm {
+			news = []string{"[bc]" + major + ":" + bm}
+		} else {
+			for _, typ := range []string{"b", "c"} {
+				if minor := folded[typ]; minor != "" {
+					news = append(news, typ+major+":"+minor)
+				} else if um := majors[major][typ]; um != nil {
+					for _, minor := range um.minors {
+						news = append(news, typ+major+":"+minor)
+					}
+				}
+			}
+		}
+		if len(news) == len(parts[major]) {
+			continue
+		}
+
+		var inputs []string
+		for _, p := range parts[major] {
+			inputs = append(inputs, ctx+"/"+p)
+			delete(l.children, p)
+		}
+		var outputs []string
+		for _, p := range news {
+			outputs = append(outputs, ctx+"/"+p)
+			l.children[p] = newLeaf(p)
+		}
+		if aa.onTransform != nil {
+			aa.transformed("udev", widening, b.rules(inputs), b.rules(outputs))
+		}
+	}
+}
+
+func (aa *aaOptimizer) optimizeTreeUdev(b bucket, ctx string, l *leaf) {
+	if strings.HasSuffix(ctx, "/run/udev/data") {
+		aa.foldUdevDevices(b, ctx, l)
+		return
+	}
+	for _, c := range l.sortedChildren() {
+		aa.optimizeTreeUdev(b, ctx+"/"+c.part, c)
+	}
+}
+
+// Combine things like:
+// /run/udev/data/c236:0 r,
+// /run/udev/data/c236:1 r,
+func (aa *aaOptimizer) optimizeUdev() {
+	aa.eachTree(func(b bucket, l *leaf) {
+		aa.optimizeTreeUdev(b, "", l)
+	})
+}
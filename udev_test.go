@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFoldUdev(t *testing.T) {
+	lines := []string{
+		"profile test {",
+		"  /run/udev/data/c236:0 r,",
+		"  /run/udev/data/c236:1 r,",
+		"  /run/udev/data/b8:16 r,",
+		"}",
+	}
+	for _, tc := range []struct {
+		name     string
+		foldUdev bool
+		lossless bool
+		want     string
+	}{
+		{"default", false, false, "/run/udev/data/{b8:16,c236:0,c236:1} r,"},
+		{"lossless", false, true, "/run/udev/data/{b8:16,c236:0,c236:1} r,"},
+		{"fold-udev", true, false, "/run/udev/data/{b8:16,c236:[0-9]*} r,"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultOptions("test", &prefixSet{paths: []string{"/run/udev"}})
+			opts.foldUdev = tc.foldUdev
+			opts.lossless = tc.lossless
+			optimized, _, err := optimizeLines(lines, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, l := range optimized {
+				found = found || strings.TrimSpace(l) == tc.want
+			}
+			if !found {
+				t.Errorf("%q is missing from\n%s", tc.want, strings.Join(optimized, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// number of lines recorded before and after each generated block, used to
+// find the block again if the file was edited
+const sidecarContext = 3
+
+type sidecarRegion struct {
+	// Start is the line index of the generated block in the output
+	Start     int      `json:"start"`
+	Generated []string `json:"generated"`
+	Original  []string `json:"original"`
+	Before    []string `json:"before"`
+	After     []string `json:"after"`
+	// OriginalLine is the 1-based line the original rules started at in
+	// the input
+	OriginalLine int `json:"originalLine,omitempty"`
+}
+
+type sidecar struct {
+	Input   string          `json:"input"`
+	Regions []sidecarRegion `json:"regions"`
+}
+
+func sidecarPath(output string) string {
+	return output + ".aaopt.json"
+}
+
+func newSidecar(input string, lines, out []string, regions []*region) *sidecar {
+	sc := &sidecar{Input: input}
+	for _, r := range regions {
+		end := r.outStart + len(r.generated)
+		before := r.outStart - sidecarContext
+		if before < 0 {
+			before = 0
+		}
+		after := end + sidecarContext
+		if after > len(out) {
+			after = len(out)
+		}
+		sc.Regions = append(sc.Regions, sidecarRegion{
+			Start:        r.outStart,
+			Generated:    r.generated,
+			OriginalLine: r.start + 1,
+			Original:     lines[r.start:r.end],
+			Before:       out[before:r.outStart],
+			After:        out[end:after],
+		})
+	}
+	return sc
+}
+
+func writeSidecar(sc *sidecar, path string) error {
+	data, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func readSidecar(path string) (*sidecar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc sidecar
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	return &sc, nil
+}
+
+func linesMatchAt(lines []string, at int, want []string) bool {
+	if at < 0 || at+len(want) > len(lines) {
+		return false
+	}
+	for i, w := range want {
+		if lines[at+i] != w {
+			return false
+		}
+	}
+	return true
+}
+
+// contextScore counts how many of the recorded context lines are still
+// found around the block
+func contextScore(lines []string, at, end int, sr *sidecarRegion) int {
+	score := 0
+	for i := range sr.Before {
+		j := at - len(sr.Before) + i
+		if j >= 0 && lines[j] == sr.Before[i] {
+			score++
+		}
+	}
+	for i := range sr.After {
+		j := end + i
+		if j < len(lines) && lines[j] == sr.After[i] {
+			score++
+		}
+	}
+	return score
+}
+
+// locateRegion finds the generated block in the lines. Like patch, the
+// recorded position is tried first, otherwise the candidate with the best
+// matching context closest to the recorded position wins.
+func locateRegion(lines []string, sr *sidecarRegion) (int, bool) {
+	if linesMatchAt(lines, sr.Start, sr.Generated) &&
+		contextScore(lines, sr.Start, sr.Start+len(sr.Generated), sr) == len(sr.Before)+len(sr.After) {
+		return sr.Start, true
+	}
+
+	best := -1
+	bestScore := -1
+	bestDistance := 0
+	for at := 0; at+len(sr.Generated) <= len(lines); at++ {
+		if !linesMatchAt(lines, at, sr.Generated) {
+			continue
+		}
+		score := contextScore(lines, at, at+len(sr.Generated), sr)
+		distance := at - sr.Start
+		if distance < 0 {
+			distance = -distance
+		}
+		if score > bestScore || (score == bestScore && distance < bestDistance) {
+			best = at
+			bestScore = score
+			bestDistance = distance
+		}
+	}
+	return best, best >= 0
+}
+
+// undo restores the original rules of every region in the sidecar. The
+// stamp is dropped, it no longer matches once the rules are restored.
+func undo(lines []string, sc *sidecar) ([]string, error) {
+	var unstamped []string
+	for _, l := range lines {
+		if !stampLine.MatchString(l) {
+			unstamped = append(unstamped, l)
+		}
+	}
+	lines = unstamped
+	type located struct {
+		at int
+		sr *sidecarRegion
+	}
+	var found []located
+	for i := range sc.Regions {
+		sr := &sc.Regions[i]
+		at, ok := locateRegion(lines, sr)
+		if !ok {
+			return nil, fmt.Errorf("cannot find generated block %d (originally at line %d)", i+1, sr.Start+1)
+		}
+		found = append(found, located{at, sr})
+	}
+
+	// replace from the bottom up so the earlier positions stay valid
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].at > found[j].at
+	})
+	for i := 1; i < len(found); i++ {
+		if found[i].at+len(found[i].sr.Generated) > found[i-1].at {
+			return nil, fmt.Errorf("generated blocks at lines %d and %d overlap", found[i].at+1, found[i-1].at+1)
+		}
+	}
+
+	for _, f := range found {
+		var restored []string
+		restored = append(restored, lines[:f.at]...)
+		restored = append(restored, f.sr.Original...)
+		restored = append(restored, lines[f.at+len(f.sr.Generated):]...)
+		lines = restored
+	}
+	return lines, nil
+}
+
+func undoMain(args []string) {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	sidecarFile := fs.String("sidecar", "", "sidecar file to undo from (default [profile].aaopt.json)")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer undo [flags] [profile] [output]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	output := input
+	if fs.NArg() > 1 {
+		output = fs.Arg(1)
+	}
+	if *sidecarFile == "" {
+		*sidecarFile = sidecarPath(input)
+	}
+
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	sc, err := readSidecar(*sidecarFile)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+
+	restored, err := undo(lines, sc)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	if err := writeLines(restored, output); err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+}
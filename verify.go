@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A corpus is a directory of profiles named [case].in, each with the
+// output expected from the optimizer in [case].expected. The flags of a
+// case can be given in [case].args, whitespace separated.
+
+type corpusCase struct {
+	name     string
+	input    string
+	expected string
+	args     []string
+}
+
+func findCorpusCases(dir string) ([]corpusCase, error) {
+	inputs, err := filepath.Glob(filepath.Join(dir, "*.in"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(inputs)
+
+	var cases []corpusCase
+	for _, in := range inputs {
+		base := strings.TrimSuffix(in, ".in")
+		c := corpusCase{name: filepath.Base(base), input: in, expected: base + ".expected"}
+		if data, err := os.ReadFile(base + ".args"); err == nil {
+			c.args = strings.Fields(string(data))
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+// firstDifference returns the 1-based line the outputs first differ at, or
+// 0 if they are the same
+func firstDifference(got, want []string) int {
+	for i := 0; i < len(got) && i < len(want); i++ {
+		if got[i] != want[i] {
+			return i + 1
+		}
+	}
+	if len(got) == len(want) {
+		return 0
+	}
+	if len(got) < len(want) {
+		return len(got) + 1
+	}
+	return len(want) + 1
+}
+
+func lineAt(lines []string, line int) string {
+	if line > len(lines) {
+		return "<end of file>"
+	}
+	return fmt.Sprintf("%q", lines[line-1])
+}
+
+// verifyCase runs the optimizer binary over the case, so the corpus checks
+// exactly what a user of the binary would get, and compares the output
+// with the expected one. With update set the expected output is rewritten
+// instead.
+func verifyCase(exe string, c corpusCase, tmp string, update bool) (string, error) {
+	out := filepath.Join(tmp, c.name+".out")
+	args := append([]string{"--no-cache"}, c.args...)
+	args = append(args, c.input, out)
+	cmd := exec.Command(exe, args...)
+	if log, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(log)))
+	}
+
+	got, err := readLines(out)
+	if err != nil {
+		return "", err
+	}
+	if update {
+		return "", writeLines(got, c.expected)
+	}
+	want, err := readLines(c.expected)
+	if err != nil {
+		return "", err
+	}
+	line := firstDifference(got, want)
+	if line == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("line %d: got %s, expected %s", line, lineAt(got, line), lineAt(want, line)), nil
+}
+
+func verifyCorpusMain(args []string) {
+	fs := flag.NewFlagSet("verify-corpus", flag.ExitOnError)
+	update := fs.Bool("update", false, "rewrite the expected outputs instead of comparing them")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer verify-corpus [flags] [directory]")
+		fmt.Println("runs the optimizer over every [case].in of the directory, with the flags")
+		fmt.Println("in [case].args, and compares the result with [case].expected")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	cases, err := findCorpusCases(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	if len(cases) == 0 {
+		fmt.Printf("aaoptimizer: no cases found in %s\n", fs.Arg(0))
+		os.Exit(-1)
+	}
+	tmp, err := os.MkdirTemp("", "aaopt-corpus")
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+
+	failed := 0
+	for _, c := range cases {
+		mismatch, err := verifyCase(exe, c, tmp, *update)
+		switch {
+		case err != nil:
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			failed++
+		case mismatch != "":
+			fmt.Printf("FAIL %s: %s\n", c.name, mismatch)
+			failed++
+		case *update:
+			fmt.Printf("updated %s\n", c.name)
+		default:
+			fmt.Printf("ok   %s\n", c.name)
+		}
+	}
+	os.RemoveAll(tmp)
+
+	fmt.Printf("%d of %d cases passed\n", len(cases)-failed, len(cases))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime/debug"
+)
+
+// optimizerPass is a pass of the optimizer, flag is the flag enabling it
+// or empty if it always runs
+type optimizerPass struct {
+	Name string `json:"name"`
+	Flag string `json:"flag,omitempty"`
+}
+
+// optimizerPasses are the passes in the order optimize runs them
+var optimizerPasses = []optimizerPass{
+	{"subset perms pass", "merge-subset-perms"},
+	{"home pass", "generalize-home"},
+	{"pid pass", "fold-pids"},
+	{"fold pass", "fold"},
+	{"single character pass", "fold-single-char"},
+	{"negated class pass", "negated-classes"},
+	{"pass 0", ""},
+	{"udev pass", "fold-udev"},
+	{"pass 1", ""},
+	{"pass 2", ""},
+}
+
+// syntaxFeatures are the parts of the AppArmor policy syntax the tool
+// understands
+var syntaxFeatures = []string{
+	"file-rules",
+	"capability-rules",
+	"qualifiers:audit,deny,owner,allow,file",
+	"exec-transitions",
+	"alternations",
+	"character-classes",
+	"variables",
+	"boolean-variables",
+	"conditionals",
+	"includes",
+	"include-if-exists",
+	"child-profiles",
+	"hats",
+	"markers:keep,no-merge,group,fold",
+}
+
+// subcommands are the commands besides optimizing
+var subcommands = []string{
+	"lint", "stats", "undo", "cache", "verify-corpus", "rename", "simulate",
+	"export-regex", "why", "matches", "init", "import-strace", "record",
+	"abstractions", "export", "diff", "selftest",
+}
+
+type buildInfo struct {
+	Version string `json:"version"`
+	Module  string `json:"module,omitempty"`
+	// ModuleVersion is the version go derived from the module, version
+	// being what the generated headers carry
+	ModuleVersion string          `json:"moduleVersion,omitempty"`
+	GoVersion     string          `json:"goVersion,omitempty"`
+	Revision      string          `json:"revision,omitempty"`
+	Modified      bool            `json:"modified,omitempty"`
+	Features      []string        `json:"features"`
+	Passes        []optimizerPass `json:"passes"`
+	Commands      []string        `json:"commands"`
+}
+
+// printVersion writes the version along with what the build supports as
+// JSON, for tooling to check for capabilities
+func printVersion() error {
+	info := buildInfo{
+		Version:  version,
+		Features: syntaxFeatures,
+		Passes:   optimizerPasses,
+		Commands: subcommands,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path
+		info.GoVersion = bi.GoVersion
+		if bi.Main.Version != "(devel)" {
+			info.ModuleVersion = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Revision = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// matchingRules returns the file rules matching the path with any of the
+// permissions
+func matchingRules(rules []profileRule, a access) []profileRule {
+	var matching []profileRule
+	for _, r := range rules {
+		if !r.isFile() || !aare.Match(r.path, a.path) {
+			continue
+		}
+		for _, p := range a.perms {
+			if permsCover(r.perms, string(p)) {
+				matching = append(matching, r)
+				break
+			}
+		}
+	}
+	return matching
+}
+
+// originRules returns the original rules the generated rule on the 1-based
+// line of the output came from, along with their lines in the input. Only
+// the original rules matching the access are returned.
+func originRules(sc *sidecar, line int, generated profileRule, a access) ([]profileRule, bool) {
+	for _, sr := range sc.Regions {
+		if line <= sr.Start || line > sr.Start+len(sr.Generated) {
+			continue
+		}
+		var origins []profileRule
+		for i, l := range sr.Original {
+			o, ok := parseProfileRule(sr.OriginalLine+i, l)
+			if !ok || !o.isFile() || o.deny != generated.deny || o.owner != generated.owner {
+				continue
+			}
+			if canonicalPerms(o.perms) != canonicalPerms(generated.perms) || o.target != generated.target {
+				continue
+			}
+			if aare.Match(o.path, a.path) && aare.Covers(generated.path, o.path) {
+				origins = append(origins, o)
+			}
+		}
+		return origins, true
+	}
+	return nil, false
+}
+
+func whyMain(args []string) {
+	fs := flag.NewFlagSet("why", flag.ExitOnError)
+	sidecarFile := fs.String("sidecar", "", "sidecar file recorded when the profile was optimized, [profile].aaopt.json by default")
+	fs.Usage = func() {
+		fmt.Println("usage: aaoptimizer why [flags] [profile] [path] [perms]")
+		fmt.Println("explains which rules of an optimized profile decide the access, and which original rules they came from")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 3 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	input := fs.Arg(0)
+	a := access{path: fs.Arg(1), perms: fs.Arg(2)}
+	lines, err := readLines(input)
+	if err != nil {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+	if *sidecarFile == "" {
+		*sidecarFile = sidecarPath(input)
+	}
+	sc, err := readSidecar(*sidecarFile)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("aaoptimizer: %v\n", err)
+		os.Exit(-1)
+	}
+
+	rules := parseProfileRules(lines)
+	d := simulateAccess(rules, a)
+	fmt.Printf("%s %s: %s\n", a.path, a.perms, d)
+
+	matching := matchingRules(rules, a)
+	if len(matching) == 0 {
+		fmt.Println("no rule matches the path")
+	}
+	for _, r := range matching {
+		fmt.Printf("  %s: %s\n", r.ref(), r.text)
+		if sc == nil {
+			continue
+		}
+		origins, generated := originRules(sc, r.line, r, a)
+		if !generated {
+			fmt.Println("    written as it is in the input")
+			continue
+		}
+		for _, o := range origins {
+			fmt.Printf("    from line %d of %s: %s\n", o.line, sc.Input, strings.TrimSpace(o.text))
+		}
+		if len(origins) == 0 {
+			fmt.Println("    generated, but no original rule granted the path")
+		}
+	}
+	if sc == nil {
+		fmt.Printf("no sidecar found at %s, optimize with --sidecar to trace generated rules to the original ones\n", *sidecarFile)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"test/aaoptimizer/aare"
+)
+
+// splitRule spreads the members of the largest alternation of the rule's
+// path over several rules, each taking as many members as fits allows. The
+// boolean is false if the rule has no alternation to split.
+func splitRule(l string, fits func(rule string) bool) ([]string, bool) {
+	head, rest, ok := splitRuleColumns(l)
+	if !ok {
+		return nil, false
+	}
+	pr, _ := parseProfileRule(0, l)
+	pathStart := len(head) - len(pr.path)
+
+	var largest *aare.Group
+	groups := aare.Groups(pr.path)
+	for i := range groups {
+		if largest == nil || len(groups[i].Members) > len(largest.Members) {
+			largest = &groups[i]
+		}
+	}
+	if largest == nil || len(largest.Members) < 2 {
+		return nil, false
+	}
+
+	before := head[:pathStart] + pr.path[:largest.Start]
+	after := pr.path[largest.End+1:] + " " + rest
+	build := func(members []string) string {
+		return before + aare.JoinAlternation(members) + after
+	}
+
+	var rules []string
+	var chunk []string
+	for _, m := range largest.Members {
+		if len(chunk) > 0 && !fits(build(append(chunk, m))) {
+			rules = append(rules, build(chunk))
+			chunk = nil
+		}
+		chunk = append(chunk, m)
+	}
+	return append(rules, build(chunk)), true
+}
+
+// wrapRule splits a rule longer than max into several rules, each taking
+// a share of the members of its largest alternation. Rules that cannot be
+// split any further are returned as they are.
+func wrapRule(l string, max int) []string {
+	if len(l) <= max {
+		return []string{l}
+	}
+	rules, ok := splitRule(l, func(r string) bool {
+		return len(r) <= max
+	})
+	// nothing gained, avoid splitting forever
+	if !ok || len(rules) == 1 {
+		return []string{l}
+	}
+
+	var wrapped []string
+	for _, r := range rules {
+		wrapped = append(wrapped, wrapRule(r, max)...)
+	}
+	return wrapped
+}
+
+func wrapRules(rules []string, max int) []string {
+	if max <= 0 {
+		return rules
+	}
+	var wrapped []string
+	for _, r := range rules {
+		wrapped = append(wrapped, wrapRule(r, max)...)
+	}
+	return wrapped
+}
+
+// expansionLimit caps expansionSize, it fits an int on 32 bit platforms
+const expansionLimit = math.MaxInt32
+
+// expansionSize returns the number of patterns the alternations of the
+// pattern expand into, as apparmor_parser does when compiling it
+func expansionSize(p string) int {
+	size := 1
+	for _, g := range aare.Groups(p) {
+		n := 0
+		for _, m := range g.Members {
+			m := expansionSize(m)
+			if m >= expansionLimit-n {
+				return expansionLimit
+			}
+			n += m
+		}
+		if n > 0 && size > expansionLimit/n {
+			return expansionLimit
+		}
+		size *= n
+	}
+	return size
+}
+
+func ruleExpansionSize(l string) int {
+	pr, ok := parseProfileRule(0, l)
+	if !ok || !pr.isFile() {
+		return 1
+	}
+	return expansionSize(pr.path)
+}
+
+// splitExpansion splits a rule expanding into more than max patterns into
+// several rules within the budget, like wrapRule. Rules that cannot be
+// split any further are returned as they are.
+func splitExpansion(l string, max int) []string {
+	if ruleExpansionSize(l) <= max {
+		return []string{l}
+	}
+	rules, ok := splitRule(l, func(r string) bool {
+		return ruleExpansionSize(r) <= max
+	})
+	if !ok || len(rules) == 1 {
+		return []string{l}
+	}
+
+	var split []string
+	for _, r := range rules {
+		split = append(split, splitExpansion(r, max)...)
+	}
+	return split
+}
+
+// limitExpansion splits the rules expanding into more than max patterns,
+// failing on rules that are over the budget even when split. A max of 0
+// means no limit.
+func limitExpansion(rules []string, max int) ([]string, error) {
+	if max <= 0 {
+		return rules, nil
+	}
+	var limited []string
+	for _, r := range rules {
+		for _, sr := range splitExpansion(r, max) {
+			if n := ruleExpansionSize(sr); n > max {
+				return nil, fmt.Errorf("rule %q expands into %d patterns, more than the budget of %d", strings.TrimSpace(sr), n, max)
+			}
+			limited = append(limited, sr)
+		}
+	}
+	return limited, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeLines replaces the file with the lines
+func writeLines(lines []string, path string) error {
+	return writeFile(path, func(w *bufio.Writer) error {
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		return nil
+	})
+}
+
+// writeFile replaces the file with what fill writes. It is written to a
+// temporary file next to it which is renamed over it once synced, so the
+// file is never left partially written. Files that are not regular, like
+// /dev/stdout, are written to directly.
+func writeFile(path string, fill func(w *bufio.Writer) error) error {
+	// replace the file a symlink points to rather than the symlink
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	fi, err := os.Stat(path)
+	if err == nil && !fi.Mode().IsRegular() {
+		return writeFileTo(path, os.O_WRONLY|os.O_TRUNC, fill)
+	}
+
+	// new files get the mode os.Create would have given them, replaced
+	// ones keep their mode, ownership and extended attributes
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".aaopt-"+strconv.Itoa(os.Getpid()))
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if fi != nil {
+		err := copyAttributes(path, tmp, fi)
+		if err == nil {
+			err = tmp.Chmod(fi.Mode().Perm())
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(tmp)
+	err = fill(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func writeFileTo(path string, flags int, fill func(w *bufio.Writer) error) error {
+	file, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err := fill(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// backupName returns the name of the nth backup of the file. The backups
+// are hidden files next to it, apparmor skips those when loading the
+// profiles of a directory, like the .dpkg-old files, but would load
+// profile.1 as a profile of its own.
+func backupName(path string, i int) string {
+	dir, base := filepath.Split(path)
+	return filepath.Join(dir, "."+base+".aaopt-bak."+strconv.Itoa(i))
+}
+
+// rotateBackups keeps the current content of the file as its first
+// backup, moving the earlier backups up to the nth
+func rotateBackups(path string, n int) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	backup := func(i int) string {
+		return backupName(path, i)
+	}
+	if err := os.Remove(backup(n)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := n - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// the file itself stays in place until the new one is renamed over it
+	if err := os.Link(path, backup(1)); err == nil {
+		return nil
+	}
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	return writeLines(lines, backup(1))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// copyAttributes gives the file the owner and the extended attributes,
+// like the SELinux label, of the file at path. Attributes that cannot be
+// set without privileges are skipped with a warning rather than failing
+// the write.
+func copyAttributes(path string, f *os.File, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		err := f.Chown(int(st.Uid), int(st.Gid))
+		if err != nil && !os.IsPermission(err) {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("warning: cannot keep the owner of %s: %v\n", path, err)
+		}
+	}
+
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		// the filesystem may not support extended attributes
+		return nil
+	}
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(path, names)
+	if err != nil {
+		return nil
+	}
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getxattr(path, string(name))
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setxattr(f.Name(), string(name), value, 0); err != nil {
+			fmt.Printf("warning: cannot keep the %s attribute of %s: %v\n", name, path, err)
+		}
+	}
+	return nil
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
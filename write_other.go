@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// copyAttributes only keeps the mode outside of Linux, which writeLines
+// takes care of
+func copyAttributes(path string, f *os.File, fi os.FileInfo) error {
+	return nil
+}